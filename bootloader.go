@@ -0,0 +1,230 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrorBootloaderNotFound = errors.New("keyboard reset, but no known bootloader appeared")
+
+const (
+	// How long a keyboard has to refuse id_bootloader_jump before it is
+	// assumed to have reset
+	bootloaderReplyTimeout = 250 * time.Millisecond
+	// Time between enumerations while waiting for a bootloader
+	bootloaderPollInterval = 100 * time.Millisecond
+)
+
+// Bootloader identifies a USB bootloader by vendor and product ID
+type Bootloader struct {
+	Name      string
+	VendorID  uint16
+	ProductID uint16
+	// The enumerated device, where reported by JumpToBootloader
+	Device Keyboard
+}
+
+func (b Bootloader) String() string {
+	return fmt.Sprintf("%s (%04x:%04x)", b.Name, b.VendorID, b.ProductID)
+}
+
+// KnownBootloaders lists the bootloaders that QMK keyboards jump to
+var KnownBootloaders = []Bootloader{
+	{Name: "atmel-dfu", VendorID: 0x03EB, ProductID: 0x2FEF},
+	{Name: "atmel-dfu", VendorID: 0x03EB, ProductID: 0x2FF0},
+	{Name: "atmel-dfu", VendorID: 0x03EB, ProductID: 0x2FF3},
+	{Name: "atmel-dfu", VendorID: 0x03EB, ProductID: 0x2FF4},
+	{Name: "atmel-dfu", VendorID: 0x03EB, ProductID: 0x2FF9},
+	{Name: "atmel-dfu", VendorID: 0x03EB, ProductID: 0x2FFA},
+	{Name: "atmel-dfu", VendorID: 0x03EB, ProductID: 0x2FFB},
+	{Name: "qmk-hid", VendorID: 0x03EB, ProductID: 0x2067},
+	{Name: "caterina", VendorID: 0x2341, ProductID: 0x0036},
+	{Name: "caterina", VendorID: 0x2341, ProductID: 0x0037},
+	{Name: "caterina", VendorID: 0x1B4F, ProductID: 0x9203},
+	{Name: "caterina", VendorID: 0x1B4F, ProductID: 0x9205},
+	{Name: "caterina", VendorID: 0x239A, ProductID: 0x000C},
+	{Name: "caterina", VendorID: 0x239A, ProductID: 0x000D},
+	{Name: "caterina", VendorID: 0x239A, ProductID: 0x000E},
+	{Name: "halfkay", VendorID: 0x16C0, ProductID: 0x0478},
+	{Name: "bootloadhid", VendorID: 0x16C0, ProductID: 0x05DF},
+	{Name: "usbasploader", VendorID: 0x16C0, ProductID: 0x05DC},
+	{Name: "stm32-dfu", VendorID: 0x0483, ProductID: 0xDF11},
+	{Name: "apm32-dfu", VendorID: 0x314B, ProductID: 0x0106},
+	{Name: "gd32v-dfu", VendorID: 0x28E9, ProductID: 0x0189},
+	{Name: "wb32-dfu", VendorID: 0x342D, ProductID: 0xDFA0},
+	{Name: "kiibohd", VendorID: 0x1C11, ProductID: 0xB007},
+	{Name: "stm32duino", VendorID: 0x1EAF, ProductID: 0x0003},
+	{Name: "rp2040", VendorID: 0x2E8A, ProductID: 0x0003},
+}
+
+// findBootloader matches a device against KnownBootloaders
+func findBootloader(device Keyboard) (Bootloader, bool) {
+	for _, bootloader := range KnownBootloaders {
+		if bootloader.VendorID == device.VendorID && bootloader.ProductID == device.ProductID {
+			bootloader.Device = device
+			return bootloader, true
+		}
+	}
+	return Bootloader{}, false
+}
+
+// BootloaderOption configures JumpToBootloader
+type BootloaderOption func(*bootloaderOptions)
+
+type bootloaderOptions struct {
+	wait      time.Duration
+	enumerate func() []Keyboard
+}
+
+func newBootloaderOptions(opts []BootloaderOption) bootloaderOptions {
+	options := bootloaderOptions{
+		enumerate: enumerateBootloaders,
+	}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+// WaitForBootloader waits up to timeout for a known bootloader to enumerate
+// after the jump
+func WaitForBootloader(timeout time.Duration) BootloaderOption {
+	return func(o *bootloaderOptions) {
+		o.wait = timeout
+	}
+}
+
+// enumerateBootloaders lists HID devices and, on Linux, every other USB
+// device, as bootloaders are often DFU, serial or mass storage devices
+func enumerateBootloaders() []Keyboard {
+	return append(enumerateDevices(), enumerateUSB()...)
+}
+
+// WithBootloaderEnumerate replaces the device enumeration used to spot the
+// bootloader. By default HID devices are listed, and on Linux every USB device
+// in sysfs. Elsewhere only HID bootloaders (qmk-hid, halfkay and bootloadhid)
+// are seen unless enumerate lists the others.
+func WithBootloaderEnumerate(enumerate func() []Keyboard) BootloaderOption {
+	return func(o *bootloaderOptions) {
+		o.enumerate = enumerate
+	}
+}
+
+func (c *client) JumpToBootloader(opts ...BootloaderOption) (Bootloader, error) {
+	options := newBootloaderOptions(opts)
+
+	// Bootloaders attached before the jump belong to some other device
+	present := map[string]bool{}
+	if options.wait > 0 {
+		for _, device := range options.enumerate() {
+			present[bootloaderKey(device)] = true
+		}
+	}
+	if err := c.jump(); err != nil {
+		return Bootloader{}, err
+	}
+	if options.wait <= 0 {
+		return Bootloader{}, nil
+	}
+	return c.waitForBootloader(options, present)
+}
+
+// jump sends id_bootloader_jump once. QMK echoes the command before it
+// resets, though the reply can be lost as the device goes away, so only an
+// explicit refusal is an error, and the client is closed after.
+func (c *client) jump() error {
+	request := make([]byte, HidMessageSize)
+	request[0] = BootloaderJumpId
+	failure := newProtocolError(request, ErrorReadWrite)
+
+	if err := c.lock(); err != nil {
+		failure.Err = err
+		return failure
+	}
+	defer c.unlock()
+
+	if c.closed {
+		failure.Err = ErrorClientClosed
+		return failure
+	}
+	if c.lost {
+		if err := c.reconnect(); err != nil {
+			failure.Cause = fmt.Errorf("reconnect failed: %w", err)
+			return failure
+		}
+	}
+
+	failure.Attempts++
+	message := append([]byte{}, request...)
+	wrote, err := c.transport.Write(message)
+	if err == nil && wrote != HidMessageSize {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		failure.Cause = err
+		return failure
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, bootloaderReplyTimeout)
+	defer cancel()
+	read, err := readContext(ctx, c.transport, message)
+	if c.ctx.Err() != nil {
+		failure.Err = c.ctx.Err()
+		return failure
+	}
+	if err == nil && read == HidMessageSize && message[0] == UnhandledId {
+		failure.Response = append([]byte{}, message...)
+		failure.Err = ErrorUnknownCommand
+		return failure
+	}
+
+	// The echo, or anything else including a failed read, is the keyboard
+	// going away
+	c.closed = true
+	c.InvalidateCache()
+	c.transport.Close()
+	c.lost = true
+	return nil
+}
+
+// waitForBootloader polls for a known bootloader not in present
+func (c *client) waitForBootloader(options bootloaderOptions, present map[string]bool) (Bootloader, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, options.wait)
+	defer cancel()
+
+	ticker := time.NewTicker(bootloaderPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, device := range options.enumerate() {
+			if present[bootloaderKey(device)] {
+				continue
+			}
+			if bootloader, ok := findBootloader(device); ok {
+				return bootloader, nil
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := c.ctx.Err(); err != nil {
+				return Bootloader{}, err
+			}
+			return Bootloader{}, ErrorBootloaderNotFound
+		}
+	}
+}
+
+func bootloaderKey(device Keyboard) string {
+	return fmt.Sprintf("%04x:%04x:%s", device.VendorID, device.ProductID, device.Path)
+}
@@ -0,0 +1,120 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/qmktest"
+)
+
+func TestJumpToBootloader(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+
+	bootloader, err := client.JumpToBootloader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bootloader != (qmk.Bootloader{}) {
+		t.Errorf("wanted no bootloader without waiting, got %v", bootloader)
+	}
+	if !emulator.InBootloader() {
+		t.Error("wanted emulator in bootloader")
+	}
+	if _, err := client.GetUptime(); !errors.Is(err, qmk.ErrorClientClosed) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorClientClosed, err)
+	}
+}
+
+func TestJumpToBootloaderReopen(t *testing.T) {
+	emulator := qmktest.NewEmulator(qmktest.DefaultConfig)
+	original := &closeCountingTransport{Emulator: emulator}
+	client, err := qmk.NewClientWithTransport(original, qmk.WithReopen(func() (qmk.Transport, error) {
+		return qmktest.NewEmulator(qmktest.DefaultConfig), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.JumpToBootloader(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetUptime(); err != nil {
+		t.Errorf("wanted reopened client to work, got %v", err)
+	}
+	if original.closes != 1 {
+		t.Errorf("wanted the original transport closed once, got %d", original.closes)
+	}
+}
+
+func TestJumpToBootloaderRefused(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.BootloaderJump = false
+	client, emulator := newTestClient(t, config)
+
+	if _, err := client.JumpToBootloader(); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+	if emulator.InBootloader() {
+		t.Error("wanted emulator not in bootloader")
+	}
+	if _, err := client.GetUptime(); err != nil {
+		t.Errorf("wanted client usable after refusal, got %v", err)
+	}
+}
+
+func TestJumpToBootloaderWait(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+
+	var (
+		mu sync.Mutex
+		// Another keyboard already sitting in its bootloader
+		devices = []qmk.Keyboard{{Path: "other", VendorID: 0x03EB, ProductID: 0x2FF4}}
+		calls   = 0
+	)
+	enumerate := func() []qmk.Keyboard {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if emulator.InBootloader() && calls == 3 {
+			devices = append(devices, qmk.Keyboard{Path: "halfkay", VendorID: 0x16C0, ProductID: 0x0478})
+		}
+		return devices
+	}
+
+	bootloader, err := client.JumpToBootloader(
+		qmk.WaitForBootloader(time.Second),
+		qmk.WithBootloaderEnumerate(enumerate),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bootloader.Name != "halfkay" || bootloader.VendorID != 0x16C0 || bootloader.ProductID != 0x0478 {
+		t.Errorf("wanted bootloader halfkay (16c0:0478), got %v", bootloader)
+	}
+	if bootloader.Device.Path != "halfkay" {
+		t.Errorf("wanted bootloader device path %q, got %q", "halfkay", bootloader.Device.Path)
+	}
+}
+
+func TestJumpToBootloaderWaitTimeout(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+
+	_, err := client.JumpToBootloader(
+		qmk.WaitForBootloader(50*time.Millisecond),
+		qmk.WithBootloaderEnumerate(func() []qmk.Keyboard { return nil }),
+	)
+	if !errors.Is(err, qmk.ErrorBootloaderNotFound) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorBootloaderNotFound, err)
+	}
+}
@@ -0,0 +1,134 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"errors"
+)
+
+// Capabilities describes the features a keyboard answers for
+type Capabilities struct {
+	ProtocolVersion uint16
+
+	// Dynamic keymap layers
+	Layers uint8
+	// Dynamic macros, and the bytes shared between them
+	MacroCount      uint8
+	MacroBufferSize uint16
+
+	// Lighting subsystems which respond. RGB matrix, LED matrix and audio are
+	// only reachable through the v12 custom channels.
+	Backlight bool
+	Rgblight  bool
+	RgbMatrix bool
+	LedMatrix bool
+	Audio     bool
+	// Before v12, firmware with either backlight or rgblight answers for
+	// both, so both are set and only one may be built in. The keyboard's
+	// definition says which.
+	LightingInconclusive bool
+
+	// id_dynamic_keymap_get/set_encoder (v10)
+	Encoders bool
+	// id_get_keyboard_value -> id_switch_matrix_state
+	SwitchMatrix bool
+}
+
+func (c *client) Capabilities() (Capabilities, error) {
+	c.cacheLock.Lock()
+	cached := c.capabilities
+	c.cacheLock.Unlock()
+	if cached != nil {
+		return *cached, nil
+	}
+
+	capabilities, err := c.probeCapabilities()
+	if err != nil {
+		return Capabilities{}, err
+	}
+	c.cacheLock.Lock()
+	c.capabilities = &capabilities
+	c.cacheLock.Unlock()
+	return capabilities, nil
+}
+
+// capabilityProbe marks a feature supported if its command is answered
+type capabilityProbe struct {
+	supported *bool
+	run       func() error
+}
+
+func (c *client) probeChannel(supported *bool, channel uint8, id uint8) capabilityProbe {
+	return capabilityProbe{supported, func() error {
+		_, err := c.GetCustomValue(channel, id)
+		return err
+	}}
+}
+
+func (c *client) probeCapabilities() (Capabilities, error) {
+	var (
+		capabilities = Capabilities{ProtocolVersion: c.protocol.version}
+		err          error
+	)
+
+	if capabilities.Layers, err = c.GetDynamicKeymapLayerCount(); err != nil {
+		return Capabilities{}, err
+	}
+	if capabilities.MacroCount, err = c.GetDynamicKeymapMacroCount(); err != nil {
+		return Capabilities{}, err
+	}
+	if capabilities.MacroBufferSize, err = c.GetDynamicKeymapMacroBufferSize(); err != nil {
+		return Capabilities{}, err
+	}
+
+	probes := []capabilityProbe{
+		{&capabilities.SwitchMatrix, func() error {
+			_, err := c.GetSwitchMatrixState()
+			return err
+		}},
+		{&capabilities.Encoders, c.probeEncoders},
+	}
+	if c.protocol.customValues {
+		probes = append(probes,
+			c.probeChannel(&capabilities.Backlight, BacklightChannelId, QmkBacklightBrightnessId),
+			c.probeChannel(&capabilities.Rgblight, RgblightChannelId, QmkRgblightBrightnessId),
+			c.probeChannel(&capabilities.RgbMatrix, RgbMatrixChannelId, QmkRgbMatrixBrightnessId),
+			c.probeChannel(&capabilities.LedMatrix, LedMatrixChannelId, QmkLedMatrixBrightnessId),
+			c.probeChannel(&capabilities.Audio, AudioChannelId, QmkAudioEnableId),
+		)
+	} else {
+		probes = append(probes, capabilityProbe{&capabilities.LightingInconclusive, func() error {
+			_, err := c.GetBacklightBrightness()
+			return err
+		}})
+	}
+
+	for _, probe := range probes {
+		err := probe.run()
+		switch {
+		case err == nil:
+			*probe.supported = true
+		case errors.Is(err, ErrorUnknownCommand), errors.Is(err, ErrorUnsupported):
+		default:
+			return Capabilities{}, err
+		}
+	}
+	if capabilities.LightingInconclusive {
+		capabilities.Backlight, capabilities.Rgblight = true, true
+	}
+	return capabilities, nil
+}
+
+// probeEncoders reads the first encoder's clockwise keycode on layer 0, which
+// firmware built without an encoder map leaves unhandled
+func (c *client) probeEncoders() error {
+	if !c.protocol.supports(DynamicKeymapGetEncoderId) {
+		return unsupported(DynamicKeymapGetEncoderId, 0)
+	}
+	buffer := [HidMessageSize]byte{DynamicKeymapGetEncoderId, 0, 0, 1}
+	return c.sendMessage(buffer[:])
+}
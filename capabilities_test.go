@@ -0,0 +1,149 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"testing"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/qmktest"
+)
+
+func TestCapabilities(t *testing.T) {
+	// Answers for backlight too, as QMK before v12 does
+	legacy := qmktest.DefaultConfig
+	legacy.Backlight = false
+
+	unlit := qmktest.DefaultConfig
+	unlit.Backlight, unlit.Rgblight = false, false
+
+	v12 := v12Config()
+	v12.Rgblight = false
+
+	bigMatrix := qmktest.DefaultConfig
+	bigMatrix.ProtocolVersion = qmk.ViaProtocolVersion10
+	bigMatrix.Rows, bigMatrix.Cols = 10, 24
+	bigMatrix.Encoders = 0
+
+	tests := []struct {
+		Name   string
+		Config qmktest.Config
+		Want   qmk.Capabilities
+	}{
+		{"default", qmktest.DefaultConfig, qmk.Capabilities{
+			ProtocolVersion:      qmk.ViaProtocolVersion9,
+			Layers:               4,
+			MacroCount:           16,
+			MacroBufferSize:      512,
+			Backlight:            true,
+			Rgblight:             true,
+			SwitchMatrix:         true,
+			LightingInconclusive: true,
+		}},
+		{"legacy without backlight", legacy, qmk.Capabilities{
+			ProtocolVersion:      qmk.ViaProtocolVersion9,
+			Layers:               4,
+			MacroCount:           16,
+			MacroBufferSize:      512,
+			Backlight:            true,
+			Rgblight:             true,
+			SwitchMatrix:         true,
+			LightingInconclusive: true,
+		}},
+		{"legacy without lighting", unlit, qmk.Capabilities{
+			ProtocolVersion: qmk.ViaProtocolVersion9,
+			Layers:          4,
+			MacroCount:      16,
+			MacroBufferSize: 512,
+			SwitchMatrix:    true,
+		}},
+		{"v12 without rgblight", v12, qmk.Capabilities{
+			ProtocolVersion: qmk.ViaProtocolVersion12,
+			Layers:          4,
+			MacroCount:      16,
+			MacroBufferSize: 512,
+			Backlight:       true,
+			Audio:           true,
+			Encoders:        true,
+			SwitchMatrix:    true,
+		}},
+		{"big matrix without encoders", bigMatrix, qmk.Capabilities{
+			ProtocolVersion:      qmk.ViaProtocolVersion10,
+			Layers:               4,
+			MacroCount:           16,
+			MacroBufferSize:      512,
+			Backlight:            true,
+			Rgblight:             true,
+			LightingInconclusive: true,
+		}},
+	}
+	for _, test := range tests {
+		client, _ := newTestClient(t, test.Config)
+		capabilities, err := client.Capabilities()
+		if err != nil {
+			t.Errorf("[%s] %v", test.Name, err)
+			continue
+		}
+		if capabilities != test.Want {
+			t.Errorf("[%s] wanted capabilities %+v, got %+v", test.Name, test.Want, capabilities)
+		}
+	}
+}
+
+func TestCapabilitiesCache(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	if _, err := client.Capabilities(); err != nil {
+		t.Fatal(err)
+	}
+	probed := len(emulator.Commands())
+
+	if _, err := client.Capabilities(); err != nil {
+		t.Fatal(err)
+	}
+	if commands := len(emulator.Commands()); commands != probed {
+		t.Errorf("wanted cached capabilities, got %d commands sent", commands-probed)
+	}
+
+	// Macro writes leave the capabilities cached
+	if err := client.SetDynamicKeymapMacro(0, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	sent := len(emulator.Commands())
+	if _, err := client.Capabilities(); err != nil {
+		t.Fatal(err)
+	}
+	if commands := len(emulator.Commands()); commands != sent {
+		t.Errorf("wanted cached capabilities after macro write, got %d commands sent", commands-sent)
+	}
+
+	client.InvalidateCache()
+	if _, err := client.Capabilities(); err != nil {
+		t.Fatal(err)
+	}
+	if commands := len(emulator.Commands()); commands == sent {
+		t.Error("wanted capabilities probed again after InvalidateCache")
+	}
+}
+
+func TestViaInfo(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+	if keyboard := client.Keyboard(); keyboard.Via != nil {
+		t.Errorf("wanted no VIA info before probing, got %+v", *keyboard.Via)
+	}
+
+	info, err := client.ViaInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := qmk.ViaInfo{ProtocolVersion: qmk.ViaProtocolVersion9, Layers: 4}
+	if info != want {
+		t.Errorf("wanted VIA info %+v, got %+v", want, info)
+	}
+	if keyboard := client.Keyboard(); keyboard.Via == nil || *keyboard.Via != want {
+		t.Errorf("wanted keyboard VIA info %+v, got %+v", want, keyboard.Via)
+	}
+}
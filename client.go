@@ -8,102 +8,508 @@ package qmk
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
+	"sync"
+	"time"
 
 	"github.com/ianmclinden/qmk-go/backlight"
 	"github.com/ianmclinden/qmk-go/keycode"
 	"github.com/ianmclinden/qmk-go/rgblight"
-	"github.com/karalabe/hid"
 )
 
+const (
+	// id_device_indication messages sent by Identify, and the time between them
+	identifyToggles  = 6
+	identifyInterval = 200 * time.Millisecond
+)
+
+// conn is the connection state shared by a client and its WithContext views
+type conn struct {
+	transport Transport
+	options   clientOptions
+	protocol  *protocol
+	closed    bool
+	// The transport was closed by a reconnect which could not reopen it
+	lost bool
+
+	// Held for a whole request/response transaction
+	transaction chan struct{}
+	// Closed by Close to interrupt pending transactions, replaced on Reopen
+	closingLock sync.Mutex
+	closing     chan struct{}
+	// Held across macro buffer read-modify-write sequences
+	macroLock sync.Mutex
+
+	cacheLock    sync.Mutex
+	macroCache   []byte
+	capabilities *Capabilities
+	// The transport's device, so that Keyboard never waits on a transaction
+	device Keyboard
+}
+
 type client struct {
-	device *hid.Device
+	*conn
+	ctx context.Context
 }
 
 var (
 	ErrorNoMatchingDevice = errors.New("no matching devices found")
-	ErrorVersionMismatch  = errors.New("keyboard does not match this VIA version")
+	ErrorVersionMismatch  = errors.New("keyboard does not speak a supported VIA version")
 	ErrorBadMessageSize   = errors.New("incorrect QMK Message size")
 	ErrorReadWrite        = errors.New("could not read/write to QMK device")
 	ErrorUnknownCommand   = errors.New("unknown VIA command")
 	ErrorBadBufferSize    = fmt.Errorf("incorrect buffer size (<=%d)", MaxDynamicKeymapBufferSize)
 	ErrorMacroNotInBytes  = errors.New("macro was not found in bytes")
 	ErrorMacroCopy        = errors.New("could not copy macro into buffer")
+	ErrorReadTimeout      = errors.New("timed out waiting for QMK response")
+	ErrorClientClosed     = errors.New("client is closed")
+	ErrorNoReopen         = errors.New("client has no way to reopen its transport")
+	ErrorUnsupported      = errors.New("not supported by the keyboard's VIA protocol version")
+	ErrorReadInFlight     = errors.New("device left open, an abandoned read never finished")
 )
 
-var (
-	dynamicKeymapMacroCache []byte
-)
-
-func NewClient(vid uint16, pid uint16, serial string) (Client, error) {
-
-	keyboards, err := ListKeyboards()
+// NewClient connects to the first VIA keyboard, by product name, matching the
+// vendor and product IDs and (optional) serial. Use OpenKeyboard to require a
+// unique match.
+func NewClient(vid uint16, pid uint16, serial string, opts ...ClientOption) (Client, error) {
+	keyboards, err := ListKeyboards(DeviceFilter{VendorID: vid, ProductID: pid, Serial: serial})
+	if errors.Is(err, ErrorNoKeyboardsFound) {
+		return nil, ErrorNoMatchingDevice
+	}
 	if err != nil {
 		return nil, err
 	}
-	serials := []hid.DeviceInfo{}
+	return openKeyboard(keyboards[0], newClientOptions(opts))
+}
 
-	for i := range keyboards {
-		if serial == "" || keyboards[i].Serial == serial {
-			serials = append(serials, keyboards[i])
-		}
+func openKeyboard(keyboard Keyboard, options clientOptions) (Client, error) {
+	open := options.open
+	if open == nil {
+		open = openHidTransport
 	}
-
-	if len(serials) == 0 {
-		return nil, ErrorNoMatchingDevice
+	if options.reopen == nil {
+		options.reopen = hidReopener(keyboard)
+		if options.open != nil {
+			options.reopen = func() (Transport, error) { return options.open(keyboard) }
+		}
 	}
-
-	di := serials[0]
-
-	var device *hid.Device
-	for i := 0; i < 20; i++ {
-		device, err = di.Open()
+	var (
+		transport Transport
+		err       error
+	)
+	for i := 0; i < options.retries; i++ {
+		if i > 0 {
+			time.Sleep(options.backoff.Delay(i))
+		}
+		transport, err = open(keyboard)
 		if err != nil {
 			continue
 		}
-		c := &client{device}
-		version, err := c.GetProtocolVersion()
+		c, err := newClient(transport, options)
 		if err != nil {
+			transport.Close()
 			return nil, err
 		}
-		if version != ViaProtocolVersion {
-			return nil, ErrorVersionMismatch
-		}
 		return c, nil
 	}
 	return nil, err
 }
 
-func (c *client) sendMessage(message []byte, retries int) error {
+// hidReopener finds a keyboard again after it has been re-enumerated, by
+// serial where it has one and otherwise by HID path
+func hidReopener(keyboard Keyboard) func() (Transport, error) {
+	filter := DeviceFilter{Path: keyboard.Path}
+	if keyboard.Serial != "" {
+		filter = DeviceFilter{VendorID: keyboard.VendorID, ProductID: keyboard.ProductID, Serial: keyboard.Serial}
+	}
+	return func() (Transport, error) {
+		keyboards, err := ListKeyboards(filter)
+		if err != nil {
+			return nil, err
+		}
+		return openHidTransport(keyboards[0])
+	}
+}
+
+// NewClientWithTransport creates a client which talks VIA over an existing
+// transport, such as a fake or an alternative HID backend
+func NewClientWithTransport(transport Transport, opts ...ClientOption) (Client, error) {
+	c, err := newClient(transport, newClientOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(transport Transport, options clientOptions) (*client, error) {
+	c := &client{
+		conn: &conn{
+			transport:   withContextReader(transport),
+			options:     options,
+			transaction: make(chan struct{}, 1),
+			closing:     make(chan struct{}),
+			device:      transport.DeviceInfo(),
+		},
+		ctx: context.Background(),
+	}
+	version, err := c.GetProtocolVersion()
+	if err != nil {
+		return nil, err
+	}
+	protocol, ok := protocols[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: 0x%04x", ErrorVersionMismatch, version)
+	}
+	c.protocol = protocol
+	return c, nil
+}
+
+// lock acquires the transaction, unless the client context is done or the
+// client is closed first
+func (c *client) lock() error {
+	closing := c.closingSignal()
+	select {
+	case <-closing:
+		return ErrorClientClosed
+	default:
+	}
+	select {
+	case c.transaction <- struct{}{}:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	case <-closing:
+		return ErrorClientClosed
+	}
+}
+
+func (c *client) unlock() {
+	<-c.transaction
+}
+
+// closingSignal returns the channel Close closes
+func (c *client) closingSignal() <-chan struct{} {
+	c.closingLock.Lock()
+	defer c.closingLock.Unlock()
+	return c.closing
+}
+
+// interrupted reports why the pending transaction should stop, if it should
+func (c *client) interrupted() error {
+	if err := c.ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-c.closingSignal():
+		return ErrorClientClosed
+	default:
+		return nil
+	}
+}
+
+// Close interrupts any pending transaction, then releases the transport
+func (c *client) Close() error {
+	c.closingLock.Lock()
+	select {
+	case <-c.closing:
+	default:
+		close(c.closing)
+	}
+	c.closingLock.Unlock()
+
+	c.transaction <- struct{}{}
+	defer c.unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.InvalidateCache()
+	if c.lost {
+		return nil
+	}
+	c.lost = true
+	return c.transport.Close()
+}
+
+func (c *client) Reopen() error {
+	// Closed clients can be reopened, so only the context interrupts the wait
+	select {
+	case c.transaction <- struct{}{}:
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+	defer c.unlock()
+
+	if c.options.reopen == nil {
+		return ErrorNoReopen
+	}
+	// Commands are kept out by closed until the reconnect succeeds
+	c.closingLock.Lock()
+	select {
+	case <-c.closing:
+		c.closing = make(chan struct{})
+	default:
+	}
+	c.closingLock.Unlock()
+	if err := c.reconnect(); err != nil {
+		return err
+	}
+	c.closed = false
+	return nil
+}
+
+// reconnect replaces the transport with a freshly opened one, checking that
+// it still speaks the negotiated VIA protocol. Callers must hold the
+// transaction.
+func (c *client) reconnect() error {
+	if !c.lost {
+		c.transport.Close()
+		c.lost = true
+	}
+	transport, err := c.options.reopen()
+	if err != nil {
+		return err
+	}
+	transport = withContextReader(transport)
+
+	message := make([]byte, HidMessageSize)
+	message[0] = GetProtocolVersionId
+	wrote, err := transport.Write(message)
+	if err == nil && wrote != HidMessageSize {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		var read int
+		read, err = c.read(transport, message)
+		if err == nil && (read != HidMessageSize || message[0] != GetProtocolVersionId) {
+			err = ErrorReadWrite
+		}
+	}
+	// During the handshake there is no version to keep yet, newClient checks
+	// the version the retried handshake reports
+	if err == nil && c.protocol != nil && uint16(message[1])<<8|uint16(message[2]) != c.protocol.version {
+		err = ErrorVersionMismatch
+	}
+	if err != nil {
+		transport.Close()
+		return err
+	}
+
+	c.transport = transport
+	c.lost = false
+	c.InvalidateCache()
+	c.cacheLock.Lock()
+	c.device = transport.DeviceInfo()
+	c.cacheLock.Unlock()
+	return nil
+}
+
+// recover attempts a reconnect after an I/O failure, where enabled
+func (c *client) recover(failure *ProtocolError) {
+	if !c.options.reconnect || c.options.reopen == nil {
+		return
+	}
+	if err := c.reconnect(); err != nil {
+		failure.Cause = fmt.Errorf("reconnect failed: %w", err)
+	}
+}
+
+func (c *client) WithContext(ctx context.Context) Client {
+	if ctx == nil {
+		panic("nil context")
+	}
+	return &client{conn: c.conn, ctx: ctx}
+}
+
+func (c *client) sendMessage(message []byte) error {
 	if len(message) != HidMessageSize {
 		return ErrorBadMessageSize
 	}
-	for i := 0; i < retries; i++ {
-		wrote, err := c.device.Write(message)
-		if err != nil || wrote != HidMessageSize {
-			continue
+	request := append([]byte{}, message...)
+	failure := newProtocolError(request, ErrorReadWrite)
+
+	if err := c.lock(); err != nil {
+		failure.Err = err
+		return failure
+	}
+	defer c.unlock()
+
+	if c.closed {
+		failure.Err = ErrorClientClosed
+		return failure
+	}
+
+	resend := true
+	for i := 0; i < c.options.retries; i++ {
+		if i > 0 && resend {
+			if err := c.backoff(failure); err != nil {
+				failure.Err = err
+				return failure
+			}
+		}
+		if err := c.interrupted(); err != nil {
+			failure.Err = err
+			return failure
+		}
+		failure.Attempts++
+		// The transport is closed, so only a reopen can help
+		if c.lost {
+			if err := c.reconnect(); err != nil {
+				failure.Cause = fmt.Errorf("reconnect failed: %w", err)
+				continue
+			}
+			resend = true
+		}
+		if resend {
+			copy(message, request)
+			wrote, err := c.transport.Write(message)
+			if err == nil && wrote != HidMessageSize {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				failure.Cause = err
+				c.recover(failure)
+				continue
+			}
 		}
-		read, err := c.device.Read(message)
-		if err != nil || read != HidMessageSize {
+		read, err := c.read(c.transport, message)
+		if interrupted := c.interrupted(); interrupted != nil {
+			failure.Err = interrupted
+			return failure
+		}
+		if err == nil && read != HidMessageSize {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			failure.Cause = err
+			resend = true
+			if err != ErrorReadTimeout {
+				c.recover(failure)
+			}
 			continue
 		}
+		failure.Response = append([]byte{}, message...)
 		if message[0] == UnhandledId {
-			return ErrorUnknownCommand
+			failure.Err = ErrorUnknownCommand
+			return failure
 		}
+		// A late reply to an abandoned request, the real reply is still queued
+		if !isResponseTo(request, message) {
+			resend = false
+			continue
+		}
+		return nil
+	}
+	return failure
+}
+
+// backoff reports a failed attempt to the retry hook, then waits out the
+// backoff delay unless the context is done first
+func (c *client) backoff(failure *ProtocolError) error {
+	delay := c.options.backoff.Delay(failure.Attempts)
+	if c.options.retryHook != nil {
+		c.options.retryHook(Retry{
+			Command:    failure.Command,
+			SubCommand: failure.SubCommand,
+			Attempt:    failure.Attempts,
+			Err:        failure.Cause,
+			Delay:      delay,
+		})
+	}
+	if delay <= 0 {
 		return nil
 	}
-	return ErrorReadWrite
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	case <-c.closingSignal():
+		return ErrorClientClosed
+	}
+}
+
+// isResponseTo checks that a response echoes the command (and value ID where
+// the firmware leaves it intact) of a request
+func isResponseTo(request []byte, response []byte) bool {
+	if response[0] != request[0] {
+		return false
+	}
+	return !hasSubCommand(request[0]) || response[1] == request[1]
+}
+
+// read a report, abandoning it if the client context is done, the client is
+// closed or the read timeout passes first
+func (c *client) read(transport Transport, message []byte) (int, error) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+	go func(done <-chan struct{}, closing <-chan struct{}) {
+		select {
+		case <-closing:
+			cancel()
+		case <-done:
+		}
+	}(ctx.Done(), c.closingSignal())
+	if c.options.readTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, c.options.readTimeout)
+		defer cancelTimeout()
+	}
+	n, err := readContext(ctx, transport, message)
+	if err != nil && ctx.Err() != nil && c.interrupted() == nil {
+		err = ErrorReadTimeout
+	}
+	return n, err
 }
 
+// readContext reads a report, abandoning it when the context is done if the
+// transport is a ContextReader, as every client transport is
+func readContext(ctx context.Context, transport Transport, message []byte) (int, error) {
+	if reader, ok := transport.(ContextReader); ok {
+		return reader.ReadContext(ctx, message)
+	}
+	return transport.Read(message)
+}
+
+func (c *client) ProtocolVersion() uint16 {
+	return c.protocol.version
+}
+
+// Keyboard describes the connected device, with its VIA details where the
+// capabilities have already been probed
 func (c *client) Keyboard() Keyboard {
-	return Keyboard(c.device.DeviceInfo)
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	keyboard := c.device
+	if c.capabilities != nil {
+		info := viaInfo(*c.capabilities)
+		keyboard.Via = &info
+	}
+	return keyboard
+}
+
+func (c *client) ViaInfo() (ViaInfo, error) {
+	capabilities, err := c.Capabilities()
+	if err != nil {
+		return ViaInfo{}, err
+	}
+	return viaInfo(capabilities), nil
+}
+
+func viaInfo(capabilities Capabilities) ViaInfo {
+	return ViaInfo{ProtocolVersion: capabilities.ProtocolVersion, Layers: capabilities.Layers}
 }
 
 func (c *client) GetProtocolVersion() (uint16, error) {
 	buffer := [HidMessageSize]byte{GetProtocolVersionId}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return 0, err
 	}
@@ -113,7 +519,7 @@ func (c *client) GetProtocolVersion() (uint16, error) {
 
 func (c *client) GetUptime() (uint32, error) {
 	buffer := [HidMessageSize]byte{GetKeyboardValueId, UptimeId}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return 0, err
 	}
@@ -122,9 +528,47 @@ func (c *client) GetUptime() (uint32, error) {
 	return uptime, nil
 }
 
+func (c *client) GetFirmwareVersion() (uint32, error) {
+	if !c.protocol.supportsKeyboardValue(FirmwareVersionId) {
+		return 0, unsupported(GetKeyboardValueId, FirmwareVersionId)
+	}
+	buffer := [HidMessageSize]byte{GetKeyboardValueId, FirmwareVersionId}
+	err := c.sendMessage(buffer[:])
+	if err != nil {
+		return 0, err
+	}
+
+	version := uint32(buffer[2])<<24 | uint32(buffer[3])<<16 | uint32(buffer[4])<<8 | uint32(buffer[5])
+	return version, nil
+}
+
+// Identify toggles the lighting an even number of times, as VIA does, so
+// that it ends up as it started
+func (c *client) Identify() error {
+	if !c.protocol.supportsKeyboardValue(DeviceIndicationId) {
+		return unsupported(SetKeyboardValueId, DeviceIndicationId)
+	}
+	for i := 0; i < identifyToggles; i++ {
+		if i > 0 {
+			timer := time.NewTimer(identifyInterval)
+			select {
+			case <-timer.C:
+			case <-c.ctx.Done():
+				timer.Stop()
+				return c.ctx.Err()
+			}
+		}
+		buffer := [HidMessageSize]byte{SetKeyboardValueId, DeviceIndicationId, byte(i)}
+		if err := c.sendMessage(buffer[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *client) GetLayoutOptions() (uint32, error) {
 	buffer := [HidMessageSize]byte{GetKeyboardValueId, LayoutOptionsId}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return 0, err
 	}
@@ -135,7 +579,7 @@ func (c *client) GetLayoutOptions() (uint32, error) {
 
 func (c *client) GetSwitchMatrixState() ([]byte, error) {
 	buffer := [HidMessageSize]byte{GetKeyboardValueId, SwitchMatrixStateId}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return nil, err
 	}
@@ -146,7 +590,7 @@ func (c *client) GetSwitchMatrixState() ([]byte, error) {
 // id_get_keyboard_value -> default (raw_hid_receive_kb)
 func (c *client) GetRawKeyboardValue(id uint8) ([]byte, error) {
 	buffer := [HidMessageSize]byte{GetKeyboardValueId, byte(id)}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return nil, err
 	}
@@ -156,22 +600,23 @@ func (c *client) GetRawKeyboardValue(id uint8) ([]byte, error) {
 
 func (c *client) SetLayoutOptions(options uint32) error {
 	buffer := [HidMessageSize]byte{
-		GetKeyboardValueId,
+		SetKeyboardValueId,
 		LayoutOptionsId,
 		byte((options >> 24) & 0xFF),
 		byte((options >> 16) & 0xFF),
 		byte((options >> 8) & 0xFF),
 		byte((options) & 0xFF),
 	}
-	return c.sendMessage(buffer[:], 20)
+	return c.sendMessage(buffer[:])
 }
 
 func (c *client) SetRawKeyboardValue(id uint8, data []byte) error {
 	if len(data) > HidMessageSize-2 {
 		return fmt.Errorf("data slice was too long (<=%d)", HidMessageSize-2)
 	}
-	buffer := append([]byte{SetKeyboardValueId, byte(id)}, data...)
-	return c.sendMessage(buffer[:], 20)
+	buffer := [HidMessageSize]byte{SetKeyboardValueId, byte(id)}
+	copy(buffer[2:], data)
+	return c.sendMessage(buffer[:])
 }
 
 func (c *client) GetDynamicKeymapKeycode(layer uint8, row uint8, column uint8) (keycode.Keycode, error) {
@@ -181,91 +626,120 @@ func (c *client) GetDynamicKeymapKeycode(layer uint8, row uint8, column uint8) (
 		byte(row),
 		byte(column),
 	}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return 0, err
 	}
 
-	return keycode.KeycodeFromBytes(buffer[4], buffer[5]), nil
+	return c.protocol.keycodes.decode(keycode.KeycodeFromBytes(buffer[4], buffer[5])), nil
 }
 
 func (c *client) SetDynamicKeymapKeycode(layer uint8, row uint8, column uint8, keycode keycode.Keycode) error {
+	value := c.protocol.keycodes.encode(keycode).ToBytes()
 	buffer := [HidMessageSize]byte{
 		DynamicKeymapSetKeycodeId,
 		byte(layer),
 		byte(row),
 		byte(column),
-		keycode.ToBytes()[0],
-		keycode.ToBytes()[1],
+		value[0],
+		value[1],
 	}
-	return c.sendMessage(buffer[:], 20)
+	return c.sendMessage(buffer[:])
 }
 
 func (c *client) ResetDynamicKeymap() error {
 	buffer := [HidMessageSize]byte{DynamicKeymapResetId}
-	return c.sendMessage(buffer[:], 20)
+	return c.sendMessage(buffer[:])
+}
+
+func (c *client) GetDynamicKeymapEncoder(layer uint8, encoder uint8, clockwise bool) (keycode.Keycode, error) {
+	if !c.protocol.supports(DynamicKeymapGetEncoderId) {
+		return 0, unsupported(DynamicKeymapGetEncoderId, 0)
+	}
+	buffer := [HidMessageSize]byte{
+		DynamicKeymapGetEncoderId,
+		byte(layer),
+		byte(encoder),
+		boolToByte(clockwise),
+	}
+	err := c.sendMessage(buffer[:])
+	if err != nil {
+		return 0, err
+	}
+
+	return c.protocol.keycodes.decode(keycode.KeycodeFromBytes(buffer[4], buffer[5])), nil
+}
+
+func (c *client) SetDynamicKeymapEncoder(layer uint8, encoder uint8, clockwise bool, keycode keycode.Keycode) error {
+	if !c.protocol.supports(DynamicKeymapSetEncoderId) {
+		return unsupported(DynamicKeymapSetEncoderId, 0)
+	}
+	value := c.protocol.keycodes.encode(keycode).ToBytes()
+	buffer := [HidMessageSize]byte{
+		DynamicKeymapSetEncoderId,
+		byte(layer),
+		byte(encoder),
+		boolToByte(clockwise),
+		value[0],
+		value[1],
+	}
+	return c.sendMessage(buffer[:])
 }
 
 func (c *client) GetBacklightBrightness() (backlight.Brightness, error) {
-	buffer := [HidMessageSize]byte{LightingGetValueId, BacklightBrightnessId}
-	err := c.sendMessage(buffer[:], 20)
+	value, err := c.getLightingValue(BacklightBrightnessId)
 	if err != nil {
 		return 0, err
 	}
 
-	return backlight.BrightnessFromByte(buffer[2]), nil
+	return backlight.BrightnessFromByte(value[0]), nil
 }
 
 func (c *client) GetBacklightEffect() (backlight.Effect, error) {
-	buffer := [HidMessageSize]byte{LightingGetValueId, BacklightEffectId}
-	err := c.sendMessage(buffer[:], 20)
+	value, err := c.getLightingValue(BacklightEffectId)
 	if err != nil {
 		return 0, err
 	}
 
-	return backlight.EffectFromByte(buffer[2]), nil
+	return backlight.EffectFromByte(value[0]), nil
 }
 
 func (c *client) GetRgblightBrightness() (rgblight.Brightness, error) {
-	buffer := [HidMessageSize]byte{LightingGetValueId, RgblightBrightnessId}
-	err := c.sendMessage(buffer[:], 20)
+	value, err := c.getLightingValue(RgblightBrightnessId)
 	if err != nil {
 		return 0, err
 	}
 
-	return rgblight.BrightnessFromByte(buffer[2]), nil
+	return rgblight.BrightnessFromByte(value[0]), nil
 }
 
 func (c *client) GetRgblightEffect() (rgblight.Effect, error) {
-	buffer := [HidMessageSize]byte{LightingGetValueId, RgblightEffectId}
-	err := c.sendMessage(buffer[:], 20)
+	value, err := c.getLightingValue(RgblightEffectId)
 	if err != nil {
 		return rgblight.EffectUnknown, err
 	}
 
-	return rgblight.EffectFromByte(buffer[2]), nil
+	return rgblight.EffectFromByte(value[0]), nil
 }
 
 func (c *client) GetRgblightEffectSpeed() (rgblight.Speed, error) {
-	buffer := [HidMessageSize]byte{LightingGetValueId, RgblightEffectSpeedId}
-	err := c.sendMessage(buffer[:], 20)
+	value, err := c.getLightingValue(RgblightEffectSpeedId)
 	if err != nil {
 		return 0, err
 	}
 
-	return rgblight.SpeedFromByte(buffer[2]), nil
+	return rgblight.SpeedFromByte(value[0]), nil
 }
 
 func (c *client) GetRgblightColor() (rgblight.Color, error) {
-	buffer := [HidMessageSize]byte{LightingGetValueId, RgblightColorId}
-	err := c.sendMessage(buffer[:], 20)
+	value, err := c.getLightingValue(RgblightColorId)
 	if err != nil {
 		return rgblight.ColorOff, err
 	}
 
 	var (
-		hue = rgblight.HueFromByte(buffer[2])
-		sat = rgblight.SaturationFromByte(buffer[3])
+		hue = rgblight.HueFromByte(value[0])
+		sat = rgblight.SaturationFromByte(value[1])
 	)
 
 	val, err := c.GetRgblightBrightness()
@@ -277,67 +751,34 @@ func (c *client) GetRgblightColor() (rgblight.Color, error) {
 }
 
 func (c *client) SetBacklightBrightness(brightness backlight.Brightness) error {
-	buffer := [HidMessageSize]byte{
-		LightingSetValueId,
-		BacklightBrightnessId,
-		brightness.ToByte(),
-	}
-	return c.sendMessage(buffer[:], 20)
+	return c.setLightingValue(BacklightBrightnessId, brightness.ToByte())
 }
 
 func (c *client) SetBacklightEffect(effect backlight.Effect) error {
-	buffer := [HidMessageSize]byte{
-		LightingSetValueId,
-		BacklightEffectId,
-		effect.ToByte(),
-	}
-	return c.sendMessage(buffer[:], 20)
+	return c.setLightingValue(BacklightEffectId, effect.ToByte())
 }
 
 func (c *client) SetRgblightBrightness(brightness rgblight.Brightness) error {
-	buffer := [HidMessageSize]byte{
-		LightingSetValueId,
-		RgblightBrightnessId,
-		brightness.ToByte(),
-	}
-	return c.sendMessage(buffer[:], 20)
+	return c.setLightingValue(RgblightBrightnessId, brightness.ToByte())
 }
 
 func (c *client) SetRgblightEffect(effect rgblight.Effect) error {
-	buffer := [HidMessageSize]byte{
-		LightingSetValueId,
-		RgblightEffectId,
-		effect.ToByte(),
-	}
-
 	// Send twice - if previous color mode is 0/Off then the first send will
 	// enable solid color mode, not the desired mode
-	err := c.sendMessage(buffer[:], 20)
+	err := c.setLightingValue(RgblightEffectId, effect.ToByte())
 	if err != nil {
 		return err
 	}
 
-	return c.sendMessage(buffer[:], 20)
+	return c.setLightingValue(RgblightEffectId, effect.ToByte())
 }
 
 func (c *client) SetRgblightEffectSpeed(speed rgblight.Speed) error {
-	buffer := [HidMessageSize]byte{
-		LightingSetValueId,
-		RgblightEffectSpeedId,
-		speed.ToByte(),
-	}
-	return c.sendMessage(buffer[:], 20)
+	return c.setLightingValue(RgblightEffectSpeedId, speed.ToByte())
 }
 
 func (c *client) SetRgblightColor(color rgblight.Color, setBrightness bool) error {
-
-	buffer := [HidMessageSize]byte{
-		LightingSetValueId,
-		RgblightColorId,
-		color.Hue.ToByte(),
-		color.Saturation.ToByte(),
-	}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.setLightingValue(RgblightColorId, color.Hue.ToByte(), color.Saturation.ToByte())
 	if err != nil {
 		return err
 	}
@@ -348,18 +789,44 @@ func (c *client) SetRgblightColor(color rgblight.Color, setBrightness bool) erro
 }
 
 func (c *client) SaveLighting() error {
-	buffer := [HidMessageSize]byte{LightingSaveId}
-	return c.sendMessage(buffer[:], 20)
+	if !c.protocol.customValues {
+		buffer := [HidMessageSize]byte{LightingSaveId}
+		return c.sendMessage(buffer[:])
+	}
+
+	// Save whichever of the lighting channels the keyboard has
+	var (
+		saved bool
+		err   error
+	)
+	for _, channel := range []uint8{BacklightChannelId, RgblightChannelId} {
+		err = c.SaveCustomValues(channel)
+		if err == nil {
+			saved = true
+			continue
+		}
+		if !errors.Is(err, ErrorUnknownCommand) {
+			return err
+		}
+	}
+	if saved {
+		return nil
+	}
+	return err
 }
 
 func (c *client) ResetEeprom() error {
+	c.macroLock.Lock()
+	defer c.macroLock.Unlock()
+
+	c.invalidateMacros()
 	buffer := [HidMessageSize]byte{EepromResetId}
-	return c.sendMessage(buffer[:], 20)
+	return c.sendMessage(buffer[:])
 }
 
 func (c *client) GetDynamicKeymapMacroCount() (uint8, error) {
 	buffer := [HidMessageSize]byte{DynamicKeymapMacroGetCountId}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return 0, err
 	}
@@ -369,7 +836,7 @@ func (c *client) GetDynamicKeymapMacroCount() (uint8, error) {
 
 func (c *client) GetDynamicKeymapMacroBufferSize() (uint16, error) {
 	buffer := [HidMessageSize]byte{DynamicKeymapMacroGetBufferSizeId}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return 0, err
 	}
@@ -384,7 +851,7 @@ func (c *client) GetDynamicKeymapMacroBuffer(offset uint16, size uint8) ([]byte,
 		byte(offset & 0xFF),
 		byte(size),
 	}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 
 	if err != nil {
 		return nil, err
@@ -394,6 +861,14 @@ func (c *client) GetDynamicKeymapMacroBuffer(offset uint16, size uint8) ([]byte,
 }
 
 func (c *client) SetDynamicKeymapMacroBuffer(offset uint16, size uint8, value []byte) error {
+	c.macroLock.Lock()
+	defer c.macroLock.Unlock()
+
+	return c.setMacroChunk(offset, size, value)
+}
+
+// setMacroChunk writes part of the macro buffer. Callers must hold macroLock.
+func (c *client) setMacroChunk(offset uint16, size uint8, value []byte) error {
 	if size <= 0 || size > MaxDynamicKeymapBufferSize {
 		return ErrorBadBufferSize
 	}
@@ -409,17 +884,22 @@ func (c *client) SetDynamicKeymapMacroBuffer(offset uint16, size uint8, value []
 	for i := 0; i < int(size); i++ {
 		buffer[i+4] = byte(value[i])
 	}
-	return c.sendMessage(buffer[:], 20)
+	c.invalidateMacros()
+	return c.sendMessage(buffer[:])
 }
 
 func (c *client) ResetDynamicKeymapMacro() error {
+	c.macroLock.Lock()
+	defer c.macroLock.Unlock()
+
+	c.invalidateMacros()
 	buffer := [HidMessageSize]byte{DynamicKeymapMacroResetId}
-	return c.sendMessage(buffer[:], 20)
+	return c.sendMessage(buffer[:])
 }
 
 func (c *client) GetDynamicKeymapLayerCount() (uint8, error) {
 	buffer := [HidMessageSize]byte{DynamicKeymapGetLayerCountId}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 	if err != nil {
 		return 0, err
 	}
@@ -434,7 +914,7 @@ func (c *client) GetDynamicKeymapBuffer(offset uint16, size uint8) ([]byte, erro
 		byte(offset & 0xFF),
 		byte(size),
 	}
-	err := c.sendMessage(buffer[:], 20)
+	err := c.sendMessage(buffer[:])
 
 	if err != nil {
 		return nil, err
@@ -459,14 +939,65 @@ func (c *client) SetDynamicKeymapBuffer(offset uint16, size uint8, value []byte)
 	for i := 0; i < int(size); i++ {
 		buffer[i+4] = byte(value[i])
 	}
-	return c.sendMessage(buffer[:], 20)
+	return c.sendMessage(buffer[:])
+}
+
+func (c *client) InvalidateCache() {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	c.macroCache = nil
+	c.capabilities = nil
 }
 
+// invalidateMacros drops only the cached macro buffer
+func (c *client) invalidateMacros() {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	c.macroCache = nil
+}
+
+func (c *client) RefreshMacros() error {
+	c.macroLock.Lock()
+	defer c.macroLock.Unlock()
+
+	c.invalidateMacros()
+	buffer, err := c.readMacroBuffer()
+	if err != nil {
+		return err
+	}
+	if c.options.macroCache {
+		c.cacheLock.Lock()
+		c.macroCache = buffer
+		c.cacheLock.Unlock()
+	}
+	return nil
+}
+
+// getMacroBuffer returns the macro buffer, from the cache where enabled.
+// Callers must hold macroLock.
 func (c *client) getMacroBuffer() ([]byte, error) {
-	if dynamicKeymapMacroCache != nil {
-		return dynamicKeymapMacroCache, nil
+	c.cacheLock.Lock()
+	cache := c.macroCache
+	c.cacheLock.Unlock()
+	if cache != nil {
+		return cache, nil
 	}
 
+	buffer, err := c.readMacroBuffer()
+	if err != nil {
+		return nil, err
+	}
+	if c.options.macroCache {
+		c.cacheLock.Lock()
+		c.macroCache = buffer
+		c.cacheLock.Unlock()
+	}
+	return buffer, nil
+}
+
+func (c *client) readMacroBuffer() ([]byte, error) {
 	size, err := c.GetDynamicKeymapMacroBufferSize()
 	if err != nil {
 		return nil, err
@@ -484,10 +1015,10 @@ func (c *client) getMacroBuffer() ([]byte, error) {
 		buffer = append(buffer, chunk...)
 	}
 	// Trim the buffer to max size
-	dynamicKeymapMacroCache = buffer[:size]
-	return dynamicKeymapMacroCache, nil
+	return buffer[:size], nil
 }
 
+// setMacroBuffer writes the whole macro buffer. Callers must hold macroLock.
 func (c *client) setMacroBuffer(buffer []byte) error {
 	size, err := c.GetDynamicKeymapMacroBufferSize()
 	if err != nil {
@@ -498,18 +1029,15 @@ func (c *client) setMacroBuffer(buffer []byte) error {
 	bytes := writes * MaxDynamicKeymapBufferSize
 
 	// Expand the buffer to the max size
-	if cap(buffer) < bytes {
-		buffer = append(buffer, make([]byte, bytes-cap(buffer))...)
+	if len(buffer) < bytes {
+		buffer = append(buffer, make([]byte, bytes-len(buffer))...)
 	}
 
-	// Clear the buffer cache
-	dynamicKeymapMacroCache = nil
-
 	// Write `writes` whole max sized blocks (overrun writes are noop)
 	for i := 0; i < writes; i++ {
 		start := i * MaxDynamicKeymapBufferSize
 		end := start + MaxDynamicKeymapBufferSize
-		err := c.SetDynamicKeymapMacroBuffer(uint16(start), MaxDynamicKeymapBufferSize, buffer[start:end])
+		err := c.setMacroChunk(uint16(start), MaxDynamicKeymapBufferSize, buffer[start:end])
 		if err != nil {
 			return err
 		}
@@ -519,12 +1047,15 @@ func (c *client) setMacroBuffer(buffer []byte) error {
 }
 
 func (c *client) GetDynamicKeymapMacro(number uint8) ([]byte, error) {
+	c.macroLock.Lock()
+	defer c.macroLock.Unlock()
+
 	count, err := c.GetDynamicKeymapMacroCount()
 	if err != nil {
 		return nil, err
 	}
-	if number > count {
-		return nil, fmt.Errorf("empty or invalid macro number (0-%d)", count)
+	if number >= count {
+		return nil, fmt.Errorf("empty or invalid macro number (0-%d)", int(count)-1)
 	}
 
 	buffer, err := c.getMacroBuffer()
@@ -537,16 +1068,19 @@ func (c *client) GetDynamicKeymapMacro(number uint8) ([]byte, error) {
 		return nil, ErrorMacroNotInBytes
 	}
 	macro := macros[number]
-	return macro[:len(macro)-1], nil
+	return append([]byte{}, macro[:len(macro)-1]...), nil
 }
 
 func (c *client) SetDynamicKeymapMacro(number uint8, macro []byte) error {
+	c.macroLock.Lock()
+	defer c.macroLock.Unlock()
+
 	count, err := c.GetDynamicKeymapMacroCount()
 	if err != nil {
 		return err
 	}
-	if number > count {
-		return fmt.Errorf("empty or invalid macro number (0-%d)", count)
+	if number >= count {
+		return fmt.Errorf("empty or invalid macro number (0-%d)", int(count)-1)
 	}
 
 	buffer, err := c.getMacroBuffer()
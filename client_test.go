@@ -0,0 +1,990 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/backlight"
+	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/qmktest"
+	"github.com/ianmclinden/qmk-go/rgblight"
+)
+
+func newTestClient(t *testing.T, config qmktest.Config) (qmk.Client, *qmktest.Emulator) {
+	t.Helper()
+	emulator := qmktest.NewEmulator(config)
+	client, err := qmk.NewClientWithTransport(emulator)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	return client, emulator
+}
+
+func TestNewClientVersionMismatch(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = 0x0001
+	_, err := qmk.NewClientWithTransport(qmktest.NewEmulator(config))
+	if !errors.Is(err, qmk.ErrorVersionMismatch) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorVersionMismatch, err)
+	}
+}
+
+func TestKeyboard(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.Keyboard.Product = "Test Board"
+	client, _ := newTestClient(t, config)
+	if product := client.Keyboard().Product; product != "Test Board" {
+		t.Errorf("wanted product %q, got %q", "Test Board", product)
+	}
+}
+
+func TestGetProtocolVersion(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+	version, err := client.GetProtocolVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != qmk.ViaProtocolVersion {
+		t.Errorf("wanted protocol version 0x%04x, got 0x%04x", qmk.ViaProtocolVersion, version)
+	}
+}
+
+func TestGetUptime(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+	if _, err := client.GetUptime(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetFirmwareVersion(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = qmk.ViaProtocolVersion11
+	config.FirmwareVersion = 0x00010203
+	client, _ := newTestClient(t, config)
+	version, err := client.GetFirmwareVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0x00010203 {
+		t.Errorf("wanted firmware version 0x%08x, got 0x%08x", 0x00010203, version)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = qmk.ViaProtocolVersion11
+	client, emulator := newTestClient(t, config)
+	if err := client.Identify(); err != nil {
+		t.Fatal(err)
+	}
+	if indications := emulator.Indications(); indications%2 != 0 || indications == 0 {
+		t.Errorf("wanted an even number of indications, got %d", indications)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.WithContext(ctx).Identify(); !errors.Is(err, context.Canceled) {
+		t.Errorf("wanted error %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestKeyboardValuesUnsupported(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	before := len(emulator.Commands())
+	if _, err := client.GetFirmwareVersion(); !errors.Is(err, qmk.ErrorUnsupported) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnsupported, err)
+	}
+	if err := client.Identify(); !errors.Is(err, qmk.ErrorUnsupported) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnsupported, err)
+	}
+	if after := len(emulator.Commands()); after != before {
+		t.Errorf("wanted no commands sent, got %d", after-before)
+	}
+}
+
+func TestLayoutOptions(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+	if err := client.SetLayoutOptions(0x12345678); err != nil {
+		t.Fatal(err)
+	}
+	options, err := client.GetLayoutOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options != 0x12345678 {
+		t.Errorf("wanted layout options 0x%08x, got 0x%08x", 0x12345678, options)
+	}
+}
+
+func TestGetSwitchMatrixState(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	emulator.SetSwitchMatrixState(1, 9, true)
+	state, err := client.GetSwitchMatrixState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 12 columns pack into two big-endian bytes per row
+	if want := []byte{0, 0, 0x02, 0x00, 0, 0}; !bytes.Equal(state[:len(want)], want) {
+		t.Errorf("wanted switch matrix state %v, got %v", want, state[:len(want)])
+	}
+}
+
+func TestRawKeyboardValue(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+	if _, err := client.GetRawKeyboardValue(0x7F); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+	if err := client.SetRawKeyboardValue(0x7F, []byte{1, 2, 3}); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+	if err := client.SetRawKeyboardValue(0x7F, make([]byte, qmk.HidMessageSize)); err == nil {
+		t.Error("wanted error for oversized raw keyboard value")
+	}
+}
+
+func TestDynamicKeymapKeycode(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.Keymap = []keycode.Keycode{keycode.KC_ESCAPE, keycode.KC_Q}
+	client, emulator := newTestClient(t, config)
+
+	kc, err := client.GetDynamicKeymapKeycode(0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kc != keycode.KC_Q {
+		t.Errorf("wanted keycode %v, got %v", keycode.KC_Q.Name(), kc.Name())
+	}
+
+	if err := client.SetDynamicKeymapKeycode(2, 3, 11, keycode.MACRO03); err != nil {
+		t.Fatal(err)
+	}
+	if kc := emulator.Keycode(2, 3, 11); kc != keycode.MACRO03 {
+		t.Errorf("wanted keycode %v, got %v", keycode.MACRO03.Name(), kc.Name())
+	}
+
+	if err := client.ResetDynamicKeymap(); err != nil {
+		t.Fatal(err)
+	}
+	if kc := emulator.Keycode(2, 3, 11); kc != keycode.KC_NO {
+		t.Errorf("wanted keycode %v after reset, got %v", keycode.KC_NO.Name(), kc.Name())
+	}
+	if kc := emulator.Keycode(0, 0, 0); kc != keycode.KC_ESCAPE {
+		t.Errorf("wanted keycode %v after reset, got %v", keycode.KC_ESCAPE.Name(), kc.Name())
+	}
+}
+
+func TestDynamicKeymapBuffer(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+
+	value := append(keycode.KC_A.ToBytes(), keycode.KC_B.ToBytes()...)
+	if err := client.SetDynamicKeymapBuffer(2, uint8(len(value)), value); err != nil {
+		t.Fatal(err)
+	}
+	if kc := emulator.Keycode(0, 0, 2); kc != keycode.KC_B {
+		t.Errorf("wanted keycode %v, got %v", keycode.KC_B.Name(), kc.Name())
+	}
+
+	buffer, err := client.GetDynamicKeymapBuffer(0, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0, 0, byte(keycode.KC_A), 0, byte(keycode.KC_B)}; !bytes.Equal(buffer[:6], want) {
+		t.Errorf("wanted keymap buffer %v, got %v", want, buffer[:6])
+	}
+
+	if err := client.SetDynamicKeymapBuffer(0, qmk.MaxDynamicKeymapBufferSize+1, value); !errors.Is(err, qmk.ErrorBadBufferSize) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorBadBufferSize, err)
+	}
+
+	layers, err := client.GetDynamicKeymapLayerCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layers != qmktest.DefaultConfig.Layers {
+		t.Errorf("wanted %d layers, got %d", qmktest.DefaultConfig.Layers, layers)
+	}
+}
+
+func TestBacklight(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+
+	if err := client.SetBacklightBrightness(backlight.Brightness(100)); err != nil {
+		t.Fatal(err)
+	}
+	brightness, err := client.GetBacklightBrightness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brightness != 100 {
+		t.Errorf("wanted backlight brightness %d, got %d", 100, brightness)
+	}
+
+	if err := client.SetBacklightEffect(backlight.EffectBreathingOn); err != nil {
+		t.Fatal(err)
+	}
+	effect, err := client.GetBacklightEffect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if effect != backlight.EffectBreathingOn {
+		t.Errorf("wanted backlight effect %v, got %v", backlight.EffectBreathingOn.Name(), effect.Name())
+	}
+
+	if err := client.SaveLighting(); err != nil {
+		t.Fatal(err)
+	}
+	if saves := emulator.LightingSaves(); saves != 1 {
+		t.Errorf("wanted %d lighting saves, got %d", 1, saves)
+	}
+}
+
+func TestRgblight(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+
+	if err := client.SetRgblightEffect(rgblight.EffectRainbowSwirl3); err != nil {
+		t.Fatal(err)
+	}
+	effect, err := client.GetRgblightEffect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if effect != rgblight.EffectRainbowSwirl3 {
+		t.Errorf("wanted rgblight effect %v, got %v", rgblight.EffectRainbowSwirl3.Name(), effect.Name())
+	}
+
+	if err := client.SetRgblightEffectSpeed(rgblight.Speed(100)); err != nil {
+		t.Fatal(err)
+	}
+	speed, err := client.GetRgblightEffectSpeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if speed != 100 {
+		t.Errorf("wanted rgblight speed %d, got %d", 100, speed)
+	}
+
+	if err := client.SetRgblightColor(rgblight.ColorBlue, true); err != nil {
+		t.Fatal(err)
+	}
+	color, err := client.GetRgblightColor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if color != rgblight.ColorBlue {
+		t.Errorf("wanted rgblight color %v, got %v", rgblight.ColorBlue.ToStringHSV(), color.ToStringHSV())
+	}
+
+	if err := client.SetRgblightBrightness(rgblight.Brightness(0)); err != nil {
+		t.Fatal(err)
+	}
+	brightness, err := client.GetRgblightBrightness()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brightness != 0 {
+		t.Errorf("wanted rgblight brightness %d, got %d", 0, brightness)
+	}
+}
+
+func TestLightingUnsupported(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.Backlight = false
+	config.Rgblight = false
+	client, _ := newTestClient(t, config)
+
+	if _, err := client.GetRgblightEffect(); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+	if err := client.SetBacklightBrightness(0); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+}
+
+func TestMacros(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.MacroCount = 4
+	// Not a multiple of MaxDynamicKeymapBufferSize, so the final chunk is partial
+	config.MacroBufferSize = 100
+	client, emulator := newTestClient(t, config)
+
+	count, err := client.GetDynamicKeymapMacroCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("wanted %d macros, got %d", 4, count)
+	}
+	size, err := client.GetDynamicKeymapMacroBufferSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 100 {
+		t.Errorf("wanted macro buffer size %d, got %d", 100, size)
+	}
+
+	long := bytes.Repeat([]byte("x"), 40)
+	if err := client.SetDynamicKeymapMacro(0, long); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetDynamicKeymapMacro(2, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(long, 0, 0), []byte("hello\x00")...)
+	if buffer := emulator.MacroBuffer(); !bytes.Equal(buffer[:len(want)], want) {
+		t.Errorf("wanted macro buffer %q, got %q", want, buffer[:len(want)])
+	}
+
+	macro, err := client.GetDynamicKeymapMacro(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(macro) != "hello" {
+		t.Errorf("wanted macro %q, got %q", "hello", macro)
+	}
+	if _, err := client.GetDynamicKeymapMacro(4); err == nil {
+		t.Error("wanted error for out of range macro")
+	}
+
+	chunk, err := client.GetDynamicKeymapMacroBuffer(28, 28)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chunk[:12], long[28:]) {
+		t.Errorf("wanted macro chunk %q, got %q", long[28:], chunk[:12])
+	}
+	if err := client.SetDynamicKeymapMacroBuffer(0, 0, nil); !errors.Is(err, qmk.ErrorBadBufferSize) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorBadBufferSize, err)
+	}
+
+	if err := client.ResetDynamicKeymapMacro(); err != nil {
+		t.Fatal(err)
+	}
+	if buffer := emulator.MacroBuffer(); !bytes.Equal(buffer, make([]byte, 100)) {
+		t.Errorf("wanted empty macro buffer after reset, got %q", buffer)
+	}
+}
+
+func TestResetEeprom(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	if err := client.SetDynamicKeymapKeycode(0, 0, 0, keycode.KC_A); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLayoutOptions(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ResetEeprom(); err != nil {
+		t.Fatal(err)
+	}
+	if kc := emulator.Keycode(0, 0, 0); kc != keycode.KC_NO {
+		t.Errorf("wanted keycode %v after reset, got %v", keycode.KC_NO.Name(), kc.Name())
+	}
+	options, err := client.GetLayoutOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options != 0 {
+		t.Errorf("wanted layout options %d after reset, got %d", 0, options)
+	}
+}
+
+// stallingTransport never answers once stalled, like an unplugged keyboard
+type stallingTransport struct {
+	*qmktest.Emulator
+	stalled chan struct{}
+}
+
+func (t *stallingTransport) Read(b []byte) (int, error) {
+	select {
+	case <-t.stalled:
+		return t.Emulator.Read(b)
+	default:
+		select {}
+	}
+}
+
+func TestWithContextDeadline(t *testing.T) {
+	transport := &stallingTransport{qmktest.NewEmulator(qmktest.DefaultConfig), make(chan struct{})}
+	close(transport.stalled)
+	client, err := qmk.NewClientWithTransport(transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.stalled = make(chan struct{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.WithContext(ctx).GetUptime()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wanted error %v, got %v", context.DeadlineExceeded, err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "id_get_keyboard_value") {
+		t.Errorf("wanted error to name the command, got %v", err)
+	}
+}
+
+// overlapTransport holds reads until released, and notes any read started
+// while another is blocked
+type overlapTransport struct {
+	*qmktest.Emulator
+	release chan struct{}
+	lock    sync.Mutex
+	reading int
+	overlap bool
+}
+
+func (t *overlapTransport) Read(b []byte) (int, error) {
+	t.lock.Lock()
+	t.reading++
+	t.overlap = t.overlap || t.reading > 1
+	release := t.release
+	t.lock.Unlock()
+	<-release
+	t.lock.Lock()
+	t.reading--
+	t.lock.Unlock()
+	return t.Emulator.Read(b)
+}
+
+func TestAbandonedReadCollected(t *testing.T) {
+	transport := &overlapTransport{Emulator: qmktest.NewEmulator(qmktest.DefaultConfig), release: make(chan struct{})}
+	close(transport.release)
+	client, err := qmk.NewClientWithTransport(transport, qmk.WithRetries(1), qmk.WithReadTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	transport.lock.Lock()
+	transport.release = release
+	transport.lock.Unlock()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetUptime(); !errors.Is(err, qmk.ErrorReadTimeout) {
+			t.Errorf("[%d] wanted error %v, got %v", i, qmk.ErrorReadTimeout, err)
+		}
+	}
+	close(release)
+	if _, err := client.GetUptime(); err != nil {
+		t.Fatal(err)
+	}
+	transport.lock.Lock()
+	defer transport.lock.Unlock()
+	if transport.overlap {
+		t.Error("wanted one read at a time, got a read beside an abandoned one")
+	}
+}
+
+func TestWithContextCanceled(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := len(emulator.Commands())
+	if err := client.WithContext(ctx).ResetDynamicKeymap(); !errors.Is(err, context.Canceled) {
+		t.Errorf("wanted error %v, got %v", context.Canceled, err)
+	}
+	if after := len(emulator.Commands()); after != before {
+		t.Errorf("wanted no commands sent after cancellation, got %d", after-before)
+	}
+}
+
+func TestMacroCachePerClient(t *testing.T) {
+	first, _ := newTestClient(t, qmktest.DefaultConfig)
+	second, _ := newTestClient(t, qmktest.DefaultConfig)
+
+	if err := first.SetDynamicKeymapMacro(0, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.GetDynamicKeymapMacro(0); err != nil {
+		t.Fatal(err)
+	}
+	macro, err := second.GetDynamicKeymapMacro(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(macro) != 0 {
+		t.Errorf("wanted empty macro on second keyboard, got %q", macro)
+	}
+}
+
+func TestMacroCacheInvalidation(t *testing.T) {
+	emulator := qmktest.NewEmulator(qmktest.DefaultConfig)
+	cached, err := qmk.NewClientWithTransport(emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncached, err := qmk.NewClientWithTransport(emulator, qmk.WithoutMacroCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := qmk.NewClientWithTransport(emulator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cached.GetDynamicKeymapMacro(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.SetDynamicKeymapMacro(0, []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	macroTests := []struct {
+		Name   string
+		Client qmk.Client
+		Macro  string
+	}{
+		{"stale cache", cached, ""},
+		{"uncached", uncached, "other"},
+	}
+	for _, test := range macroTests {
+		macro, err := test.Client.GetDynamicKeymapMacro(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(macro) != test.Macro {
+			t.Errorf("[%s] wanted macro %q, got %q", test.Name, test.Macro, macro)
+		}
+	}
+
+	if err := cached.RefreshMacros(); err != nil {
+		t.Fatal(err)
+	}
+	if macro, _ := cached.GetDynamicKeymapMacro(0); string(macro) != "other" {
+		t.Errorf("wanted macro %q after refresh, got %q", "other", macro)
+	}
+
+	// Refreshing leaves nothing behind to go stale without the cache
+	if err := uncached.RefreshMacros(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.SetDynamicKeymapMacro(0, []byte("zz")); err != nil {
+		t.Fatal(err)
+	}
+	if macro, _ := uncached.GetDynamicKeymapMacro(0); string(macro) != "zz" {
+		t.Errorf("wanted uncached macro %q after refresh, got %q", "zz", macro)
+	}
+	if err := cached.RefreshMacros(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cached.SetDynamicKeymapMacroBuffer(0, 1, []byte("X")); err != nil {
+		t.Fatal(err)
+	}
+	if macro, _ := cached.GetDynamicKeymapMacro(0); string(macro) != "Xz" {
+		t.Errorf("wanted macro %q after buffer write, got %q", "Xz", macro)
+	}
+
+	if err := cached.ResetDynamicKeymapMacro(); err != nil {
+		t.Fatal(err)
+	}
+	if macro, _ := cached.GetDynamicKeymapMacro(0); len(macro) != 0 {
+		t.Errorf("wanted empty macro after reset, got %q", macro)
+	}
+}
+
+// hookTransport calls a hook before each write
+type hookTransport struct {
+	*qmktest.Emulator
+	hook func([]byte)
+}
+
+func (t *hookTransport) Write(b []byte) (int, error) {
+	t.hook(b)
+	return t.Emulator.Write(b)
+}
+
+func TestMacroWriteDuringRead(t *testing.T) {
+	transport := &hookTransport{Emulator: qmktest.NewEmulator(qmktest.DefaultConfig), hook: func([]byte) {}}
+	client, err := qmk.NewClientWithTransport(transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	var once sync.Once
+	transport.hook = func(b []byte) {
+		if b[0] != qmk.DynamicKeymapMacroGetBufferId {
+			return
+		}
+		// Overwrite the first chunk while the rest is still being read
+		once.Do(func() {
+			go func() { written <- client.SetDynamicKeymapMacroBuffer(0, 1, []byte("X")) }()
+			time.Sleep(20 * time.Millisecond)
+		})
+	}
+	if _, err := client.GetDynamicKeymapMacro(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if macro, _ := client.GetDynamicKeymapMacro(0); string(macro) != "X" {
+		t.Errorf("wanted macro %q after the concurrent write, got %q", "X", macro)
+	}
+}
+
+func TestConcurrentClient(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(col uint8) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := client.SetDynamicKeymapKeycode(0, 0, col, keycode.KC_A+keycode.Keycode(col)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(uint8(i))
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				layers, err := client.GetDynamicKeymapLayerCount()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if layers != qmktest.DefaultConfig.Layers {
+					t.Errorf("wanted %d layers, got %d", qmktest.DefaultConfig.Layers, layers)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for col := uint8(0); col < 8; col++ {
+		if kc, want := emulator.Keycode(0, 0, col), keycode.KC_A+keycode.Keycode(col); kc != want {
+			t.Errorf("wanted keycode %v, got %v", want.Name(), kc.Name())
+		}
+	}
+}
+
+// staleTransport delivers a reply to some earlier, abandoned request first
+type staleTransport struct {
+	*qmktest.Emulator
+	stale []byte
+}
+
+func (t *staleTransport) Read(b []byte) (int, error) {
+	if t.stale != nil {
+		n := copy(b, t.stale)
+		t.stale = nil
+		return n, nil
+	}
+	return t.Emulator.Read(b)
+}
+
+func TestStaleResponse(t *testing.T) {
+	transport := &staleTransport{Emulator: qmktest.NewEmulator(qmktest.DefaultConfig)}
+	client, err := qmk.NewClientWithTransport(transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport.stale = make([]byte, qmk.HidMessageSize)
+	transport.stale[0] = qmk.DynamicKeymapGetLayerCountId
+	transport.stale[1] = 0xEE
+	count, err := client.GetDynamicKeymapMacroCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != qmktest.DefaultConfig.MacroCount {
+		t.Errorf("wanted %d macros, got %d", qmktest.DefaultConfig.MacroCount, count)
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("wanted repeated close to succeed, got %v", err)
+	}
+	if _, err := client.GetUptime(); !errors.Is(err, qmk.ErrorClientClosed) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorClientClosed, err)
+	}
+	if _, err := emulator.Write(make([]byte, qmk.HidMessageSize)); !errors.Is(err, qmktest.ErrorClosed) {
+		t.Errorf("wanted transport to be closed, got %v", err)
+	}
+	if err := client.Reopen(); !errors.Is(err, qmk.ErrorNoReopen) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorNoReopen, err)
+	}
+}
+
+func TestCloseInterrupts(t *testing.T) {
+	transport := &stallingTransport{qmktest.NewEmulator(qmktest.DefaultConfig), make(chan struct{})}
+	close(transport.stalled)
+	client, err := qmk.NewClientWithTransport(transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.stalled = make(chan struct{})
+
+	before := len(transport.Commands())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.GetUptime()
+		errs <- err
+	}()
+	for len(transport.Commands()) == before {
+		time.Sleep(time.Millisecond)
+	}
+
+	keyboards := make(chan qmk.Keyboard, 1)
+	go func() { keyboards <- client.Keyboard() }()
+	select {
+	case <-keyboards:
+	case <-time.After(time.Second):
+		t.Error("wanted Keyboard not to wait on the pending command")
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- client.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wanted Close to interrupt the pending command")
+	}
+	if err := <-errs; !errors.Is(err, qmk.ErrorClientClosed) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorClientClosed, err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	emulator := qmktest.NewEmulator(qmktest.DefaultConfig)
+	original := &closeCountingTransport{Emulator: emulator}
+	client, err := qmk.NewClientWithTransport(original, qmk.WithReopen(func() (qmk.Transport, error) {
+		emulator.Plug()
+		return emulator, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetUptime(); err != nil {
+		t.Errorf("wanted reopened client to work, got %v", err)
+	}
+	if original.closes != 1 {
+		t.Errorf("wanted the original transport closed once, got %d", original.closes)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var (
+		emulator = qmktest.NewEmulator(qmktest.DefaultConfig)
+		reopens  = 0
+		present  = false
+	)
+	client, err := qmk.NewClientWithTransport(emulator,
+		qmk.WithRetries(3),
+		qmk.WithReconnect(),
+		qmk.WithReopen(func() (qmk.Transport, error) {
+			reopens++
+			if !present {
+				return nil, qmk.ErrorNoMatchingDevice
+			}
+			emulator.Plug()
+			return emulator, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetDynamicKeymapKeycode(0, 0, 0, keycode.KC_A); err != nil {
+		t.Fatal(err)
+	}
+
+	emulator.Unplug()
+	_, err = client.GetDynamicKeymapKeycode(0, 0, 0)
+	if !errors.Is(err, qmk.ErrorReadWrite) || !errors.Is(err, qmk.ErrorNoMatchingDevice) {
+		t.Errorf("wanted failed reconnect, got %v", err)
+	}
+
+	present = true
+	reopens = 0
+	kc, err := client.GetDynamicKeymapKeycode(0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kc != keycode.KC_A {
+		t.Errorf("wanted keycode %v after reconnect, got %v", keycode.KC_A.Name(), kc.Name())
+	}
+	if reopens != 1 {
+		t.Errorf("wanted %d reopen, got %d", 1, reopens)
+	}
+}
+
+// closeCountingTransport counts closes, and writes made after it was closed
+type closeCountingTransport struct {
+	*qmktest.Emulator
+	closed bool
+	closes int
+	writes int
+}
+
+func (t *closeCountingTransport) Write(b []byte) (int, error) {
+	if t.closed {
+		t.writes++
+	}
+	return t.Emulator.Write(b)
+}
+
+func (t *closeCountingTransport) Close() error {
+	t.closed = true
+	t.closes++
+	return t.Emulator.Close()
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	var (
+		original = &closeCountingTransport{Emulator: qmktest.NewEmulator(qmktest.DefaultConfig)}
+		replaced = qmktest.NewEmulator(qmktest.DefaultConfig)
+		reopens  = 0
+		delays   []time.Duration
+	)
+	client, err := qmk.NewClientWithTransport(original,
+		qmk.WithReconnect(),
+		qmk.WithRetryHook(func(r qmk.Retry) { delays = append(delays, r.Delay) }),
+		qmk.WithReopen(func() (qmk.Transport, error) {
+			// The keyboard takes a while to enumerate again
+			reopens++
+			if reopens < 3 {
+				return nil, qmk.ErrorNoMatchingDevice
+			}
+			return replaced, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original.Unplug()
+	if _, err := client.GetUptime(); err != nil {
+		t.Fatal(err)
+	}
+	if reopens != 3 {
+		t.Errorf("wanted %d reopens, got %d", 3, reopens)
+	}
+	if original.writes != 0 {
+		t.Errorf("wanted no writes to the closed transport, got %d", original.writes)
+	}
+	for i, delay := range delays {
+		if delay <= 0 {
+			t.Errorf("[%d] wanted a reconnect backoff, got %v", i, delay)
+		}
+	}
+}
+
+// failingTransport fails its first write, as a keyboard unplugged mid handshake
+type failingTransport struct {
+	*qmktest.Emulator
+	failed bool
+}
+
+func (t *failingTransport) Write(b []byte) (int, error) {
+	if !t.failed {
+		t.failed = true
+		return 0, qmktest.ErrorUnplugged
+	}
+	return t.Emulator.Write(b)
+}
+
+func TestReconnectDuringHandshake(t *testing.T) {
+	emulator := qmktest.NewEmulator(qmktest.DefaultConfig)
+	reopens := 0
+	client, err := qmk.NewClientWithTransport(&failingTransport{Emulator: qmktest.NewEmulator(qmktest.DefaultConfig)},
+		qmk.WithRetries(2),
+		qmk.WithReconnect(),
+		qmk.WithReopen(func() (qmk.Transport, error) {
+			reopens++
+			return emulator, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopens != 1 {
+		t.Errorf("wanted %d reopen, got %d", 1, reopens)
+	}
+	if version := client.ProtocolVersion(); version != qmk.ViaProtocolVersion {
+		t.Errorf("wanted version 0x%04x, got 0x%04x", qmk.ViaProtocolVersion, version)
+	}
+}
+
+func TestReconnectVersionMismatch(t *testing.T) {
+	emulator := qmktest.NewEmulator(qmktest.DefaultConfig)
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = 0x0001
+	other := qmktest.NewEmulator(config)
+
+	client, err := qmk.NewClientWithTransport(emulator,
+		qmk.WithRetries(1),
+		qmk.WithReconnect(),
+		qmk.WithReopen(func() (qmk.Transport, error) { return other, nil }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulator.Unplug()
+	if _, err := client.GetUptime(); !errors.Is(err, qmk.ErrorVersionMismatch) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorVersionMismatch, err)
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	for version := uint16(qmk.MinViaProtocolVersion); version <= qmk.MaxViaProtocolVersion; version++ {
+		config := qmktest.DefaultConfig
+		config.ProtocolVersion = version
+		client, emulator := newTestClient(t, config)
+		if negotiated := client.ProtocolVersion(); negotiated != version {
+			t.Errorf("wanted negotiated version 0x%04x, got 0x%04x", version, negotiated)
+		}
+
+		if err := client.SetDynamicKeymapKeycode(0, 0, 0, keycode.MACRO03); err != nil {
+			t.Fatal(err)
+		}
+		want := keycode.MACRO03
+		if version >= qmk.ViaProtocolVersion12 {
+			want = 0x7703
+		}
+		if raw := emulator.Keycode(0, 0, 0); raw != want {
+			t.Errorf("[0x%04x] wanted raw keycode 0x%04x, got 0x%04x", version, uint16(want), uint16(raw))
+		}
+		kc, err := client.GetDynamicKeymapKeycode(0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kc != keycode.MACRO03 {
+			t.Errorf("[0x%04x] wanted keycode %v, got %v", version, keycode.MACRO03.Name(), kc.Name())
+		}
+	}
+
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = qmk.MaxViaProtocolVersion + 1
+	if _, err := qmk.NewClientWithTransport(qmktest.NewEmulator(config)); !errors.Is(err, qmk.ErrorVersionMismatch) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorVersionMismatch, err)
+	}
+}
@@ -0,0 +1,214 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"fmt"
+
+	"github.com/ianmclinden/qmk-go/backlight"
+	"github.com/ianmclinden/qmk-go/rgblight"
+)
+
+// lightingChannels maps legacy lighting value IDs to v12 channel and value IDs
+var lightingChannels = map[byte][2]uint8{
+	BacklightBrightnessId: {BacklightChannelId, QmkBacklightBrightnessId},
+	BacklightEffectId:     {BacklightChannelId, QmkBacklightEffectId},
+	RgblightBrightnessId:  {RgblightChannelId, QmkRgblightBrightnessId},
+	RgblightEffectId:      {RgblightChannelId, QmkRgblightEffectId},
+	RgblightEffectSpeedId: {RgblightChannelId, QmkRgblightEffectSpeedId},
+	RgblightColorId:       {RgblightChannelId, QmkRgblightColorId},
+}
+
+// getLightingValue reads a legacy lighting value, through its custom value
+// channel on v12 keyboards
+func (c *client) getLightingValue(id byte) ([]byte, error) {
+	if c.protocol.customValues {
+		channel := lightingChannels[id]
+		return c.GetCustomValue(channel[0], channel[1])
+	}
+	buffer := [HidMessageSize]byte{LightingGetValueId, id}
+	if err := c.sendMessage(buffer[:]); err != nil {
+		return nil, err
+	}
+	return buffer[2:], nil
+}
+
+// setLightingValue writes a legacy lighting value, through its custom value
+// channel on v12 keyboards
+func (c *client) setLightingValue(id byte, value ...byte) error {
+	if c.protocol.customValues {
+		channel := lightingChannels[id]
+		return c.SetCustomValue(channel[0], channel[1], value)
+	}
+	buffer := [HidMessageSize]byte{LightingSetValueId, id}
+	copy(buffer[2:], value)
+	return c.sendMessage(buffer[:])
+}
+
+// id_custom_get_value
+func (c *client) GetCustomValue(channel uint8, id uint8) ([]byte, error) {
+	if !c.protocol.customValues {
+		return nil, unsupported(CustomGetValueId, channel)
+	}
+	buffer := [HidMessageSize]byte{CustomGetValueId, channel, id}
+	if err := c.sendMessage(buffer[:]); err != nil {
+		return nil, err
+	}
+	return buffer[3:], nil
+}
+
+// id_custom_set_value
+func (c *client) SetCustomValue(channel uint8, id uint8, value []byte) error {
+	if !c.protocol.customValues {
+		return unsupported(CustomSetValueId, channel)
+	}
+	if len(value) > HidMessageSize-3 {
+		return fmt.Errorf("value slice was too long (<=%d)", HidMessageSize-3)
+	}
+	buffer := [HidMessageSize]byte{CustomSetValueId, channel, id}
+	copy(buffer[3:], value)
+	return c.sendMessage(buffer[:])
+}
+
+// id_custom_save
+func (c *client) SaveCustomValues(channel uint8) error {
+	if !c.protocol.customValues {
+		return unsupported(CustomSaveId, channel)
+	}
+	buffer := [HidMessageSize]byte{CustomSaveId, channel}
+	return c.sendMessage(buffer[:])
+}
+
+func (c *client) GetAudioEnabled() (bool, error) {
+	value, err := c.GetCustomValue(AudioChannelId, QmkAudioEnableId)
+	if err != nil {
+		return false, err
+	}
+	return value[0] != 0, nil
+}
+
+func (c *client) SetAudioEnabled(enabled bool) error {
+	return c.SetCustomValue(AudioChannelId, QmkAudioEnableId, []byte{boolToByte(enabled)})
+}
+
+func (c *client) GetAudioClickyEnabled() (bool, error) {
+	value, err := c.GetCustomValue(AudioChannelId, QmkAudioClickyEnableId)
+	if err != nil {
+		return false, err
+	}
+	return value[0] != 0, nil
+}
+
+func (c *client) SetAudioClickyEnabled(enabled bool) error {
+	return c.SetCustomValue(AudioChannelId, QmkAudioClickyEnableId, []byte{boolToByte(enabled)})
+}
+
+func (c *client) GetRgbMatrixBrightness() (rgblight.Brightness, error) {
+	value, err := c.GetCustomValue(RgbMatrixChannelId, QmkRgbMatrixBrightnessId)
+	if err != nil {
+		return 0, err
+	}
+	return rgblight.BrightnessFromByte(value[0]), nil
+}
+
+func (c *client) SetRgbMatrixBrightness(brightness rgblight.Brightness) error {
+	return c.SetCustomValue(RgbMatrixChannelId, QmkRgbMatrixBrightnessId, []byte{brightness.ToByte()})
+}
+
+func (c *client) GetRgbMatrixEffect() (uint8, error) {
+	value, err := c.GetCustomValue(RgbMatrixChannelId, QmkRgbMatrixEffectId)
+	if err != nil {
+		return 0, err
+	}
+	return value[0], nil
+}
+
+func (c *client) SetRgbMatrixEffect(effect uint8) error {
+	return c.SetCustomValue(RgbMatrixChannelId, QmkRgbMatrixEffectId, []byte{effect})
+}
+
+func (c *client) GetRgbMatrixEffectSpeed() (rgblight.Speed, error) {
+	value, err := c.GetCustomValue(RgbMatrixChannelId, QmkRgbMatrixEffectSpeedId)
+	if err != nil {
+		return 0, err
+	}
+	return rgblight.SpeedFromByte(value[0]), nil
+}
+
+func (c *client) SetRgbMatrixEffectSpeed(speed rgblight.Speed) error {
+	return c.SetCustomValue(RgbMatrixChannelId, QmkRgbMatrixEffectSpeedId, []byte{speed.ToByte()})
+}
+
+func (c *client) GetRgbMatrixColor() (rgblight.Color, error) {
+	value, err := c.GetCustomValue(RgbMatrixChannelId, QmkRgbMatrixColorId)
+	if err != nil {
+		return rgblight.ColorOff, err
+	}
+	brightness, err := c.GetRgbMatrixBrightness()
+	if err != nil {
+		return rgblight.ColorOff, err
+	}
+	return rgblight.Color{
+		Hue:        rgblight.HueFromByte(value[0]),
+		Saturation: rgblight.SaturationFromByte(value[1]),
+		Brightness: brightness,
+	}, nil
+}
+
+func (c *client) SetRgbMatrixColor(color rgblight.Color, setBrightness bool) error {
+	err := c.SetCustomValue(RgbMatrixChannelId, QmkRgbMatrixColorId, []byte{color.Hue.ToByte(), color.Saturation.ToByte()})
+	if err != nil {
+		return err
+	}
+	if setBrightness {
+		return c.SetRgbMatrixBrightness(color.Brightness)
+	}
+	return nil
+}
+
+func (c *client) GetLedMatrixBrightness() (backlight.Brightness, error) {
+	value, err := c.GetCustomValue(LedMatrixChannelId, QmkLedMatrixBrightnessId)
+	if err != nil {
+		return 0, err
+	}
+	return backlight.BrightnessFromByte(value[0]), nil
+}
+
+func (c *client) SetLedMatrixBrightness(brightness backlight.Brightness) error {
+	return c.SetCustomValue(LedMatrixChannelId, QmkLedMatrixBrightnessId, []byte{brightness.ToByte()})
+}
+
+func (c *client) GetLedMatrixEffect() (uint8, error) {
+	value, err := c.GetCustomValue(LedMatrixChannelId, QmkLedMatrixEffectId)
+	if err != nil {
+		return 0, err
+	}
+	return value[0], nil
+}
+
+func (c *client) SetLedMatrixEffect(effect uint8) error {
+	return c.SetCustomValue(LedMatrixChannelId, QmkLedMatrixEffectId, []byte{effect})
+}
+
+func (c *client) GetLedMatrixEffectSpeed() (rgblight.Speed, error) {
+	value, err := c.GetCustomValue(LedMatrixChannelId, QmkLedMatrixEffectSpeedId)
+	if err != nil {
+		return 0, err
+	}
+	return rgblight.SpeedFromByte(value[0]), nil
+}
+
+func (c *client) SetLedMatrixEffectSpeed(speed rgblight.Speed) error {
+	return c.SetCustomValue(LedMatrixChannelId, QmkLedMatrixEffectSpeedId, []byte{speed.ToByte()})
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,226 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/backlight"
+	"github.com/ianmclinden/qmk-go/qmktest"
+	"github.com/ianmclinden/qmk-go/rgblight"
+)
+
+func v12Config() qmktest.Config {
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = qmk.ViaProtocolVersion12
+	config.Audio = true
+	config.CustomValues = map[uint8][]byte{0x10: {0x01, 0x02}}
+	return config
+}
+
+func TestLightingOverCustomChannels(t *testing.T) {
+	client, emulator := newTestClient(t, v12Config())
+
+	if err := client.SetRgblightColor(rgblight.ColorRed, true); err != nil {
+		t.Fatal(err)
+	}
+	if value := emulator.CustomValue(qmk.RgblightChannelId, qmk.QmkRgblightColorId); !bytes.Equal(value, []byte{0, 255}) {
+		t.Errorf("wanted rgblight color channel value %v, got %v", []byte{0, 255}, value)
+	}
+	color, err := client.GetRgblightColor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if color != rgblight.ColorRed {
+		t.Errorf("wanted rgblight color %v, got %v", rgblight.ColorRed.ToStringHSV(), color.ToStringHSV())
+	}
+
+	if err := client.SetBacklightEffect(backlight.EffectBreathingOn); err != nil {
+		t.Fatal(err)
+	}
+	effect, err := client.GetBacklightEffect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if effect != backlight.EffectBreathingOn {
+		t.Errorf("wanted backlight effect %v, got %v", backlight.EffectBreathingOn.Name(), effect.Name())
+	}
+
+	if err := client.SaveLighting(); err != nil {
+		t.Fatal(err)
+	}
+	if saves := emulator.LightingSaves(); saves != 2 {
+		t.Errorf("wanted %d channel saves, got %d", 2, saves)
+	}
+}
+
+func TestSaveLightingPartialChannels(t *testing.T) {
+	config := v12Config()
+	config.Backlight = false
+	client, emulator := newTestClient(t, config)
+	if err := client.SaveLighting(); err != nil {
+		t.Fatal(err)
+	}
+	if saves := emulator.LightingSaves(); saves != 1 {
+		t.Errorf("wanted %d channel saves, got %d", 1, saves)
+	}
+
+	config.Rgblight = false
+	client, _ = newTestClient(t, config)
+	if err := client.SaveLighting(); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+}
+
+func TestCustomValues(t *testing.T) {
+	client, emulator := newTestClient(t, v12Config())
+
+	value, err := client.GetCustomValue(qmk.CustomChannelId, 0x10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value[:2], []byte{0x01, 0x02}) {
+		t.Errorf("wanted custom value %v, got %v", []byte{0x01, 0x02}, value[:2])
+	}
+	if err := client.SetCustomValue(qmk.CustomChannelId, 0x10, []byte{0x03, 0x04}); err != nil {
+		t.Fatal(err)
+	}
+	if value := emulator.CustomValue(qmk.CustomChannelId, 0x10); !bytes.Equal(value, []byte{0x03, 0x04}) {
+		t.Errorf("wanted custom value %v, got %v", []byte{0x03, 0x04}, value)
+	}
+	if err := client.SaveCustomValues(qmk.CustomChannelId); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := client.GetCustomValue(qmk.RgbMatrixChannelId, qmk.QmkRgbMatrixBrightnessId); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+	if err := client.SetCustomValue(qmk.CustomChannelId, 0x10, make([]byte, qmk.HidMessageSize)); err == nil {
+		t.Error("wanted error for oversized custom value")
+	}
+}
+
+func TestAudio(t *testing.T) {
+	client, _ := newTestClient(t, v12Config())
+
+	audioTests := []struct {
+		Set func(bool) error
+		Get func() (bool, error)
+	}{
+		{client.SetAudioEnabled, client.GetAudioEnabled},
+		{client.SetAudioClickyEnabled, client.GetAudioClickyEnabled},
+	}
+	for i, test := range audioTests {
+		for _, want := range []bool{true, false} {
+			if err := test.Set(want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := test.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("[%d] wanted audio value %v, got %v", i, want, got)
+			}
+		}
+	}
+}
+
+func TestRgbMatrix(t *testing.T) {
+	config := v12Config()
+	config.RgbMatrix = true
+	client, emulator := newTestClient(t, config)
+
+	if err := client.SetRgbMatrixColor(rgblight.ColorRed, true); err != nil {
+		t.Fatal(err)
+	}
+	if value := emulator.CustomValue(qmk.RgbMatrixChannelId, qmk.QmkRgbMatrixColorId); !bytes.Equal(value, []byte{0, 255}) {
+		t.Errorf("wanted rgb matrix color channel value %v, got %v", []byte{0, 255}, value)
+	}
+	color, err := client.GetRgbMatrixColor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if color != rgblight.ColorRed {
+		t.Errorf("wanted rgb matrix color %v, got %v", rgblight.ColorRed.ToStringHSV(), color.ToStringHSV())
+	}
+
+	if err := client.SetRgbMatrixEffect(7); err != nil {
+		t.Fatal(err)
+	}
+	if effect, err := client.GetRgbMatrixEffect(); err != nil || effect != 7 {
+		t.Errorf("wanted rgb matrix effect %d, got %d (%v)", 7, effect, err)
+	}
+	if err := client.SetRgbMatrixEffectSpeed(50); err != nil {
+		t.Fatal(err)
+	}
+	if speed, err := client.GetRgbMatrixEffectSpeed(); err != nil || speed != 50 {
+		t.Errorf("wanted rgb matrix speed %d, got %d (%v)", 50, speed, err)
+	}
+	if err := client.SetRgbMatrixBrightness(20); err != nil {
+		t.Fatal(err)
+	}
+	if value := emulator.CustomValue(qmk.RgbMatrixChannelId, qmk.QmkRgbMatrixBrightnessId); !bytes.Equal(value, []byte{51}) {
+		t.Errorf("wanted rgb matrix brightness channel value %v, got %v", []byte{51}, value)
+	}
+	if err := client.SaveCustomValues(qmk.RgbMatrixChannelId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLedMatrix(t *testing.T) {
+	config := v12Config()
+	config.LedMatrix = true
+	client, emulator := newTestClient(t, config)
+
+	if err := client.SetLedMatrixBrightness(100); err != nil {
+		t.Fatal(err)
+	}
+	if value := emulator.CustomValue(qmk.LedMatrixChannelId, qmk.QmkLedMatrixBrightnessId); !bytes.Equal(value, []byte{255}) {
+		t.Errorf("wanted led matrix brightness channel value %v, got %v", []byte{255}, value)
+	}
+	if brightness, err := client.GetLedMatrixBrightness(); err != nil || brightness != 100 {
+		t.Errorf("wanted led matrix brightness %d, got %d (%v)", 100, brightness, err)
+	}
+	if err := client.SetLedMatrixEffect(3); err != nil {
+		t.Fatal(err)
+	}
+	if effect, err := client.GetLedMatrixEffect(); err != nil || effect != 3 {
+		t.Errorf("wanted led matrix effect %d, got %d (%v)", 3, effect, err)
+	}
+	if err := client.SetLedMatrixEffectSpeed(100); err != nil {
+		t.Fatal(err)
+	}
+	if speed, err := client.GetLedMatrixEffectSpeed(); err != nil || speed != 100 {
+		t.Errorf("wanted led matrix speed %d, got %d (%v)", 100, speed, err)
+	}
+
+	// Keyboards without the channel do not answer for it
+	if _, err := client.GetRgbMatrixEffect(); !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+}
+
+func TestCustomValuesUnsupported(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	before := len(emulator.Commands())
+	if _, err := client.GetCustomValue(qmk.CustomChannelId, 0x10); !errors.Is(err, qmk.ErrorUnsupported) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnsupported, err)
+	}
+	if err := client.SetAudioEnabled(true); !errors.Is(err, qmk.ErrorUnsupported) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnsupported, err)
+	}
+	if _, err := client.GetLedMatrixBrightness(); !errors.Is(err, qmk.ErrorUnsupported) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnsupported, err)
+	}
+	if after := len(emulator.Commands()); after != before {
+		t.Errorf("wanted no commands sent, got %d", after-before)
+	}
+}
@@ -0,0 +1,289 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+// Package definition reads VIA keyboard definition files, which describe what
+// VIA cannot ask a keyboard: its matrix size, physical layout and custom
+// keycodes.
+package definition
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/kle"
+)
+
+var (
+	ErrorBadDefinition = errors.New("invalid keyboard definition")
+	ErrorNotFound      = errors.New("no definition for keyboard")
+	ErrorMismatch      = errors.New("definition is for a different keyboard")
+)
+
+// Definition file versions, told apart by their fields
+const (
+	// Has lighting and customFeatures
+	Version2 = 2
+	// Has menus and keycodes
+	Version3 = 3
+)
+
+// Definition is a VIA v2 or v3 keyboard definition
+type Definition struct {
+	// Version2 or Version3
+	Version   int
+	Name      string
+	VendorID  uint16
+	ProductID uint16
+	Matrix    Matrix
+	Layouts   Layouts
+	// Names for USER00 onwards
+	CustomKeycodes []CustomKeycode
+
+	// v2 lighting, either a preset name or an object, as written
+	Lighting json.RawMessage
+	// v3 menus
+	Menus []Menu
+	// v3 keycode groups VIA shows, such as qmk_lighting
+	Keycodes []string
+}
+
+// Matrix is the switch matrix size
+type Matrix struct {
+	Rows uint8 `json:"rows"`
+	Cols uint8 `json:"cols"`
+}
+
+// Layouts is the physical layout, as KLE (keyboard-layout-editor.com) JSON
+// with "row,col" matrix positions as key legends, and its layout options
+type Layouts struct {
+	Labels []Label         `json:"labels,omitempty"`
+	Keymap json.RawMessage `json:"keymap"`
+}
+
+// Label names a layout option. Options without choices are toggles.
+type Label struct {
+	Name    string
+	Choices []string
+}
+
+// UnmarshalJSON accepts a toggle's name, or an option's name followed by
+// its choices
+func (l *Label) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*l = Label{Name: name}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("%w: label is neither a string nor a list of strings", ErrorBadDefinition)
+	}
+	if len(values) < 2 {
+		return fmt.Errorf("%w: label %v needs a name and choices", ErrorBadDefinition, values)
+	}
+	*l = Label{Name: values[0], Choices: values[1:]}
+	return nil
+}
+
+func (l Label) MarshalJSON() ([]byte, error) {
+	if l.Choices == nil {
+		return json.Marshal(l.Name)
+	}
+	return json.Marshal(append([]string{l.Name}, l.Choices...))
+}
+
+// CustomKeycode names a keyboard specific keycode
+type CustomKeycode struct {
+	Name      string `json:"name"`
+	Title     string `json:"title,omitempty"`
+	ShortName string `json:"shortName,omitempty"`
+}
+
+// Menu is a v3 menu, either one of VIA's built in menus by name (such as
+// qmk_rgblight) or a custom menu kept as written
+type Menu struct {
+	Builtin string
+	Label   string
+	Content json.RawMessage
+}
+
+func (m *Menu) UnmarshalJSON(data []byte) error {
+	var builtin string
+	if err := json.Unmarshal(data, &builtin); err == nil {
+		*m = Menu{Builtin: builtin}
+		return nil
+	}
+	var custom struct {
+		Label   string          `json:"label"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return fmt.Errorf("%w: menu is neither a name nor an object", ErrorBadDefinition)
+	}
+	*m = Menu{Label: custom.Label, Content: custom.Content}
+	return nil
+}
+
+// definitionJSON is a definition as written, with hex string IDs
+type definitionJSON struct {
+	Name           string          `json:"name"`
+	VendorID       string          `json:"vendorId"`
+	ProductID      string          `json:"productId"`
+	Matrix         Matrix          `json:"matrix"`
+	Layouts        Layouts         `json:"layouts"`
+	CustomKeycodes []CustomKeycode `json:"customKeycodes"`
+	Lighting       json.RawMessage `json:"lighting"`
+	Menus          []Menu          `json:"menus"`
+	Keycodes       []string        `json:"keycodes"`
+}
+
+// Read decodes and checks a VIA definition
+func Read(r io.Reader) (*Definition, error) {
+	var doc definitionJSON
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	d := &Definition{
+		Version:        Version2,
+		Name:           doc.Name,
+		Matrix:         doc.Matrix,
+		Layouts:        doc.Layouts,
+		CustomKeycodes: doc.CustomKeycodes,
+		Lighting:       doc.Lighting,
+		Menus:          doc.Menus,
+		Keycodes:       doc.Keycodes,
+	}
+	if doc.Menus != nil || doc.Keycodes != nil {
+		d.Version = Version3
+	}
+
+	var err error
+	if d.VendorID, err = parseID(doc.VendorID); err != nil {
+		return nil, fmt.Errorf("%w: vendorId %v", ErrorBadDefinition, err)
+	}
+	if d.ProductID, err = parseID(doc.ProductID); err != nil {
+		return nil, fmt.Errorf("%w: productId %v", ErrorBadDefinition, err)
+	}
+	if d.Name == "" {
+		return nil, fmt.Errorf("%w: no name", ErrorBadDefinition)
+	}
+	if d.Matrix.Rows == 0 || d.Matrix.Cols == 0 {
+		return nil, fmt.Errorf("%w: %s matrix is %dx%d", ErrorBadDefinition, d.Name, d.Matrix.Rows, d.Matrix.Cols)
+	}
+	if len(d.Layouts.Keymap) == 0 {
+		return nil, fmt.Errorf("%w: %s has no layouts.keymap", ErrorBadDefinition, d.Name)
+	}
+	if _, err := d.KLE(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// KLE parses the physical layout. Every key other than decals must have a
+// matrix position inside the matrix.
+func (d *Definition) KLE() (*kle.Layout, error) {
+	layout, err := kle.Parse(d.Layouts.Keymap)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s layouts.keymap: %v", ErrorBadDefinition, d.Name, err)
+	}
+	for i, key := range layout.Keys {
+		if key.Decal {
+			continue
+		}
+		if key.Matrix == nil {
+			return nil, fmt.Errorf("%w: %s key %d has no matrix position in %q", ErrorBadDefinition, d.Name, i, key.Labels[0])
+		}
+		if key.Matrix.Row >= int(d.Matrix.Rows) || key.Matrix.Col >= int(d.Matrix.Cols) {
+			return nil, fmt.Errorf("%w: %s key %d at %d,%d is outside the %dx%d matrix", ErrorBadDefinition, d.Name, i,
+				key.Matrix.Row, key.Matrix.Col, d.Matrix.Rows, d.Matrix.Cols)
+		}
+	}
+	return layout, nil
+}
+
+// parseID parses a hex ID such as "0x4B42"
+func parseID(value string) (uint16, error) {
+	if !strings.HasPrefix(value, "0x") && !strings.HasPrefix(value, "0X") {
+		return 0, fmt.Errorf("%q is not a hex ID", value)
+	}
+	id, err := strconv.ParseUint(value[2:], 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a hex ID", value)
+	}
+	return uint16(id), nil
+}
+
+// ReadFS reads every .json file in a directory of fsys as a definition
+func ReadFS(fsys fs.FS, dir string) ([]*Definition, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	var definitions []*Definition
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		file, err := fsys.Open(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		d, err := Read(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		definitions = append(definitions, d)
+	}
+	return definitions, nil
+}
+
+// Matches reports whether the definition is for a keyboard, by vendor and
+// product ID
+func (d *Definition) Matches(keyboard qmk.Keyboard) bool {
+	return d.VendorID == keyboard.VendorID && d.ProductID == keyboard.ProductID
+}
+
+// Find returns the first definition matching a keyboard
+func Find(definitions []*Definition, keyboard qmk.Keyboard) (*Definition, error) {
+	for _, d := range definitions {
+		if d.Matches(keyboard) {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %04x:%04x", ErrorNotFound, keyboard.VendorID, keyboard.ProductID)
+}
+
+// Apply fills in the keyboard's matrix size, which VIA cannot report. The
+// rest of Via is left for Keyboard.LoadVia, before or after.
+func (d *Definition) Apply(keyboard *qmk.Keyboard) error {
+	if !d.Matches(*keyboard) {
+		return fmt.Errorf("%w: %s is %04x:%04x, keyboard is %04x:%04x", ErrorMismatch,
+			d.Name, d.VendorID, d.ProductID, keyboard.VendorID, keyboard.ProductID)
+	}
+	if keyboard.Via == nil {
+		keyboard.Via = &qmk.ViaInfo{}
+	}
+	keyboard.Via.Rows, keyboard.Via.Cols = d.Matrix.Rows, d.Matrix.Cols
+	return nil
+}
+
+// CustomKeycode returns the custom keycode for USER00 onwards
+func (d *Definition) CustomKeycode(code keycode.Keycode) (CustomKeycode, bool) {
+	index := int(code) - int(keycode.USER00)
+	if index < 0 || index >= len(d.CustomKeycodes) || index > int(keycode.USER15-keycode.USER00) {
+		return CustomKeycode{}, false
+	}
+	return d.CustomKeycodes[index], true
+}
@@ -0,0 +1,224 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package definition
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/keymap"
+	"github.com/ianmclinden/qmk-go/qmktest"
+)
+
+const testV2 = `{
+  "name": "Test 2x3",
+  "vendorId": "0x1234",
+  "productId": "0x0002",
+  "lighting": "qmk_backlight",
+  "matrix": {"rows": 2, "cols": 3},
+  "layouts": {
+    "labels": ["Split Space", ["Bottom Row", "ANSI", "Tsangan", "WKL"]],
+    "keymap": [["0,0", "0,1", "0,2"], [{"w": 2}, "1,0", "1,2"]]
+  },
+  "customKeycodes": [{"name": "Fancy", "title": "Does fancy things", "shortName": "FNCY"}]
+}`
+
+const testV3 = `{
+  "name": "Test 4x12",
+  "vendorId": "0x1234",
+  "productId": "0x0003",
+  "matrix": {"rows": 4, "cols": 12},
+  "layouts": {"keymap": [["0,0"]]},
+  "menus": ["qmk_rgblight", {"label": "Extras", "content": [{"label": "Mode", "content": []}]}],
+  "keycodes": ["qmk_lighting"]
+}`
+
+func TestReadV2(t *testing.T) {
+	d, err := Read(strings.NewReader(testV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version != Version2 || d.Name != "Test 2x3" || d.VendorID != 0x1234 || d.ProductID != 0x0002 {
+		t.Errorf("wanted v2 Test 2x3 1234:0002, got v%d %s %04x:%04x", d.Version, d.Name, d.VendorID, d.ProductID)
+	}
+	if d.Matrix.Rows != 2 || d.Matrix.Cols != 3 {
+		t.Errorf("wanted 2x3 matrix, got %dx%d", d.Matrix.Rows, d.Matrix.Cols)
+	}
+	if string(d.Lighting) != `"qmk_backlight"` {
+		t.Errorf("wanted lighting %q, got %s", "qmk_backlight", d.Lighting)
+	}
+
+	labels := d.Layouts.Labels
+	if len(labels) != 2 || labels[0].Name != "Split Space" || labels[0].Choices != nil ||
+		labels[1].Name != "Bottom Row" || strings.Join(labels[1].Choices, ",") != "ANSI,Tsangan,WKL" {
+		t.Errorf("wanted Split Space toggle and 3 Bottom Row choices, got %+v", labels)
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `["Split Space",["Bottom Row","ANSI","Tsangan","WKL"]]`; string(data) != want {
+		t.Errorf("wanted labels %s, got %s", want, data)
+	}
+
+	if custom, ok := d.CustomKeycode(keycode.USER00); !ok || custom.ShortName != "FNCY" {
+		t.Errorf("wanted USER00 to be FNCY, got %+v", custom)
+	}
+	if _, ok := d.CustomKeycode(keycode.USER01); ok {
+		t.Errorf("wanted no USER01")
+	}
+	if _, ok := d.CustomKeycode(keycode.KC_A); ok {
+		t.Errorf("wanted no custom keycode for KC_A")
+	}
+}
+
+func TestReadV3(t *testing.T) {
+	d, err := Read(strings.NewReader(testV3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Version != Version3 || d.Lighting != nil {
+		t.Errorf("wanted v3 without lighting, got v%d with %s", d.Version, d.Lighting)
+	}
+	if len(d.Menus) != 2 || d.Menus[0].Builtin != "qmk_rgblight" || d.Menus[1].Label != "Extras" || len(d.Menus[1].Content) == 0 {
+		t.Errorf("wanted qmk_rgblight and Extras menus, got %+v", d.Menus)
+	}
+	if len(d.Keycodes) != 1 || d.Keycodes[0] != "qmk_lighting" {
+		t.Errorf("wanted qmk_lighting keycodes, got %v", d.Keycodes)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	errorTests := []string{
+		strings.Replace(testV2, `"0x1234"`, `"4660"`, 1),
+		strings.Replace(testV2, `"0x0002"`, `"0x10000"`, 1),
+		strings.Replace(testV2, `"Test 2x3"`, `""`, 1),
+		strings.Replace(testV2, `"rows": 2`, `"rows": 0`, 1),
+		strings.Replace(testV2, `"Split Space"`, `["Split Space"]`, 1),
+		strings.Replace(testV3, `"keymap": [["0,0"]]`, `"labels": []`, 1),
+		strings.Replace(testV3, `"qmk_rgblight"`, `3`, 1),
+	}
+	for i, test := range errorTests {
+		if _, err := Read(strings.NewReader(test)); !errors.Is(err, ErrorBadDefinition) {
+			t.Errorf("[%d] wanted error %v, got %v", i, ErrorBadDefinition, err)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	fsys := fstest.MapFS{
+		"defs/v2.json":   {Data: []byte(testV2)},
+		"defs/v3.json":   {Data: []byte(testV3)},
+		"defs/README.md": {Data: []byte("not a definition")},
+	}
+	definitions, err := ReadFS(fsys, "defs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(definitions) != 2 {
+		t.Fatalf("wanted 2 definitions, got %d", len(definitions))
+	}
+
+	keyboard := qmk.Keyboard{VendorID: 0x1234, ProductID: 0x0003, Via: &qmk.ViaInfo{Layers: 4}}
+	d, err := Find(definitions, keyboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "Test 4x12" {
+		t.Errorf("wanted Test 4x12, got %s", d.Name)
+	}
+	if err := d.Apply(&keyboard); err != nil {
+		t.Fatal(err)
+	}
+	if keyboard.Via.Rows != 4 || keyboard.Via.Cols != 12 || keyboard.Via.Layers != 4 {
+		t.Errorf("wanted 4 layers of 4x12, got %+v", keyboard.Via)
+	}
+
+	other := qmk.Keyboard{VendorID: 0x1234, ProductID: 0x0004}
+	if _, err := Find(definitions, other); !errors.Is(err, ErrorNotFound) {
+		t.Errorf("wanted error %v, got %v", ErrorNotFound, err)
+	}
+	if err := d.Apply(&other); !errors.Is(err, ErrorMismatch) {
+		t.Errorf("wanted error %v, got %v", ErrorMismatch, err)
+	}
+	if other.Via != nil {
+		t.Errorf("wanted no VIA info on mismatch, got %+v", other.Via)
+	}
+
+	fsys["defs/bad.json"] = &fstest.MapFile{Data: []byte(`{"name": "bad"}`)}
+	if _, err := ReadFS(fsys, "defs"); !errors.Is(err, ErrorBadDefinition) || !strings.Contains(err.Error(), "bad.json") {
+		t.Errorf("wanted error %v naming bad.json, got %v", ErrorBadDefinition, err)
+	}
+}
+
+func TestApplyThenLoadVia(t *testing.T) {
+	d, err := Read(strings.NewReader(testV3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion, config.Layers = qmk.ViaProtocolVersion12, 3
+	open := qmk.WithOpen(func(qmk.Keyboard) (qmk.Transport, error) {
+		return qmktest.NewEmulator(config), nil
+	})
+
+	keyboard := qmk.Keyboard{VendorID: 0x1234, ProductID: 0x0003}
+	if err := d.Apply(&keyboard); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyboard.LoadVia(open); err != nil {
+		t.Fatal(err)
+	}
+	want := qmk.ViaInfo{ProtocolVersion: qmk.ViaProtocolVersion12, Layers: 3, Rows: 4, Cols: 12}
+	if *keyboard.Via != want {
+		t.Errorf("wanted %+v, got %+v", want, *keyboard.Via)
+	}
+
+	// Loaded first, then applied
+	keyboard = qmk.Keyboard{VendorID: 0x1234, ProductID: 0x0003}
+	if err := keyboard.LoadVia(open); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Apply(&keyboard); err != nil {
+		t.Fatal(err)
+	}
+	if *keyboard.Via != want {
+		t.Errorf("wanted %+v, got %+v", want, *keyboard.Via)
+	}
+}
+
+func TestKLE(t *testing.T) {
+	d, err := Read(strings.NewReader(testV2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout, err := d.KLE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layout.Keys) != 5 {
+		t.Fatalf("wanted 5 keys, got %d", len(layout.Keys))
+	}
+	if key := layout.Keys[3]; key.W != 2 || key.Y != 1 || *key.Matrix != (keymap.Position{Row: 1, Col: 0}) {
+		t.Errorf("wanted 2u key at 1,0 on the second row, got %+v", key)
+	}
+
+	for i, test := range []string{
+		strings.Replace(testV2, `"1,2"`, `"Enter"`, 1),
+		strings.Replace(testV2, `"1,2"`, `"1,3"`, 1),
+		strings.Replace(testV2, `"keymap": [`, `"keymap": [3, `, 1),
+	} {
+		if _, err := Read(strings.NewReader(test)); !errors.Is(err, ErrorBadDefinition) {
+			t.Errorf("[%d] wanted error %v, got %v", i, ErrorBadDefinition, err)
+		}
+	}
+}
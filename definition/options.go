@@ -0,0 +1,199 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package definition
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go/keymap"
+)
+
+var ErrorBadLayoutOption = errors.New("invalid layout option")
+
+// Toggle choices, as named by Selection
+const (
+	ToggleOff = "false"
+	ToggleOn  = "true"
+)
+
+// LayoutOptions are the chosen layout options, one choice per label. VIA
+// stores them in the layout options keyboard value with the last label in
+// the lowest bits, each label taking just enough bits for its choices.
+type LayoutOptions struct {
+	Labels []Label
+	// Index of each label's choice, with toggles 0 (off) or 1 (on)
+	Choices []int
+}
+
+// Selection is a label and its chosen choice
+type Selection struct {
+	Label  string
+	Choice string
+}
+
+func (s Selection) String() string {
+	return s.Label + ": " + s.Choice
+}
+
+// choices counts a label's choices
+func (l Label) choices() int {
+	if l.Choices == nil {
+		return 2
+	}
+	return len(l.Choices)
+}
+
+// width is the number of bits a label takes
+func (l Label) width() int {
+	return bits.Len(uint(l.choices() - 1))
+}
+
+// choiceName names a choice of the label
+func (l Label) choiceName(choice int) string {
+	if l.Choices != nil {
+		return l.Choices[choice]
+	}
+	if choice == 0 {
+		return ToggleOff
+	}
+	return ToggleOn
+}
+
+// DecodeLayoutOptions unpacks a layout options keyboard value
+func DecodeLayoutOptions(labels []Label, value uint32) (LayoutOptions, error) {
+	if err := checkWidth(labels); err != nil {
+		return LayoutOptions{}, err
+	}
+	options := LayoutOptions{Labels: labels, Choices: make([]int, len(labels))}
+	for i := len(labels) - 1; i >= 0; i-- {
+		width := labels[i].width()
+		choice := int(value & (1<<width - 1))
+		value >>= width
+		if choice >= labels[i].choices() {
+			return LayoutOptions{}, fmt.Errorf("%w: %s has %d choices, got choice %d", ErrorBadLayoutOption, labels[i].Name, labels[i].choices(), choice)
+		}
+		options.Choices[i] = choice
+	}
+	return options, nil
+}
+
+func checkWidth(labels []Label) error {
+	total := 0
+	for _, label := range labels {
+		total += label.width()
+	}
+	if total > 32 {
+		return fmt.Errorf("%w: labels need %d bits, the value has 32", ErrorBadLayoutOption, total)
+	}
+	return nil
+}
+
+// Encode packs the choices into a layout options keyboard value
+func (o LayoutOptions) Encode() (uint32, error) {
+	if len(o.Choices) != len(o.Labels) {
+		return 0, fmt.Errorf("%w: %d choices for %d labels", ErrorBadLayoutOption, len(o.Choices), len(o.Labels))
+	}
+	if err := checkWidth(o.Labels); err != nil {
+		return 0, err
+	}
+	var value uint32
+	for i, label := range o.Labels {
+		if o.Choices[i] < 0 || o.Choices[i] >= label.choices() {
+			return 0, fmt.Errorf("%w: %s has %d choices, got choice %d", ErrorBadLayoutOption, label.Name, label.choices(), o.Choices[i])
+		}
+		value = value<<label.width() | uint32(o.Choices[i])
+	}
+	return value, nil
+}
+
+// Selections names each label's choice
+func (o LayoutOptions) Selections() []Selection {
+	selections := make([]Selection, len(o.Labels))
+	for i, label := range o.Labels {
+		selections[i] = Selection{Label: label.Name, Choice: label.choiceName(o.Choices[i])}
+	}
+	return selections
+}
+
+func (o LayoutOptions) String() string {
+	selections := o.Selections()
+	names := make([]string, len(selections))
+	for i, selection := range selections {
+		names[i] = selection.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// Set chooses a label's choice by name. Toggles take true or false.
+func (o *LayoutOptions) Set(label string, choice string) error {
+	for i, l := range o.Labels {
+		if l.Name != label {
+			continue
+		}
+		if l.Choices == nil {
+			on, err := strconv.ParseBool(choice)
+			if err != nil {
+				return fmt.Errorf("%w: %s is a toggle, got %q", ErrorBadLayoutOption, label, choice)
+			}
+			o.Choices[i] = 0
+			if on {
+				o.Choices[i] = 1
+			}
+			return nil
+		}
+		for j, name := range l.Choices {
+			if name == choice {
+				o.Choices[i] = j
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s has no choice %q", ErrorBadLayoutOption, label, choice)
+	}
+	return fmt.Errorf("%w: no label %q", ErrorBadLayoutOption, label)
+}
+
+// LayoutOptions unpacks a layout options keyboard value with the
+// definition's labels
+func (d *Definition) LayoutOptions(value uint32) (LayoutOptions, error) {
+	return DecodeLayoutOptions(d.Layouts.Labels, value)
+}
+
+// Layout lists the matrix positions of the keys in the chosen layout, in KLE
+// order. Keys of other choices, and decals, are left out. The key order is
+// VIA's rather than a QMK LAYOUT macro's, so the layout has no macro name and
+// is marked keymap.KLEOrder, which keymap.c and keymap.json conversion refuse.
+// Those take their layouts from the keyboard's QMK info.json, with
+// keymap.ReadInfo.
+func (d *Definition) Layout(options LayoutOptions) (keymap.Layout, error) {
+	layout := keymap.Layout{Rows: int(d.Matrix.Rows), Cols: int(d.Matrix.Cols), Order: keymap.KLEOrder}
+	keys, err := d.KLE()
+	if err != nil {
+		return layout, err
+	}
+	for _, key := range keys.Keys {
+		if key.Decal {
+			continue
+		}
+		if key.Option != nil {
+			if key.Option.Group >= len(options.Choices) {
+				return layout, fmt.Errorf("%w: %s has a key in option group %d, which has no label", ErrorBadDefinition, d.Name, key.Option.Group)
+			}
+			if options.Choices[key.Option.Group] != key.Option.Choice {
+				continue
+			}
+		}
+		layout.Keys = append(layout.Keys, *key.Matrix)
+	}
+	if err := layout.Validate(); err != nil {
+		return layout, fmt.Errorf("%w: %s: %v", ErrorBadDefinition, d.Name, err)
+	}
+	return layout, nil
+}
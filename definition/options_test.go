@@ -0,0 +1,180 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package definition
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go/keymap"
+)
+
+var testLabels = []Label{
+	{Name: "Split Backspace"},
+	{Name: "Bottom Row", Choices: []string{"6.25U", "7U", "WKL"}},
+	{Name: "ISO Enter"},
+}
+
+var layoutOptionTests = []struct {
+	Value   uint32
+	Choices []int
+	String  string
+}{
+	/* 0*/ {0x0, []int{0, 0, 0}, "Split Backspace: false, Bottom Row: 6.25U, ISO Enter: false"},
+	/* 1*/ {0xA, []int{1, 1, 0}, "Split Backspace: true, Bottom Row: 7U, ISO Enter: false"},
+	/* 2*/ {0x5, []int{0, 2, 1}, "Split Backspace: false, Bottom Row: WKL, ISO Enter: true"},
+}
+
+func TestDecodeLayoutOptions(t *testing.T) {
+	for i, test := range layoutOptionTests {
+		options, err := DecodeLayoutOptions(testLabels, test.Value)
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		for j, choice := range test.Choices {
+			if options.Choices[j] != choice {
+				t.Errorf("[%d] wanted choices %v, got %v", i, test.Choices, options.Choices)
+				break
+			}
+		}
+		if s := options.String(); s != test.String {
+			t.Errorf("[%d] wanted %q, got %q", i, test.String, s)
+		}
+		value, err := options.Encode()
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+		}
+		if value != test.Value {
+			t.Errorf("[%d] wanted value 0x%x, got 0x%x", i, test.Value, value)
+		}
+	}
+
+	// Bottom Row's 2 bits can hold a 4th choice it does not have
+	if _, err := DecodeLayoutOptions(testLabels, 0x7); !errors.Is(err, ErrorBadLayoutOption) {
+		t.Errorf("wanted error %v, got %v", ErrorBadLayoutOption, err)
+	}
+	wide := make([]Label, 33)
+	if _, err := DecodeLayoutOptions(wide, 0); !errors.Is(err, ErrorBadLayoutOption) {
+		t.Errorf("wanted error %v, got %v", ErrorBadLayoutOption, err)
+	}
+}
+
+func TestSetLayoutOptions(t *testing.T) {
+	options, err := DecodeLayoutOptions(testLabels, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := options.Set("Bottom Row", "WKL"); err != nil {
+		t.Fatal(err)
+	}
+	if err := options.Set("ISO Enter", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := options.Encode(); err != nil || value != 0x5 {
+		t.Errorf("wanted value 0x5, got 0x%x (%v)", value, err)
+	}
+
+	errorTests := [][2]string{
+		{"Bottom Row", "8U"},
+		{"ISO Enter", "maybe"},
+		{"Numpad", "true"},
+	}
+	for i, test := range errorTests {
+		if err := options.Set(test[0], test[1]); !errors.Is(err, ErrorBadLayoutOption) {
+			t.Errorf("[%d] wanted error %v, got %v", i, ErrorBadLayoutOption, err)
+		}
+	}
+	options.Choices[1] = 3
+	if _, err := options.Encode(); !errors.Is(err, ErrorBadLayoutOption) {
+		t.Errorf("wanted error %v, got %v", ErrorBadLayoutOption, err)
+	}
+}
+
+const testOptionsDefinition = `{
+  "name": "Test Options",
+  "vendorId": "0x1234",
+  "productId": "0x0004",
+  "matrix": {"rows": 2, "cols": 3},
+  "layouts": {
+    "labels": ["Split Space", ["Right Key", "Shift", "Fn", "None"]],
+    "keymap": [
+      ["0,0", "0,1", "0,2\n\n\n1,0", "0,2\n\n\n1,1"],
+      [{"w": 2}, "1,0\n\n\n0,0", {"x": -2}, "1,0\n\n\n0,1", "1,1\n\n\n0,1", {"d": true}, "logo"]
+    ]
+  }
+}`
+
+func TestDefinitionLayout(t *testing.T) {
+	d, err := Read(strings.NewReader(testOptionsDefinition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := func(row int, col int) keymap.Position { return keymap.Position{Row: row, Col: col} }
+	layoutTests := []struct {
+		Value uint32
+		Keys  []keymap.Position
+	}{
+		// Split Space off, Right Key Shift
+		{0x0, []keymap.Position{pos(0, 0), pos(0, 1), pos(0, 2), pos(1, 0)}},
+		// Split Space on, Right Key Fn
+		{0x5, []keymap.Position{pos(0, 0), pos(0, 1), pos(0, 2), pos(1, 0), pos(1, 1)}},
+		// Split Space on, Right Key None
+		{0x6, []keymap.Position{pos(0, 0), pos(0, 1), pos(1, 0), pos(1, 1)}},
+	}
+	for i, test := range layoutTests {
+		options, err := d.LayoutOptions(test.Value)
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		layout, err := d.Layout(options)
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		if layout.Rows != 2 || layout.Cols != 3 || len(layout.Keys) != len(test.Keys) {
+			t.Errorf("[%d] wanted %d keys in 2x3, got %+v", i, len(test.Keys), layout)
+			continue
+		}
+		for j, key := range test.Keys {
+			if layout.Keys[j] != key {
+				t.Errorf("[%d] wanted keys %v, got %v", i, test.Keys, layout.Keys)
+				break
+			}
+		}
+	}
+
+	// KLE order is not a LAYOUT macro's, so QMK keymaps cannot use it
+	options, _ := d.LayoutOptions(0)
+	layout, err := d.Layout(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Order != keymap.KLEOrder {
+		t.Errorf("wanted KLE order, got %v", layout.Order)
+	}
+	k := keymap.New(1, 2, 3)
+	doc := &keymap.JSON{Layers: [][]string{{"KC_A", "KC_B", "KC_C", "KC_D"}}}
+	_, fromErr := keymap.FromKeymap(k, layout, "test")
+	_, toErr := doc.ToKeymap(layout)
+	_, readErr := keymap.ReadC(strings.NewReader("keymaps[] = {LAYOUT(KC_A, KC_B, KC_C, KC_D)};"), layout)
+	for i, err := range []error{keymap.WriteC(io.Discard, k, layout, keymap.COptions{}), readErr, toErr, fromErr} {
+		if !errors.Is(err, keymap.ErrorLayoutOrder) {
+			t.Errorf("[%d] wanted error %v, got %v", i, keymap.ErrorLayoutOrder, err)
+		}
+	}
+
+	// Right Key's group has no choice
+	options.Labels = options.Labels[:1]
+	options.Choices = options.Choices[:1]
+	if _, err := d.Layout(options); !errors.Is(err, ErrorBadDefinition) {
+		t.Errorf("wanted error %v, got %v", ErrorBadDefinition, err)
+	}
+}
@@ -0,0 +1,79 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProtocolError describes a VIA command which failed.
+//
+// It unwraps to one of the package sentinel errors (or a context error), so
+// errors.Is(err, ErrorReadWrite) still works, and errors.Is also matches the
+// underlying transport error in Cause.
+type ProtocolError struct {
+	// VIA command ID of the request
+	Command byte
+	// Value or channel ID, for commands which have one
+	SubCommand byte
+	// Number of attempts made before giving up
+	Attempts int
+	// Sentinel describing the failure
+	Err error
+	// Last error returned by the transport, if any
+	Cause error
+	// Last raw response received, if any
+	Response []byte
+}
+
+func (e *ProtocolError) Error() string {
+	var b strings.Builder
+	b.WriteString(commandName(e.Command))
+	if hasSubCommand(e.Command) {
+		fmt.Fprintf(&b, " (0x%02x)", e.SubCommand)
+	}
+	fmt.Fprintf(&b, ": %v", e.Err)
+	if e.Attempts > 1 {
+		fmt.Fprintf(&b, " after %d attempts", e.Attempts)
+	}
+	if e.Cause != nil {
+		fmt.Fprintf(&b, ": %v", e.Cause)
+	}
+	return b.String()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ProtocolError) Is(target error) bool {
+	return e.Cause != nil && errors.Is(e.Cause, target)
+}
+
+// unsupported fails a command the negotiated protocol version lacks
+func unsupported(command byte, subCommand byte) *ProtocolError {
+	return &ProtocolError{Command: command, SubCommand: subCommand, Err: ErrorUnsupported}
+}
+
+func newProtocolError(request []byte, err error) *ProtocolError {
+	e := &ProtocolError{Command: request[0], Err: err}
+	if hasSubCommand(request[0]) {
+		e.SubCommand = request[1]
+	}
+	return e
+}
+
+// hasSubCommand reports whether the second request byte selects a value
+func hasSubCommand(command byte) bool {
+	switch command {
+	case GetKeyboardValueId, SetKeyboardValueId, LightingGetValueId, LightingSetValueId:
+		return true
+	}
+	return false
+}
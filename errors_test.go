@@ -0,0 +1,61 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/qmktest"
+)
+
+func TestProtocolErrorUnknownCommand(t *testing.T) {
+	client, _ := newTestClient(t, qmktest.DefaultConfig)
+	_, err := client.GetRawKeyboardValue(0x7F)
+
+	var protocolError *qmk.ProtocolError
+	if !errors.As(err, &protocolError) {
+		t.Fatalf("wanted *qmk.ProtocolError, got %T", err)
+	}
+	if !errors.Is(err, qmk.ErrorUnknownCommand) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnknownCommand, err)
+	}
+	if protocolError.Command != qmk.GetKeyboardValueId || protocolError.SubCommand != 0x7F {
+		t.Errorf("wanted command 0x%02x/0x%02x, got 0x%02x/0x%02x", qmk.GetKeyboardValueId, 0x7F, protocolError.Command, protocolError.SubCommand)
+	}
+	if protocolError.Attempts != 1 {
+		t.Errorf("wanted %d attempts, got %d", 1, protocolError.Attempts)
+	}
+	if len(protocolError.Response) != qmk.HidMessageSize || protocolError.Response[0] != qmk.UnhandledId {
+		t.Errorf("wanted raw unhandled response, got %v", protocolError.Response)
+	}
+}
+
+func TestProtocolErrorReadWrite(t *testing.T) {
+	client, emulator := newTestClient(t, qmktest.DefaultConfig)
+	emulator.Close()
+	err := client.ResetDynamicKeymap()
+
+	var protocolError *qmk.ProtocolError
+	if !errors.As(err, &protocolError) {
+		t.Fatalf("wanted *qmk.ProtocolError, got %T", err)
+	}
+	if !errors.Is(err, qmk.ErrorReadWrite) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorReadWrite, err)
+	}
+	if !errors.Is(err, qmktest.ErrorClosed) {
+		t.Errorf("wanted transport error %v, got %v", qmktest.ErrorClosed, protocolError.Cause)
+	}
+	if protocolError.Attempts != 20 {
+		t.Errorf("wanted %d attempts, got %d", 20, protocolError.Attempts)
+	}
+	if msg := err.Error(); !strings.HasPrefix(msg, "id_dynamic_keymap_reset") {
+		t.Errorf("wanted error to name the command, got %q", msg)
+	}
+}
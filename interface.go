@@ -7,19 +7,53 @@
 package qmk
 
 import (
+	"context"
+
 	"github.com/ianmclinden/qmk-go/backlight"
 	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/keymap"
 	"github.com/ianmclinden/qmk-go/rgblight"
 )
 
 // Client to bind and configure QMK Keyboard
+//
+// A Client is safe for concurrent use. Each command is a single
+// request/response transaction on the device, and transactions are
+// serialized so goroutines never read each other's responses. Macro
+// read-modify-write (SetDynamicKeymapMacro) is atomic with respect to other
+// macro calls on the same Client, including raw macro buffer writes and
+// resets, but not to other Clients or programs sharing the keyboard.
 type Client interface {
+	// The connected keyboard. Via is filled in once capabilities are probed.
 	Keyboard() Keyboard
+	// Protocol version and layer count, probed as by Capabilities
+	ViaInfo() (ViaInfo, error)
+
+	// Returns a client sharing this connection whose commands are bound to ctx.
+	// Cancellation and deadlines are checked between retries and abandon
+	// pending reads, returning the context error wrapped with the command
+	WithContext(ctx context.Context) Client
 
+	// Release the device, interrupting pending commands. Commands on a closed
+	// client fail with ErrorClientClosed, until it is reopened.
+	Close() error
+	// Close and reopen the device (see WithReopen), re-verifying the protocol
+	Reopen() error
+
+	// VIA protocol version negotiated when the client connected
+	ProtocolVersion() uint16
+	// Probe the features the keyboard answers for. The result is cached
+	// until InvalidateCache, or the client reconnects.
+	Capabilities() (Capabilities, error)
 	// id_get_protocol_version
 	GetProtocolVersion() (uint16, error)
 	// id_get_keyboard_value -> id_uptime (ms)
 	GetUptime() (uint32, error)
+	// id_get_keyboard_value -> id_firmware_version (v11)
+	GetFirmwareVersion() (uint32, error)
+	// id_set_keyboard_value -> id_device_indication (v11), blinking the
+	// lighting so the user can tell which keyboard this is
+	Identify() error
 
 	// id_get_keyboard_value -> id_layout_options
 	GetLayoutOptions() (uint32, error)
@@ -40,6 +74,10 @@ type Client interface {
 	SetDynamicKeymapKeycode(uint8, uint8, uint8, keycode.Keycode) error
 	// id_dynamic_keymap_reset
 	ResetDynamicKeymap() error
+	// id_dynamic_keymap_get_encoder (v10) -> layer, encoder, clockwise
+	GetDynamicKeymapEncoder(uint8, uint8, bool) (keycode.Keycode, error)
+	// id_dynamic_keymap_set_encoder (v10) -> layer, encoder, clockwise, keycode
+	SetDynamicKeymapEncoder(uint8, uint8, bool, keycode.Keycode) error
 
 	// id_lighting_get_value -> id_qmk_backlight_brightness
 	GetBacklightBrightness() (backlight.Brightness, error)
@@ -70,6 +108,56 @@ type Client interface {
 	// Save rgblight and backlight to EEPROM
 	SaveLighting() error
 
+	// id_custom_get_value (v12) -> channel, value ID
+	GetCustomValue(uint8, uint8) ([]byte, error)
+	// id_custom_set_value (v12) -> channel, value ID, value
+	SetCustomValue(uint8, uint8, []byte) error
+	// id_custom_save (v12) -> channel
+	SaveCustomValues(uint8) error
+
+	// id_custom_get_value (v12) -> id_qmk_audio_channel -> id_qmk_audio_enable
+	GetAudioEnabled() (bool, error)
+	// id_custom_set_value (v12) -> id_qmk_audio_channel -> id_qmk_audio_enable
+	SetAudioEnabled(bool) error
+	// id_custom_get_value (v12) -> id_qmk_audio_channel -> id_qmk_audio_clicky_enable
+	GetAudioClickyEnabled() (bool, error)
+	// id_custom_set_value (v12) -> id_qmk_audio_channel -> id_qmk_audio_clicky_enable
+	SetAudioClickyEnabled(bool) error
+
+	// id_custom_get_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_brightness
+	GetRgbMatrixBrightness() (rgblight.Brightness, error)
+	// id_custom_set_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_brightness
+	SetRgbMatrixBrightness(rgblight.Brightness) error
+	// id_custom_get_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_effect,
+	// numbered by the effects the firmware was built with
+	GetRgbMatrixEffect() (uint8, error)
+	// id_custom_set_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_effect
+	SetRgbMatrixEffect(uint8) error
+	// id_custom_get_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_effect_speed
+	GetRgbMatrixEffectSpeed() (rgblight.Speed, error)
+	// id_custom_set_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_effect_speed
+	SetRgbMatrixEffectSpeed(rgblight.Speed) error
+	// id_custom_get_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_color, with
+	// the brightness
+	GetRgbMatrixColor() (rgblight.Color, error)
+	// id_custom_set_value (v12) -> id_qmk_rgb_matrix_channel -> id_qmk_rgb_matrix_color
+	// (optionally set brightness from color)
+	SetRgbMatrixColor(rgblight.Color, bool) error
+
+	// id_custom_get_value (v12) -> id_qmk_led_matrix_channel -> id_qmk_led_matrix_brightness
+	GetLedMatrixBrightness() (backlight.Brightness, error)
+	// id_custom_set_value (v12) -> id_qmk_led_matrix_channel -> id_qmk_led_matrix_brightness
+	SetLedMatrixBrightness(backlight.Brightness) error
+	// id_custom_get_value (v12) -> id_qmk_led_matrix_channel -> id_qmk_led_matrix_effect,
+	// numbered by the effects the firmware was built with
+	GetLedMatrixEffect() (uint8, error)
+	// id_custom_set_value (v12) -> id_qmk_led_matrix_channel -> id_qmk_led_matrix_effect
+	SetLedMatrixEffect(uint8) error
+	// id_custom_get_value (v12) -> id_qmk_led_matrix_channel -> id_qmk_led_matrix_effect_speed
+	GetLedMatrixEffectSpeed() (rgblight.Speed, error)
+	// id_custom_set_value (v12) -> id_qmk_led_matrix_channel -> id_qmk_led_matrix_effect_speed
+	SetLedMatrixEffectSpeed(rgblight.Speed) error
+
 	// Get the number of supported macros
 	GetDynamicKeymapMacroCount() (uint8, error)
 	// Get macro by VIA index (preferred)
@@ -78,6 +166,11 @@ type Client interface {
 	SetDynamicKeymapMacro(uint8, []byte) error
 	// Reset the dynamic keymap
 	ResetDynamicKeymapMacro() error
+	// Re-read the macro buffer into the client cache, unless created
+	// WithoutMacroCache
+	RefreshMacros() error
+	// Drop cached keyboard state, such as the macro buffer and capabilities
+	InvalidateCache()
 
 	// Get the number of supported keymap layers
 	GetDynamicKeymapLayerCount() (uint8, error)
@@ -92,7 +185,18 @@ type Client interface {
 	GetDynamicKeymapBuffer(uint16, uint8) ([]byte, error)
 	// Set multiple keycodes by buffer (id_dynamic_keymap_set_buffer)
 	SetDynamicKeymapBuffer(uint16, uint8, []byte) error
+	// Read every layer of a rows x cols dynamic keymap by buffer, reporting
+	// progress (if not nil) after each chunk
+	ReadKeymap(uint8, uint8, Progress) (keymap.Keymap, error)
+	// Write only the keycodes which differ from the keyboard's keymap, then
+	// verify them, reporting progress (if not nil) as bytes are written
+	WriteKeymap(keymap.Keymap, Progress) error
 
 	// Reset EEPROM
 	ResetEeprom() error
+
+	// id_bootloader_jump. The keyboard replies and resets, so the client is
+	// closed once it has gone. With WaitForBootloader, waits for a
+	// known bootloader to enumerate and reports it.
+	JumpToBootloader(...BootloaderOption) (Bootloader, error)
 }
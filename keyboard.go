@@ -7,18 +7,165 @@
 package qmk
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"path"
 	"sort"
+	"strings"
 
 	"github.com/karalabe/hid"
 )
 
 var (
-	ErrorHIDUnsupported   = errors.New("HID API is not supported")
-	ErrorNoKeyboardsFound = errors.New("no via-enabled keyboards found")
+	ErrorHIDUnsupported    = errors.New("HID API is not supported")
+	ErrorNoKeyboardsFound  = errors.New("no via-enabled keyboards found")
+	ErrorMultipleKeyboards = errors.New("multiple keyboards match")
 )
 
-type Keyboard = hid.DeviceInfo
+// enumerate lists all HID devices, replaceable for testing
+var enumerate = func() []hid.DeviceInfo {
+	return hid.Enumerate(0, 0)
+}
+
+// enumerateDevices lists all HID devices as Keyboards
+func enumerateDevices() []Keyboard {
+	devices := enumerate()
+	keyboards := make([]Keyboard, len(devices))
+	for i := range devices {
+		keyboards[i] = keyboardFromHid(devices[i])
+	}
+	return keyboards
+}
+
+// Keyboard describes an attached keyboard
+type Keyboard struct {
+	// USB vendor and product IDs, and serial number, which identify the
+	// keyboard wherever it is plugged in
+	VendorID  uint16 `json:"vendorId"`
+	ProductID uint16 `json:"productId"`
+	Serial    string `json:"serial,omitempty"`
+	// Platform-specific HID path, which may change when the keyboard is
+	// replugged
+	Path string `json:"path"`
+
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	// USB device release number
+	Release uint16 `json:"release,omitempty"`
+
+	// HID usage and USB interface number of the raw HID endpoint
+	UsagePage uint16 `json:"usagePage,omitempty"`
+	Usage     uint16 `json:"usage,omitempty"`
+	Interface int    `json:"interface"`
+
+	// Details reported over VIA, nil until loaded (see LoadVia) or until a
+	// keyboard definition fills in the matrix size
+	Via *ViaInfo `json:"via,omitempty"`
+}
+
+// ViaInfo describes a keyboard's VIA support
+type ViaInfo struct {
+	ProtocolVersion uint16 `json:"protocolVersion"`
+	// Dynamic keymap layers
+	Layers uint8 `json:"layers"`
+	// Switch matrix size, which VIA reads from a keyboard definition rather
+	// than the keyboard (zero until a definition is applied)
+	Rows uint8 `json:"rows,omitempty"`
+	Cols uint8 `json:"cols,omitempty"`
+}
+
+func keyboardFromHid(info hid.DeviceInfo) Keyboard {
+	return Keyboard{
+		VendorID:     info.VendorID,
+		ProductID:    info.ProductID,
+		Serial:       info.Serial,
+		Path:         info.Path,
+		Manufacturer: info.Manufacturer,
+		Product:      info.Product,
+		Release:      info.Release,
+		UsagePage:    info.UsagePage,
+		Usage:        info.Usage,
+		Interface:    info.Interface,
+	}
+}
+
+func (k Keyboard) hidInfo() hid.DeviceInfo {
+	return hid.DeviceInfo{
+		Path:         k.Path,
+		VendorID:     k.VendorID,
+		ProductID:    k.ProductID,
+		Release:      k.Release,
+		Serial:       k.Serial,
+		Manufacturer: k.Manufacturer,
+		Product:      k.Product,
+		UsagePage:    k.UsagePage,
+		Usage:        k.Usage,
+		Interface:    k.Interface,
+	}
+}
+
+// ID identifies the keyboard by vendor ID, product ID and serial, falling
+// back to the HID path for keyboards without a serial
+func (k Keyboard) ID() string {
+	if k.Serial != "" {
+		return fmt.Sprintf("%04x:%04x:%s", k.VendorID, k.ProductID, k.Serial)
+	}
+	return fmt.Sprintf("%04x:%04x@%s", k.VendorID, k.ProductID, k.Path)
+}
+
+// Name is a human readable name for the keyboard, from its USB product or
+// manufacturer strings where it has them
+func (k Keyboard) Name() string {
+	product := strings.TrimSpace(k.Product)
+	manufacturer := strings.TrimSpace(k.Manufacturer)
+	switch {
+	case product != "":
+		return product
+	case manufacturer != "":
+		return manufacturer + " keyboard"
+	default:
+		return fmt.Sprintf("Keyboard %04x:%04x", k.VendorID, k.ProductID)
+	}
+}
+
+func (k Keyboard) String() string {
+	return fmt.Sprintf("%s (%s)", k.Name(), k.ID())
+}
+
+// MarshalJSON adds the ID and display name to the keyboard fields
+func (k Keyboard) MarshalJSON() ([]byte, error) {
+	type keyboard Keyboard
+	return json.Marshal(struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		keyboard
+	}{k.ID(), k.Name(), keyboard(k)})
+}
+
+// LoadVia fills in the protocol version and layer count of Via, if they are
+// not already loaded, by briefly connecting to the keyboard. A matrix size
+// already in Via, as from a keyboard definition, is kept.
+func (k *Keyboard) LoadVia(opts ...ClientOption) error {
+	if k.Via != nil && k.Via.ProtocolVersion != 0 {
+		return nil
+	}
+	client, err := openKeyboard(*k, newClientOptions(opts))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	info, err := client.ViaInfo()
+	if err != nil {
+		return err
+	}
+	if k.Via != nil {
+		info.Rows, info.Cols = k.Via.Rows, k.Via.Cols
+	}
+	k.Via = &info
+	return nil
+}
 
 type byProduct []Keyboard
 
@@ -26,14 +173,64 @@ func (a byProduct) Len() int           { return len(a) }
 func (a byProduct) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byProduct) Less(i, j int) bool { return a[i].Product < a[j].Product }
 
-func ListKeyboards() ([]Keyboard, error) {
+// DeviceFilter selects keyboards. Zero valued fields match any keyboard.
+type DeviceFilter struct {
+	// USB vendor and product IDs
+	VendorID  uint16
+	ProductID uint16
+	// USB serial number
+	Serial string
+	// Glob patterns (see path.Match) for the USB product and manufacturer
+	Product      string
+	Manufacturer string
+	// Platform-specific HID path
+	Path string
+	// USB interface number (nil matches any interface)
+	Interface *int
+}
+
+// Match reports whether a keyboard satisfies every field set in the filter
+func (f DeviceFilter) Match(k Keyboard) bool {
+	switch {
+	case f.VendorID != 0 && f.VendorID != k.VendorID:
+		return false
+	case f.ProductID != 0 && f.ProductID != k.ProductID:
+		return false
+	case f.Serial != "" && f.Serial != k.Serial:
+		return false
+	case f.Path != "" && f.Path != k.Path:
+		return false
+	case f.Interface != nil && *f.Interface != k.Interface:
+		return false
+	case !globMatch(f.Product, k.Product):
+		return false
+	case !globMatch(f.Manufacturer, k.Manufacturer):
+		return false
+	}
+	return true
+}
+
+func globMatch(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// ListKeyboards lists VIA keyboards, sorted by product name. If filters are
+// given, only keyboards matching at least one of them are listed.
+func ListKeyboards(filters ...DeviceFilter) ([]Keyboard, error) {
 	var (
-		devices   = hid.Enumerate(0, 0)
+		devices   = enumerateDevices()
 		keyboards = []Keyboard{}
 	)
 
 	for i := range devices {
-		if devices[i].UsagePage == HidUsagePage && devices[i].Usage == HidUsage {
+		if devices[i].UsagePage != HidUsagePage || devices[i].Usage != HidUsage {
+			continue
+		}
+		if matchAny(filters, devices[i]) {
 			keyboards = append(keyboards, devices[i])
 		}
 	}
@@ -45,3 +242,36 @@ func ListKeyboards() ([]Keyboard, error) {
 	sort.Sort(byProduct(keyboards))
 	return keyboards, nil
 }
+
+func matchAny(filters []DeviceFilter, k Keyboard) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		if filter.Match(k) {
+			return true
+		}
+	}
+	return false
+}
+
+// OpenKeyboard connects to the single VIA keyboard matching filter. It fails
+// with ErrorNoMatchingDevice or ErrorMultipleKeyboards unless exactly one
+// keyboard matches.
+func OpenKeyboard(filter DeviceFilter, opts ...ClientOption) (Client, error) {
+	keyboards, err := ListKeyboards(filter)
+	if errors.Is(err, ErrorNoKeyboardsFound) {
+		return nil, ErrorNoMatchingDevice
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keyboards) > 1 {
+		names := make([]string, len(keyboards))
+		for i := range keyboards {
+			names[i] = fmt.Sprintf("%q (%s)", keyboards[i].Product, keyboards[i].Path)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrorMultipleKeyboards, strings.Join(names, ", "))
+	}
+	return openKeyboard(keyboards[0], newClientOptions(opts))
+}
@@ -0,0 +1,148 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/karalabe/hid"
+)
+
+var testDevices = []hid.DeviceInfo{
+	{Path: "/dev/hidraw0", VendorID: 0x4B54, ProductID: 0x2323, Serial: "A1", Manufacturer: "Keebs", Product: "Zeta 60", UsagePage: HidUsagePage, Usage: HidUsage, Interface: 1},
+	{Path: "/dev/hidraw1", VendorID: 0x4B54, ProductID: 0x2323, Serial: "A2", Manufacturer: "Keebs", Product: "Alpha 60", UsagePage: HidUsagePage, Usage: HidUsage, Interface: 1},
+	{Path: "/dev/hidraw2", VendorID: 0x4B54, ProductID: 0x2324, Serial: "B1", Manufacturer: "Keebs", Product: "Zeta TKL", UsagePage: HidUsagePage, Usage: HidUsage, Interface: 2},
+	{Path: "/dev/hidraw3", VendorID: 0x046D, ProductID: 0xC52B, Manufacturer: "Logitech", Product: "Receiver", UsagePage: 0x0001, Usage: 0x06},
+}
+
+func withTestDevices(t *testing.T, devices []hid.DeviceInfo) {
+	t.Helper()
+	previous := enumerate
+	enumerate = func() []hid.DeviceInfo { return devices }
+	t.Cleanup(func() { enumerate = previous })
+}
+
+func interfaceNumber(n int) *int {
+	return &n
+}
+
+var filterTests = []struct {
+	Filter DeviceFilter
+	Paths  []string
+}{
+	/* 0*/ {DeviceFilter{}, []string{"/dev/hidraw1", "/dev/hidraw0", "/dev/hidraw2"}},
+	/* 1*/ {DeviceFilter{VendorID: 0x4B54, ProductID: 0x2323}, []string{"/dev/hidraw1", "/dev/hidraw0"}},
+	/* 2*/ {DeviceFilter{ProductID: 0x2324}, []string{"/dev/hidraw2"}},
+	/* 3*/ {DeviceFilter{Serial: "A1"}, []string{"/dev/hidraw0"}},
+	/* 4*/ {DeviceFilter{Product: "Zeta*"}, []string{"/dev/hidraw0", "/dev/hidraw2"}},
+	/* 5*/ {DeviceFilter{Manufacturer: "Keebs", Product: "* 60"}, []string{"/dev/hidraw1", "/dev/hidraw0"}},
+	/* 6*/ {DeviceFilter{Path: "/dev/hidraw2"}, []string{"/dev/hidraw2"}},
+	/* 7*/ {DeviceFilter{Interface: interfaceNumber(2)}, []string{"/dev/hidraw2"}},
+	/* 8*/ {DeviceFilter{Interface: interfaceNumber(0)}, nil},
+	/* 9*/ {DeviceFilter{Product: "Receiver"}, nil},
+	/*10*/ {DeviceFilter{Product: "["}, nil},
+}
+
+func TestListKeyboardsFilter(t *testing.T) {
+	withTestDevices(t, testDevices)
+	for i, test := range filterTests {
+		keyboards, err := ListKeyboards(test.Filter)
+		if len(test.Paths) == 0 {
+			if !errors.Is(err, ErrorNoKeyboardsFound) {
+				t.Errorf("[%d] wanted error %v, got %v", i, ErrorNoKeyboardsFound, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		if len(keyboards) != len(test.Paths) {
+			t.Errorf("[%d] wanted %d keyboards, got %d", i, len(test.Paths), len(keyboards))
+			continue
+		}
+		for j := range keyboards {
+			if keyboards[j].Path != test.Paths[j] {
+				t.Errorf("[%d] wanted keyboard %d at %s, got %s", i, j, test.Paths[j], keyboards[j].Path)
+			}
+		}
+	}
+}
+
+func TestListKeyboardsMultipleFilters(t *testing.T) {
+	withTestDevices(t, testDevices)
+	keyboards, err := ListKeyboards(DeviceFilter{Serial: "A2"}, DeviceFilter{Serial: "B1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyboards) != 2 {
+		t.Errorf("wanted %d keyboards, got %d", 2, len(keyboards))
+	}
+}
+
+func TestOpenKeyboardSelection(t *testing.T) {
+	withTestDevices(t, testDevices)
+	if _, err := OpenKeyboard(DeviceFilter{Serial: "C1"}); !errors.Is(err, ErrorNoMatchingDevice) {
+		t.Errorf("wanted error %v, got %v", ErrorNoMatchingDevice, err)
+	}
+	if _, err := OpenKeyboard(DeviceFilter{VendorID: 0x4B54}); !errors.Is(err, ErrorMultipleKeyboards) {
+		t.Errorf("wanted error %v, got %v", ErrorMultipleKeyboards, err)
+	}
+}
+
+func TestKeyboardFromHid(t *testing.T) {
+	for _, device := range testDevices {
+		if info := keyboardFromHid(device).hidInfo(); info != device {
+			t.Errorf("wanted device %+v, got %+v", device, info)
+		}
+	}
+}
+
+func TestKeyboardIdentity(t *testing.T) {
+	tests := []struct {
+		Keyboard Keyboard
+		ID       string
+		Name     string
+	}{
+		{Keyboard{VendorID: 0x4B54, ProductID: 0x2323, Serial: "A1", Path: "/dev/hidraw0", Manufacturer: "Keebs", Product: " Zeta 60 "}, "4b54:2323:A1", "Zeta 60"},
+		{Keyboard{VendorID: 0x4B54, ProductID: 0x2323, Path: "/dev/hidraw0", Manufacturer: "Keebs"}, "4b54:2323@/dev/hidraw0", "Keebs keyboard"},
+		{Keyboard{VendorID: 0x4B54, ProductID: 0x2323, Path: "/dev/hidraw0"}, "4b54:2323@/dev/hidraw0", "Keyboard 4b54:2323"},
+	}
+	for i, test := range tests {
+		if id := test.Keyboard.ID(); id != test.ID {
+			t.Errorf("[%d] wanted ID %q, got %q", i, test.ID, id)
+		}
+		if name := test.Keyboard.Name(); name != test.Name {
+			t.Errorf("[%d] wanted name %q, got %q", i, test.Name, name)
+		}
+	}
+}
+
+func TestKeyboardJSON(t *testing.T) {
+	keyboard := keyboardFromHid(testDevices[0])
+	keyboard.Via = &ViaInfo{ProtocolVersion: ViaProtocolVersion9, Layers: 4}
+
+	encoded, err := json.Marshal(keyboard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":"4b54:2323:A1","name":"Zeta 60","vendorId":19284,"productId":8995,"serial":"A1","path":"/dev/hidraw0",` +
+		`"manufacturer":"Keebs","product":"Zeta 60","usagePage":65376,"usage":97,"interface":1,"via":{"protocolVersion":9,"layers":4}}`
+	if string(encoded) != want {
+		t.Errorf("wanted JSON %s, got %s", want, encoded)
+	}
+
+	var decoded Keyboard
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID() != keyboard.ID() || decoded.Via == nil || *decoded.Via != *keyboard.Via {
+		t.Errorf("wanted keyboard %+v, got %+v", keyboard, decoded)
+	}
+}
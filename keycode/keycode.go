@@ -8,6 +8,8 @@ package keycode
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -593,6 +595,14 @@ const (
 	USER15
 )
 
+// String is the keycode name, or a hex literal for keycodes without one
+func (k Keycode) String() string {
+	if name := k.Name(); name != "UNKNOWN" {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", uint16(k))
+}
+
 func (k Keycode) Name() string {
 	switch k {
 
@@ -1170,11 +1180,300 @@ func (k Keycode) Name() string {
 		return "USER15"
 
 	default:
+		if name, ok := quantumName(k, false, nil); ok {
+			return name
+		}
 		return "UNKNOWN"
 	}
 }
 
+// ShortName is the keycode's short alias, such as KC_ENT for KC_ENTER, or its
+// String for keycodes without one
+func (k Keycode) ShortName() string {
+	switch k {
+	case KC_TRANSPARENT:
+		return "KC_TRNS"
+	case KC_ENTER:
+		return "KC_ENT"
+	case KC_ESCAPE:
+		return "KC_ESC"
+	case KC_BACKSPACE:
+		return "KC_BSPC"
+	case KC_SPACE:
+		return "KC_SPC"
+	case KC_MINUS:
+		return "KC_MINS"
+	case KC_EQUAL:
+		return "KC_EQL"
+	case KC_LEFT_BRACKET:
+		return "KC_LBRC"
+	case KC_RIGHT_BRACKET:
+		return "KC_RBRC"
+	case KC_BACKSLASH:
+		return "KC_BSLS"
+	case KC_NONUS_HASH:
+		return "KC_NUHS"
+	case KC_SEMICOLON:
+		return "KC_SCLN"
+	case KC_QUOTE:
+		return "KC_QUOT"
+	case KC_GRAVE:
+		return "KC_GRV"
+	case KC_COMMA:
+		return "KC_COMM"
+	case KC_SLASH:
+		return "KC_SLSH"
+	case KC_NONUS_BACKSLASH:
+		return "KC_NUBS"
+	case KC_CAPS_LOCK:
+		return "KC_CAPS"
+	case KC_SCROLL_LOCK:
+		return "KC_SCRL"
+	case KC_NUM_LOCK:
+		return "KC_NUM"
+	case KC_LOCKING_CAPS_LOCK:
+		return "KC_LCAP"
+	case KC_LOCKING_NUM_LOCK:
+		return "KC_LNUM"
+	case KC_LOCKING_SCROLL_LOCK:
+		return "KC_LSCR"
+	case KC_PRINT_SCREEN:
+		return "KC_PSCR"
+	case KC_PAUSE:
+		return "KC_PAUS"
+	case KC_INSERT:
+		return "KC_INS"
+	case KC_PAGE_UP:
+		return "KC_PGUP"
+	case KC_DELETE:
+		return "KC_DEL"
+	case KC_PAGE_DOWN:
+		return "KC_PGDN"
+	case KC_RIGHT:
+		return "KC_RGHT"
+	case KC_APPLICATION:
+		return "KC_APP"
+	case KC_EXECUTE:
+		return "KC_EXEC"
+	case KC_SELECT:
+		return "KC_SLCT"
+	case KC_AGAIN:
+		return "KC_AGIN"
+	case KC_PASTE:
+		return "KC_PSTE"
+	case KC_ALTERNATE_ERASE:
+		return "KC_ERAS"
+	case KC_SYSTEM_REQUEST:
+		return "KC_SYRQ"
+	case KC_CANCEL:
+		return "KC_CNCL"
+	case KC_CLEAR:
+		return "KC_CLR"
+	case KC_PRIOR:
+		return "KC_PRIR"
+	case KC_RETURN:
+		return "KC_RETN"
+	case KC_SEPARATOR:
+		return "KC_SEPR"
+	case KC_CLEAR_AGAIN:
+		return "KC_CLAG"
+	case KC_CRSEL:
+		return "KC_CRSL"
+	case KC_EXSEL:
+		return "KC_EXSL"
+	case KC_KP_SLASH:
+		return "KC_PSLS"
+	case KC_KP_ASTERISK:
+		return "KC_PAST"
+	case KC_KP_MINUS:
+		return "KC_PMNS"
+	case KC_KP_PLUS:
+		return "KC_PPLS"
+	case KC_KP_ENTER:
+		return "KC_PENT"
+	case KC_KP_1:
+		return "KC_P1"
+	case KC_KP_2:
+		return "KC_P2"
+	case KC_KP_3:
+		return "KC_P3"
+	case KC_KP_4:
+		return "KC_P4"
+	case KC_KP_5:
+		return "KC_P5"
+	case KC_KP_6:
+		return "KC_P6"
+	case KC_KP_7:
+		return "KC_P7"
+	case KC_KP_8:
+		return "KC_P8"
+	case KC_KP_9:
+		return "KC_P9"
+	case KC_KP_0:
+		return "KC_P0"
+	case KC_KP_DOT:
+		return "KC_PDOT"
+	case KC_KP_EQUAL:
+		return "KC_PEQL"
+	case KC_KP_COMMA:
+		return "KC_PCMM"
+	case KC_INTERNATIONAL_1:
+		return "KC_INT1"
+	case KC_INTERNATIONAL_2:
+		return "KC_INT2"
+	case KC_INTERNATIONAL_3:
+		return "KC_INT3"
+	case KC_INTERNATIONAL_4:
+		return "KC_INT4"
+	case KC_INTERNATIONAL_5:
+		return "KC_INT5"
+	case KC_INTERNATIONAL_6:
+		return "KC_INT6"
+	case KC_INTERNATIONAL_7:
+		return "KC_INT7"
+	case KC_INTERNATIONAL_8:
+		return "KC_INT8"
+	case KC_INTERNATIONAL_9:
+		return "KC_INT9"
+	case KC_LANGUAGE_1:
+		return "KC_LNG1"
+	case KC_LANGUAGE_2:
+		return "KC_LNG2"
+	case KC_LANGUAGE_3:
+		return "KC_LNG3"
+	case KC_LANGUAGE_4:
+		return "KC_LNG4"
+	case KC_LANGUAGE_5:
+		return "KC_LNG5"
+	case KC_LANGUAGE_6:
+		return "KC_LNG6"
+	case KC_LANGUAGE_7:
+		return "KC_LNG7"
+	case KC_LANGUAGE_8:
+		return "KC_LNG8"
+	case KC_LANGUAGE_9:
+		return "KC_LNG9"
+	case KC_LEFT_CTRL:
+		return "KC_LCTL"
+	case KC_LEFT_SHIFT:
+		return "KC_LSFT"
+	case KC_LEFT_ALT:
+		return "KC_LALT"
+	case KC_LEFT_GUI:
+		return "KC_LGUI"
+	case KC_RIGHT_CTRL:
+		return "KC_RCTL"
+	case KC_RIGHT_SHIFT:
+		return "KC_RSFT"
+	case KC_RIGHT_ALT:
+		return "KC_RALT"
+	case KC_RIGHT_GUI:
+		return "KC_RGUI"
+	case KC_SYSTEM_POWER:
+		return "KC_PWR"
+	case KC_SYSTEM_SLEEP:
+		return "KC_SLEP"
+	case KC_SYSTEM_WAKE:
+		return "KC_WAKE"
+	case KC_AUDIO_MUTE:
+		return "KC_MUTE"
+	case KC_AUDIO_VOL_UP:
+		return "KC_VOLU"
+	case KC_AUDIO_VOL_DOWN:
+		return "KC_VOLD"
+	case KC_MEDIA_NEXT_TRACK:
+		return "KC_MNXT"
+	case KC_MEDIA_PREV_TRACK:
+		return "KC_MPRV"
+	case KC_MEDIA_STOP:
+		return "KC_MSTP"
+	case KC_MEDIA_PLAY_PAUSE:
+		return "KC_MPLY"
+	case KC_MEDIA_SELECT:
+		return "KC_MSEL"
+	case KC_MEDIA_EJECT:
+		return "KC_EJCT"
+	case KC_CALCULATOR:
+		return "KC_CALC"
+	case KC_MY_COMPUTER:
+		return "KC_MYCM"
+	case KC_WWW_SEARCH:
+		return "KC_WSCH"
+	case KC_WWW_HOME:
+		return "KC_WHOM"
+	case KC_WWW_BACK:
+		return "KC_WBAK"
+	case KC_WWW_FORWARD:
+		return "KC_WFWD"
+	case KC_WWW_STOP:
+		return "KC_WSTP"
+	case KC_WWW_REFRESH:
+		return "KC_WREF"
+	case KC_WWW_FAVORITES:
+		return "KC_WFAV"
+	case KC_MEDIA_FAST_FORWARD:
+		return "KC_MFFD"
+	case KC_MEDIA_REWIND:
+		return "KC_MRWD"
+	case KC_BRIGHTNESS_UP:
+		return "KC_BRIU"
+	case KC_BRIGHTNESS_DOWN:
+		return "KC_BRID"
+	case KC_MS_UP:
+		return "KC_MS_U"
+	case KC_MS_DOWN:
+		return "KC_MS_D"
+	case KC_MS_LEFT:
+		return "KC_MS_L"
+	case KC_MS_RIGHT:
+		return "KC_MS_R"
+	case KC_MS_BTN1:
+		return "KC_BTN1"
+	case KC_MS_BTN2:
+		return "KC_BTN2"
+	case KC_MS_BTN3:
+		return "KC_BTN3"
+	case KC_MS_BTN4:
+		return "KC_BTN4"
+	case KC_MS_BTN5:
+		return "KC_BTN5"
+	case KC_MS_WH_UP:
+		return "KC_WH_U"
+	case KC_MS_WH_DOWN:
+		return "KC_WH_D"
+	case KC_MS_WH_LEFT:
+		return "KC_WH_L"
+	case KC_MS_WH_RIGHT:
+		return "KC_WH_R"
+	case KC_MS_ACCEL0:
+		return "KC_ACL0"
+	case KC_MS_ACCEL1:
+		return "KC_ACL1"
+	case KC_MS_ACCEL2:
+		return "KC_ACL2"
+	default:
+		if name, ok := quantumName(k, true, nil); ok {
+			return name
+		}
+		return k.String()
+	}
+}
+
+// KeycodeFromString parses a keycode name, with or without braces and the
+// KC_ prefix, a hex literal such as 0x5101, or a QMK functional form with
+// numbered layers such as LT(1, KC_SPC)
 func KeycodeFromString(value string) (Keycode, error) {
+	value = strings.TrimSpace(value)
+	if code, ok, err := quantumFromString(value, nil); ok {
+		return code, err
+	}
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		code, err := strconv.ParseUint(value[2:], 16, 16)
+		if err != nil {
+			return KC_NO, ErrorUnknownKeycode
+		}
+		return Keycode(code), nil
+	}
 	value = strings.Replace(value, "{", "", -1)
 	value = strings.Replace(value, "}", "", -1)
 	value = strings.Replace(value, "KC_", "", -1)
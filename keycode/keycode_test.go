@@ -8,6 +8,7 @@ package keycode
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
@@ -544,3 +545,59 @@ func TestKeycodeToBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestKeycodeLiterals(t *testing.T) {
+	literalTests := []struct {
+		Input   string
+		Keycode Keycode
+		String  string
+	}{
+		{"0x5101", 0x5101, "MO(1)"},
+		{"0x5A00", 0x5A00, "0x5A00"},
+		{" 0X00e0 ", KC_LEFT_CTRL, "KC_LEFT_CTRL"},
+		{"0x0004", KC_A, "KC_A"},
+	}
+	for i, test := range literalTests {
+		keycode, err := KeycodeFromString(test.Input)
+		if err != nil {
+			t.Errorf("[%v] (%v) %v", i, test.Input, err)
+		}
+		if keycode != test.Keycode {
+			t.Errorf("[%v] (%v) wanted keycode 0x%04x, got 0x%04x", i, test.Input, uint16(test.Keycode), uint16(keycode))
+		}
+		if s := keycode.String(); s != test.String {
+			t.Errorf("[%v] (%v) wanted keycode string %v, got %v", i, test.Input, test.String, s)
+		}
+	}
+	for _, input := range []string{"0x", "0x10000", "0xZZ"} {
+		if _, err := KeycodeFromString(input); !errors.Is(err, ErrorUnknownKeycode) {
+			t.Errorf("(%v) wanted error %v, got %v", input, ErrorUnknownKeycode, err)
+		}
+	}
+}
+
+func TestKeycodeShortName(t *testing.T) {
+	for i, test := range keycodeTests {
+		// Short names parse back to the same keycode
+		keycode, err := KeycodeFromString(test.Keycode.ShortName())
+		if err != nil || keycode != test.Keycode {
+			t.Errorf("[%v] (%v) wanted short name %v to parse as %v, got %v (%v)", i, test.Input, test.Keycode.ShortName(), test.Keycode, keycode, err)
+		}
+	}
+	shortTests := []struct {
+		Keycode Keycode
+		Short   string
+	}{
+		{KC_ENTER, "KC_ENT"},
+		{KC_TRANSPARENT, "KC_TRNS"},
+		{KC_LEFT_GUI, "KC_LGUI"},
+		{KC_A, "KC_A"},
+		{0x5101, "MO(1)"},
+		{0x5A00, "0x5A00"},
+	}
+	for i, test := range shortTests {
+		if short := test.Keycode.ShortName(); short != test.Short {
+			t.Errorf("[%v] wanted short name %v, got %v", i, test.Short, short)
+		}
+	}
+}
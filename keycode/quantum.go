@@ -0,0 +1,593 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keycode
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrorBadArgument = errors.New("invalid keycode argument")
+
+// Quantum keycode ranges, in the legacy (pre QMK 0.19) numbering used by this
+// package
+const (
+	QK_MODS             Keycode = 0x0100
+	QK_MODS_MAX         Keycode = 0x1FFF
+	QK_LAYER_TAP        Keycode = 0x4000
+	QK_LAYER_TAP_MAX    Keycode = 0x4FFF
+	QK_TO               Keycode = 0x5000
+	QK_MOMENTARY        Keycode = 0x5100
+	QK_DEF_LAYER        Keycode = 0x5200
+	QK_TOGGLE_LAYER     Keycode = 0x5300
+	QK_ONE_SHOT_LAYER   Keycode = 0x5400
+	QK_ONE_SHOT_MOD     Keycode = 0x5500
+	QK_TAP_DANCE        Keycode = 0x5700
+	QK_LAYER_TAP_TOGGLE Keycode = 0x5800
+	QK_LAYER_MOD        Keycode = 0x5900
+	QK_MOD_TAP          Keycode = 0x6000
+	QK_MOD_TAP_MAX      Keycode = 0x7FFF
+
+	// TO() activates its layer on press
+	toOnPress Keycode = 0x10
+)
+
+// Mod is a QMK modifier bitmask. The right hand flag makes every set
+// modifier a right hand one.
+type Mod uint8
+
+const (
+	MOD_LCTL Mod = 0x01
+	MOD_LSFT Mod = 0x02
+	MOD_LALT Mod = 0x04
+	MOD_LGUI Mod = 0x08
+	MOD_RCTL Mod = 0x11
+	MOD_RSFT Mod = 0x12
+	MOD_RALT Mod = 0x14
+	MOD_RGUI Mod = 0x18
+	MOD_MEH  Mod = 0x07
+	MOD_HYPR Mod = 0x0F
+
+	modRight Mod = 0x10
+	modMask  Mod = 0x1F
+)
+
+// Layer limits of each layer keycode, from the smallest of the legacy and v12
+// ranges
+const (
+	maxLayerTap = 16
+	maxLayerMod = 16
+	maxLayerTo  = 16
+	maxLayer    = 32
+	maxTapDance = 256
+)
+
+var modBits = []struct {
+	bit  Mod
+	name string
+}{
+	{0x01, "CTL"},
+	{0x02, "SFT"},
+	{0x04, "ALT"},
+	{0x08, "GUI"},
+}
+
+// modNames are the MOD_ constants accepted in mod expressions
+var modNames = map[string]Mod{
+	"MOD_LCTL": MOD_LCTL,
+	"MOD_LSFT": MOD_LSFT,
+	"MOD_LALT": MOD_LALT,
+	"MOD_LGUI": MOD_LGUI,
+	"MOD_RCTL": MOD_RCTL,
+	"MOD_RSFT": MOD_RSFT,
+	"MOD_RALT": MOD_RALT,
+	"MOD_RGUI": MOD_RGUI,
+	"MOD_MEH":  MOD_MEH,
+	"MOD_HYPR": MOD_HYPR,
+}
+
+// String is the mod as MOD_ constants joined with |
+func (m Mod) String() string {
+	m &= modMask
+	if m&^modRight == 0 {
+		return fmt.Sprintf("0x%02X", uint8(m))
+	}
+	hand := "L"
+	if m&modRight != 0 {
+		hand = "R"
+	}
+	var names []string
+	for _, b := range modBits {
+		if m&b.bit != 0 {
+			names = append(names, "MOD_"+hand+b.name)
+		}
+	}
+	return strings.Join(names, " | ")
+}
+
+// modFunctions wrap a basic keycode with modifiers, as in LCTL(KC_A)
+var modFunctions = map[string]Mod{
+	"LCTL": MOD_LCTL, "C": MOD_LCTL,
+	"LSFT": MOD_LSFT, "S": MOD_LSFT,
+	"LALT": MOD_LALT, "A": MOD_LALT, "LOPT": MOD_LALT,
+	"LGUI": MOD_LGUI, "G": MOD_LGUI, "LCMD": MOD_LGUI, "LWIN": MOD_LGUI,
+	"RCTL": MOD_RCTL,
+	"RSFT": MOD_RSFT,
+	"RALT": MOD_RALT, "ALGR": MOD_RALT, "ROPT": MOD_RALT,
+	"RGUI": MOD_RGUI, "RCMD": MOD_RGUI, "RWIN": MOD_RGUI,
+	"MEH":  MOD_MEH,
+	"HYPR": MOD_HYPR,
+	"LCS":  MOD_LCTL | MOD_LSFT, "C_S": MOD_LCTL | MOD_LSFT,
+	"LCA":  MOD_LCTL | MOD_LALT,
+	"LSA":  MOD_LSFT | MOD_LALT,
+	"LCAG": MOD_LCTL | MOD_LALT | MOD_LGUI,
+	"SGUI": MOD_LSFT | MOD_LGUI, "SCMD": MOD_LSFT | MOD_LGUI, "SWIN": MOD_LSFT | MOD_LGUI,
+}
+
+// modTapFunctions are the MT(mod, kc) shorthands, as in LCTL_T(KC_A)
+var modTapFunctions = map[string]Mod{
+	"LCTL_T": MOD_LCTL, "CTL_T": MOD_LCTL,
+	"LSFT_T": MOD_LSFT, "SFT_T": MOD_LSFT,
+	"LALT_T": MOD_LALT, "ALT_T": MOD_LALT, "LOPT_T": MOD_LALT, "OPT_T": MOD_LALT,
+	"LGUI_T": MOD_LGUI, "GUI_T": MOD_LGUI, "LCMD_T": MOD_LGUI, "CMD_T": MOD_LGUI, "LWIN_T": MOD_LGUI, "WIN_T": MOD_LGUI,
+	"RCTL_T": MOD_RCTL,
+	"RSFT_T": MOD_RSFT,
+	"RALT_T": MOD_RALT, "ALGR_T": MOD_RALT, "ROPT_T": MOD_RALT,
+	"RGUI_T": MOD_RGUI, "RCMD_T": MOD_RGUI, "RWIN_T": MOD_RGUI,
+	"MEH_T":  MOD_MEH,
+	"HYPR_T": MOD_HYPR, "ALL_T": MOD_HYPR,
+	"LCS_T": MOD_LCTL | MOD_LSFT, "C_S_T": MOD_LCTL | MOD_LSFT,
+	"LCA_T":  MOD_LCTL | MOD_LALT,
+	"LSA_T":  MOD_LSFT | MOD_LALT,
+	"LCAG_T": MOD_LCTL | MOD_LALT | MOD_LGUI,
+	"SGUI_T": MOD_LSFT | MOD_LGUI, "SCMD_T": MOD_LSFT | MOD_LGUI, "SWIN_T": MOD_LSFT | MOD_LGUI,
+}
+
+// layerFunctions take a single layer, as in MO(1)
+var layerFunctions = map[string]struct {
+	base Keycode
+	max  int
+}{
+	"TO":  {QK_TO | toOnPress, maxLayerTo},
+	"MO":  {QK_MOMENTARY, maxLayer},
+	"DF":  {QK_DEF_LAYER, maxLayer},
+	"TG":  {QK_TOGGLE_LAYER, maxLayer},
+	"OSL": {QK_ONE_SHOT_LAYER, maxLayer},
+	"TT":  {QK_LAYER_TAP_TOGGLE, maxLayer},
+}
+
+// shiftedKeycodes are the US ANSI shifted symbols, LSFT() of a basic keycode
+var shiftedKeycodes = []struct {
+	name  string
+	short string
+	code  Keycode
+}{
+	{"KC_TILDE", "KC_TILD", KC_GRAVE},
+	{"KC_EXCLAIM", "KC_EXLM", KC_1},
+	{"KC_AT", "KC_AT", KC_2},
+	{"KC_HASH", "KC_HASH", KC_3},
+	{"KC_DOLLAR", "KC_DLR", KC_4},
+	{"KC_PERCENT", "KC_PERC", KC_5},
+	{"KC_CIRCUMFLEX", "KC_CIRC", KC_6},
+	{"KC_AMPERSAND", "KC_AMPR", KC_7},
+	{"KC_ASTERISK", "KC_ASTR", KC_8},
+	{"KC_LEFT_PAREN", "KC_LPRN", KC_9},
+	{"KC_RIGHT_PAREN", "KC_RPRN", KC_0},
+	{"KC_UNDERSCORE", "KC_UNDS", KC_MINUS},
+	{"KC_PLUS", "KC_PLUS", KC_EQUAL},
+	{"KC_LEFT_CURLY_BRACE", "KC_LCBR", KC_LEFT_BRACKET},
+	{"KC_RIGHT_CURLY_BRACE", "KC_RCBR", KC_RIGHT_BRACKET},
+	{"KC_PIPE", "KC_PIPE", KC_BACKSLASH},
+	{"KC_COLON", "KC_COLN", KC_SEMICOLON},
+	{"KC_DOUBLE_QUOTE", "KC_DQUO", KC_QUOTE},
+	{"KC_LEFT_ANGLE_BRACKET", "KC_LABK", KC_COMMA},
+	{"KC_RIGHT_ANGLE_BRACKET", "KC_RABK", KC_DOT},
+	{"KC_QUESTION", "KC_QUES", KC_SLASH},
+}
+
+// modTapNames name MT(mod, kc) for single modifiers, MEH and HYPR
+var modTapNames = []struct {
+	mod  Mod
+	name string
+}{
+	{MOD_LCTL, "LCTL_T"},
+	{MOD_LSFT, "LSFT_T"},
+	{MOD_LALT, "LALT_T"},
+	{MOD_LGUI, "LGUI_T"},
+	{MOD_RCTL, "RCTL_T"},
+	{MOD_RSFT, "RSFT_T"},
+	{MOD_RALT, "RALT_T"},
+	{MOD_RGUI, "RGUI_T"},
+	{MOD_MEH, "MEH_T"},
+	{MOD_HYPR, "HYPR_T"},
+}
+
+// ParseKeycode parses a keycode as KeycodeFromString does, resolving layer
+// arguments of functional forms such as LT(_NAV, KC_SPC) through layers, which
+// may be nil. Functional forms include the layer keycodes, modifier wrappers
+// such as LCTL(KC_C), mod-taps such as MT(MOD_LCTL | MOD_LSFT, KC_A) and
+// LCTL_T(KC_A), OSM(MOD_LSFT) and TD(0). Shifted symbols such as KC_EXLM,
+// the _______ and XXXXXXX fillers, and the QMK 0.19 names FormatKeycode
+// writes, are also accepted.
+func ParseKeycode(value string, layers map[string]uint8) (Keycode, error) {
+	value = strings.TrimSpace(value)
+	if code, ok, err := quantumFromString(value, layers); ok {
+		return code, err
+	}
+	return KeycodeFromString(value)
+}
+
+// numberedKeycodes are QMK 0.19's names for VIA's macro and custom keycodes,
+// as in QK_MACRO_0 for MACRO00 and QK_KB_0 for USER00
+var numberedKeycodes = []struct {
+	prefix string
+	base   Keycode
+	count  int
+}{
+	{"QK_MACRO_", MACRO00, 16},
+	{"QK_KB_", USER00, 16},
+}
+
+// Tri-layer keycodes, as QMK 0.19 names FN_MO13 and FN_MO23
+const (
+	triLayerLower = "QK_TRI_LAYER_LOWER"
+	triLayerUpper = "QK_TRI_LAYER_UPPER"
+)
+
+// FormatKeycode names a keycode for a QMK 0.19 or later keymap.c. It is named
+// as String does, or as ShortName does if short is set, except that VIA's
+// macro, custom and tri-layer keycodes take QMK 0.19's names, such as
+// QK_MACRO_0 and QK_KB_0, and layer arguments of functional forms such as
+// MO(1) are named through layers, which may be nil.
+func FormatKeycode(k Keycode, layers []string, short bool) string {
+	for _, numbered := range numberedKeycodes {
+		if k >= numbered.base && k < numbered.base+Keycode(numbered.count) {
+			return numbered.prefix + strconv.Itoa(int(k-numbered.base))
+		}
+	}
+	switch k {
+	case FN_MO13:
+		return triLayerLower
+	case FN_MO23:
+		return triLayerUpper
+	}
+	if name, ok := quantumName(k, short, layers); ok {
+		return name
+	}
+	if short {
+		return k.ShortName()
+	}
+	return k.String()
+}
+
+// quantumFromString parses the keycodes ParseKeycode adds to
+// KeycodeFromString, reporting whether value is one of them
+func quantumFromString(value string, layers map[string]uint8) (Keycode, bool, error) {
+	switch value {
+	case "_______":
+		return KC_TRANSPARENT, true, nil
+	case "XXXXXXX":
+		return KC_NO, true, nil
+	case triLayerLower:
+		return FN_MO13, true, nil
+	case triLayerUpper:
+		return FN_MO23, true, nil
+	}
+	for _, numbered := range numberedKeycodes {
+		if !strings.HasPrefix(value, numbered.prefix) {
+			continue
+		}
+		index, err := strconv.Atoi(value[len(numbered.prefix):])
+		if err != nil || index < 0 || index >= numbered.count || strconv.Itoa(index) != value[len(numbered.prefix):] {
+			return KC_NO, true, ErrorUnknownKeycode
+		}
+		return numbered.base + Keycode(index), true, nil
+	}
+	for _, shifted := range shiftedKeycodes {
+		if value == shifted.name || value == shifted.short {
+			return Keycode(MOD_LSFT)<<8 | shifted.code, true, nil
+		}
+	}
+	open := strings.IndexByte(value, '(')
+	if open < 0 {
+		return KC_NO, false, nil
+	}
+	code, err := functionFromString(value, open, layers)
+	return code, true, err
+}
+
+// functionFromString parses a functional keycode, with its ( at open
+func functionFromString(value string, open int, layers map[string]uint8) (Keycode, error) {
+	if !strings.HasSuffix(value, ")") {
+		return KC_NO, fmt.Errorf("%w: unbalanced parentheses", ErrorUnknownKeycode)
+	}
+	function := strings.TrimSpace(value[:open])
+	args, err := splitArguments(value[open+1 : len(value)-1])
+	if err != nil {
+		return KC_NO, err
+	}
+	argCount := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%w: %s takes %d arguments, got %d", ErrorBadArgument, function, n, len(args))
+		}
+		return nil
+	}
+
+	if mod, ok := modFunctions[function]; ok {
+		if err := argCount(1); err != nil {
+			return KC_NO, err
+		}
+		code, err := ParseKeycode(args[0], layers)
+		if err != nil {
+			return KC_NO, err
+		}
+		if code > QK_MODS_MAX {
+			return KC_NO, fmt.Errorf("%w: %s cannot modify %s", ErrorBadArgument, function, code)
+		}
+		return code | Keycode(mod)<<8, nil
+	}
+	if mod, ok := modTapFunctions[function]; ok {
+		if err := argCount(1); err != nil {
+			return KC_NO, err
+		}
+		return modTap(mod, args[0], layers)
+	}
+	if f, ok := layerFunctions[function]; ok {
+		if err := argCount(1); err != nil {
+			return KC_NO, err
+		}
+		layer, err := parseLayer(args[0], layers, f.max)
+		if err != nil {
+			return KC_NO, err
+		}
+		return f.base | Keycode(layer), nil
+	}
+
+	switch function {
+	case "LT":
+		if err := argCount(2); err != nil {
+			return KC_NO, err
+		}
+		layer, err := parseLayer(args[0], layers, maxLayerTap)
+		if err != nil {
+			return KC_NO, err
+		}
+		code, err := basicArgument(function, args[1], layers)
+		if err != nil {
+			return KC_NO, err
+		}
+		return QK_LAYER_TAP | Keycode(layer)<<8 | code, nil
+	case "LM":
+		if err := argCount(2); err != nil {
+			return KC_NO, err
+		}
+		layer, err := parseLayer(args[0], layers, maxLayerMod)
+		if err != nil {
+			return KC_NO, err
+		}
+		mod, err := parseMod(args[1])
+		if err != nil {
+			return KC_NO, err
+		}
+		if mod&modRight != 0 {
+			return KC_NO, fmt.Errorf("%w: LM takes left hand mods, got %s", ErrorBadArgument, mod)
+		}
+		return QK_LAYER_MOD | Keycode(layer)<<4 | Keycode(mod), nil
+	case "MT":
+		if err := argCount(2); err != nil {
+			return KC_NO, err
+		}
+		mod, err := parseMod(args[0])
+		if err != nil {
+			return KC_NO, err
+		}
+		return modTap(mod, args[1], layers)
+	case "OSM":
+		if err := argCount(1); err != nil {
+			return KC_NO, err
+		}
+		mod, err := parseMod(args[0])
+		if err != nil {
+			return KC_NO, err
+		}
+		return QK_ONE_SHOT_MOD | Keycode(mod), nil
+	case "TD":
+		if err := argCount(1); err != nil {
+			return KC_NO, err
+		}
+		index, err := parseLayer(args[0], layers, maxTapDance)
+		if err != nil {
+			return KC_NO, err
+		}
+		return QK_TAP_DANCE | Keycode(index), nil
+	}
+	return KC_NO, ErrorUnknownKeycode
+}
+
+// splitArguments splits a function's arguments at top level commas
+func splitArguments(value string) ([]string, error) {
+	var (
+		args  []string
+		depth int
+		start int
+	)
+	for i, c := range value {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("%w: unbalanced parentheses", ErrorUnknownKeycode)
+			}
+		case ',':
+			if depth == 0 {
+				args = append(args, strings.TrimSpace(value[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("%w: unbalanced parentheses", ErrorUnknownKeycode)
+	}
+	args = append(args, strings.TrimSpace(value[start:]))
+	for _, arg := range args {
+		if arg == "" {
+			return nil, fmt.Errorf("%w: empty argument", ErrorBadArgument)
+		}
+	}
+	return args, nil
+}
+
+func modTap(mod Mod, arg string, layers map[string]uint8) (Keycode, error) {
+	code, err := basicArgument("MT", arg, layers)
+	if err != nil {
+		return KC_NO, err
+	}
+	return QK_MOD_TAP | Keycode(mod&modMask)<<8 | code, nil
+}
+
+// basicArgument parses a keycode argument which must be a basic keycode
+func basicArgument(function string, arg string, layers map[string]uint8) (Keycode, error) {
+	code, err := ParseKeycode(arg, layers)
+	if err != nil {
+		return KC_NO, err
+	}
+	if code > 0xFF {
+		return KC_NO, fmt.Errorf("%w: %s takes a basic keycode, got %s", ErrorBadArgument, function, code)
+	}
+	return code, nil
+}
+
+// parseLayer parses a layer number or name below max
+func parseLayer(arg string, layers map[string]uint8, max int) (int, error) {
+	layer, err := strconv.ParseInt(arg, 0, 16)
+	if err != nil {
+		named, ok := layers[arg]
+		if !ok {
+			return 0, fmt.Errorf("%w: unknown layer %q", ErrorBadArgument, arg)
+		}
+		layer = int64(named)
+	}
+	if layer < 0 || layer >= int64(max) {
+		return 0, fmt.Errorf("%w: layer %d is not below %d", ErrorBadArgument, layer, max)
+	}
+	return int(layer), nil
+}
+
+// parseMod parses MOD_ constants or numbers joined with |
+func parseMod(arg string) (Mod, error) {
+	var mod Mod
+	for _, part := range strings.Split(arg, "|") {
+		part = strings.TrimSpace(strings.Trim(strings.TrimSpace(part), "()"))
+		if m, ok := modNames[part]; ok {
+			mod |= m
+			continue
+		}
+		m, err := strconv.ParseUint(part, 0, 8)
+		if err != nil || Mod(m)&^modMask != 0 {
+			return 0, fmt.Errorf("%w: unknown mod %q", ErrorBadArgument, part)
+		}
+		mod |= Mod(m)
+	}
+	return mod, nil
+}
+
+// quantumName names keycodes in the quantum ranges, using short names for
+// wrapped keycodes if short is set, and naming layer arguments through layers,
+// which may be nil
+func quantumName(k Keycode, short bool, layers []string) (string, bool) {
+	inner := func(code Keycode) string {
+		if short {
+			return code.ShortName()
+		}
+		return code.String()
+	}
+	layer := func(index Keycode) string {
+		if int(index) < len(layers) && layers[index] != "" {
+			return layers[index]
+		}
+		return strconv.Itoa(int(index))
+	}
+	switch {
+	case k >= QK_MODS && k <= QK_MODS_MAX:
+		mod := Mod(k>>8) & modMask
+		code := k & 0xFF
+		if mod == modRight {
+			return "", false
+		}
+		if mod == MOD_LSFT {
+			for _, shifted := range shiftedKeycodes {
+				if shifted.code != code {
+					continue
+				}
+				if short {
+					return shifted.short, true
+				}
+				return shifted.name, true
+			}
+		}
+		switch mod {
+		case MOD_MEH:
+			return "MEH(" + inner(code) + ")", true
+		case MOD_HYPR:
+			return "HYPR(" + inner(code) + ")", true
+		}
+		hand := "L"
+		if mod&modRight != 0 {
+			hand = "R"
+		}
+		name := inner(code)
+		for i := len(modBits) - 1; i >= 0; i-- {
+			if mod&modBits[i].bit != 0 {
+				name = hand + modBits[i].name + "(" + name + ")"
+			}
+		}
+		return name, true
+
+	case k >= QK_LAYER_TAP && k <= QK_LAYER_TAP_MAX:
+		return fmt.Sprintf("LT(%s, %s)", layer((k>>8)&0x0F), inner(k&0xFF)), true
+
+	case k >= QK_TO|toOnPress && k < QK_TO|toOnPress+maxLayerTo:
+		return fmt.Sprintf("TO(%s)", layer(k&0x0F)), true
+	case k >= QK_MOMENTARY && k < QK_MOMENTARY+maxLayer:
+		return fmt.Sprintf("MO(%s)", layer(k-QK_MOMENTARY)), true
+	case k >= QK_DEF_LAYER && k < QK_DEF_LAYER+maxLayer:
+		return fmt.Sprintf("DF(%s)", layer(k-QK_DEF_LAYER)), true
+	case k >= QK_TOGGLE_LAYER && k < QK_TOGGLE_LAYER+maxLayer:
+		return fmt.Sprintf("TG(%s)", layer(k-QK_TOGGLE_LAYER)), true
+	case k >= QK_ONE_SHOT_LAYER && k < QK_ONE_SHOT_LAYER+maxLayer:
+		return fmt.Sprintf("OSL(%s)", layer(k-QK_ONE_SHOT_LAYER)), true
+	case k >= QK_ONE_SHOT_MOD && k <= QK_ONE_SHOT_MOD|Keycode(modMask):
+		return fmt.Sprintf("OSM(%s)", Mod(k&0xFF)), true
+	case k >= QK_TAP_DANCE && k < QK_TAP_DANCE+maxTapDance:
+		return fmt.Sprintf("TD(%d)", k-QK_TAP_DANCE), true
+	case k >= QK_LAYER_TAP_TOGGLE && k < QK_LAYER_TAP_TOGGLE+maxLayer:
+		return fmt.Sprintf("TT(%s)", layer(k-QK_LAYER_TAP_TOGGLE)), true
+	case k >= QK_LAYER_MOD && k < QK_LAYER_MOD+maxLayerMod<<4:
+		mod := Mod(k & 0x0F)
+		if mod == 0 {
+			return "", false
+		}
+		return fmt.Sprintf("LM(%s, %s)", layer((k>>4)&0x0F), mod), true
+
+	case k >= QK_MOD_TAP && k <= QK_MOD_TAP_MAX:
+		mod := Mod(k>>8) & modMask
+		if mod&^modRight == 0 {
+			return "", false
+		}
+		for _, alias := range modTapNames {
+			if alias.mod == mod {
+				return alias.name + "(" + inner(k&0xFF) + ")", true
+			}
+		}
+		return fmt.Sprintf("MT(%s, %s)", mod, inner(k&0xFF)), true
+	}
+	return "", false
+}
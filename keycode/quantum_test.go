@@ -0,0 +1,148 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keycode
+
+import (
+	"errors"
+	"testing"
+)
+
+var quantumTests = []struct {
+	Input   string
+	Keycode Keycode
+	Name    string
+	Short   string
+}{
+	/* 0*/ {"LT(1, KC_SPC)", 0x412C, "LT(1, KC_SPACE)", "LT(1, KC_SPC)"},
+	/* 1*/ {"LT(15,KC_A)", 0x4F04, "LT(15, KC_A)", "LT(15, KC_A)"},
+	/* 2*/ {"MO(1)", 0x5101, "MO(1)", "MO(1)"},
+	/* 3*/ {"TO(3)", 0x5013, "TO(3)", "TO(3)"},
+	/* 4*/ {"DF(0)", 0x5200, "DF(0)", "DF(0)"},
+	/* 5*/ {"TG(31)", 0x531F, "TG(31)", "TG(31)"},
+	/* 6*/ {"OSL(2)", 0x5402, "OSL(2)", "OSL(2)"},
+	/* 7*/ {"TT(4)", 0x5804, "TT(4)", "TT(4)"},
+	/* 8*/ {"TD(7)", 0x5707, "TD(7)", "TD(7)"},
+	/* 9*/ {"OSM(MOD_LSFT)", 0x5502, "OSM(MOD_LSFT)", "OSM(MOD_LSFT)"},
+	/*10*/ {"OSM(MOD_RCTL | MOD_RALT)", 0x5515, "OSM(MOD_RCTL | MOD_RALT)", "OSM(MOD_RCTL | MOD_RALT)"},
+	/*11*/ {"LM(2, MOD_LCTL|MOD_LALT)", 0x5925, "LM(2, MOD_LCTL | MOD_LALT)", "LM(2, MOD_LCTL | MOD_LALT)"},
+	/*12*/ {"LCTL(KC_C)", 0x0106, "LCTL(KC_C)", "LCTL(KC_C)"},
+	/*13*/ {"C(S(KC_ESC))", 0x0329, "LCTL(LSFT(KC_ESCAPE))", "LCTL(LSFT(KC_ESC))"},
+	/*14*/ {"RALT(KC_E)", 0x1408, "RALT(KC_E)", "RALT(KC_E)"},
+	/*15*/ {"MEH(KC_F1)", 0x073A, "MEH(KC_F1)", "MEH(KC_F1)"},
+	/*16*/ {"KC_EXLM", 0x021E, "KC_EXCLAIM", "KC_EXLM"},
+	/*17*/ {"LSFT(KC_SLASH)", 0x0238, "KC_QUESTION", "KC_QUES"},
+	/*18*/ {"LCTL_T(KC_A)", 0x6104, "LCTL_T(KC_A)", "LCTL_T(KC_A)"},
+	/*19*/ {"MT(MOD_LCTL | MOD_LSFT, KC_ENT)", 0x6328, "MT(MOD_LCTL | MOD_LSFT, KC_ENTER)", "MT(MOD_LCTL | MOD_LSFT, KC_ENT)"},
+	/*20*/ {"ALL_T(KC_NO)", 0x6F00, "HYPR_T(KC_NO)", "HYPR_T(KC_NO)"},
+	/*21*/ {"_______", KC_TRANSPARENT, "KC_TRANSPARENT", "KC_TRNS"},
+	/*22*/ {"XXXXXXX", KC_NO, "KC_NO", "KC_NO"},
+}
+
+func TestQuantumKeycodes(t *testing.T) {
+	for i, test := range quantumTests {
+		keycode, err := KeycodeFromString(test.Input)
+		if err != nil {
+			t.Errorf("[%v] (%v) %v", i, test.Input, err)
+			continue
+		}
+		if keycode != test.Keycode {
+			t.Errorf("[%v] (%v) wanted keycode 0x%04x, got 0x%04x", i, test.Input, uint16(test.Keycode), uint16(keycode))
+		}
+		if name := keycode.Name(); name != test.Name {
+			t.Errorf("[%v] (%v) wanted keycode name %v, got %v", i, test.Input, test.Name, name)
+		}
+		if short := keycode.ShortName(); short != test.Short {
+			t.Errorf("[%v] (%v) wanted short name %v, got %v", i, test.Input, test.Short, short)
+		}
+		for _, name := range []string{test.Name, test.Short} {
+			if parsed, err := KeycodeFromString(name); err != nil || parsed != keycode {
+				t.Errorf("[%v] (%v) wanted %v to parse back, got 0x%04x (%v)", i, test.Input, name, uint16(parsed), err)
+			}
+		}
+	}
+}
+
+func TestParseKeycodeLayers(t *testing.T) {
+	layers := map[string]uint8{"_BASE": 0, "_NAV": 2}
+	keycode, err := ParseKeycode("LT(_NAV, KC_SPC)", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keycode != 0x422C {
+		t.Errorf("wanted keycode 0x422c, got 0x%04x", uint16(keycode))
+	}
+	if _, err := KeycodeFromString("MO(_NAV)"); !errors.Is(err, ErrorBadArgument) {
+		t.Errorf("wanted error %v without layer names, got %v", ErrorBadArgument, err)
+	}
+}
+
+func TestQuantumErrors(t *testing.T) {
+	errorTests := []struct {
+		Input string
+		Err   error
+	}{
+		{"LT(16, KC_A)", ErrorBadArgument},
+		{"LT(1, MO(1))", ErrorBadArgument},
+		{"LT(1)", ErrorBadArgument},
+		{"MO(32)", ErrorBadArgument},
+		{"TO(16)", ErrorBadArgument},
+		{"LM(1, MOD_RCTL)", ErrorBadArgument},
+		{"OSM(MOD_NOPE)", ErrorBadArgument},
+		{"MT(MOD_LCTL, KC_A, KC_B)", ErrorBadArgument},
+		{"LCTL(MO(1))", ErrorBadArgument},
+		{"LT(1, KC_NOPE)", ErrorUnknownKeycode},
+		{"NOPE(1)", ErrorUnknownKeycode},
+		{"MO(1", ErrorUnknownKeycode},
+		{"MO(1))", ErrorUnknownKeycode},
+		{"MO()", ErrorBadArgument},
+	}
+	for i, test := range errorTests {
+		if _, err := KeycodeFromString(test.Input); !errors.Is(err, test.Err) {
+			t.Errorf("[%v] (%v) wanted error %v, got %v", i, test.Input, test.Err, err)
+		}
+	}
+}
+
+func TestFormatKeycode(t *testing.T) {
+	layers := []string{"_BASE", "_NAV"}
+	formatTests := []struct {
+		Keycode Keycode
+		Name    string
+		Short   string
+	}{
+		/* 0*/ {MACRO00, "QK_MACRO_0", "QK_MACRO_0"},
+		/* 1*/ {MACRO15, "QK_MACRO_15", "QK_MACRO_15"},
+		/* 2*/ {USER07, "QK_KB_7", "QK_KB_7"},
+		/* 3*/ {FN_MO13, "QK_TRI_LAYER_LOWER", "QK_TRI_LAYER_LOWER"},
+		/* 4*/ {FN_MO23, "QK_TRI_LAYER_UPPER", "QK_TRI_LAYER_UPPER"},
+		/* 5*/ {0x5101, "MO(_NAV)", "MO(_NAV)"},
+		/* 6*/ {0x412C, "LT(_NAV, KC_SPACE)", "LT(_NAV, KC_SPC)"},
+		/* 7*/ {0x5010, "TO(_BASE)", "TO(_BASE)"},
+		/* 8*/ {0x5902, "LM(_BASE, MOD_LSFT)", "LM(_BASE, MOD_LSFT)"},
+		/* 9*/ {0x5802, "TT(2)", "TT(2)"},
+		/*10*/ {KC_ESCAPE, "KC_ESCAPE", "KC_ESC"},
+	}
+	names := map[string]uint8{"_BASE": 0, "_NAV": 1}
+	for i, test := range formatTests {
+		if name := FormatKeycode(test.Keycode, layers, false); name != test.Name {
+			t.Errorf("[%v] wanted name %v, got %v", i, test.Name, name)
+		}
+		if short := FormatKeycode(test.Keycode, layers, true); short != test.Short {
+			t.Errorf("[%v] wanted short name %v, got %v", i, test.Short, short)
+		}
+		for _, name := range []string{test.Name, test.Short} {
+			if parsed, err := ParseKeycode(name, names); err != nil || parsed != test.Keycode {
+				t.Errorf("[%v] wanted %v to parse back, got 0x%04x (%v)", i, name, uint16(parsed), err)
+			}
+		}
+	}
+	for _, name := range []string{"QK_MACRO_16", "QK_KB_01", "QK_KB_"} {
+		if _, err := KeycodeFromString(name); !errors.Is(err, ErrorUnknownKeycode) {
+			t.Errorf("(%v) wanted error %v, got %v", name, ErrorUnknownKeycode, err)
+		}
+	}
+}
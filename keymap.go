@@ -0,0 +1,129 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/keymap"
+)
+
+var (
+	ErrorKeymapTooLarge = errors.New("keymap is larger than the dynamic keymap buffer can address")
+	ErrorKeymapVerify   = errors.New("keymap read back does not match what was written")
+)
+
+// Progress reports the bytes transferred so far, out of the total, during a
+// bulk transfer
+type Progress func(done int, total int)
+
+func (c *client) ReadKeymap(rows uint8, cols uint8, progress Progress) (keymap.Keymap, error) {
+	layers, err := c.GetDynamicKeymapLayerCount()
+	if err != nil {
+		return nil, err
+	}
+	size := keymap.Size(int(layers), int(rows), int(cols))
+	if size > math.MaxUint16+1 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrorKeymapTooLarge, size)
+	}
+
+	data, err := c.readKeymapBuffer(size, progress)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := keymap.FromBytes(data, int(layers), int(rows), int(cols))
+	if err != nil {
+		return nil, err
+	}
+	return raw.Map(c.protocol.keycodes.decode), nil
+}
+
+// readKeymapBuffer reads size bytes of the dynamic keymap in buffer sized
+// chunks. Keycodes split across chunks are rejoined by the caller decoding
+// the whole buffer at once.
+func (c *client) readKeymapBuffer(size int, progress Progress) ([]byte, error) {
+	data := make([]byte, size)
+	for offset := 0; offset < size; offset += MaxDynamicKeymapBufferSize {
+		chunk := size - offset
+		if chunk > MaxDynamicKeymapBufferSize {
+			chunk = MaxDynamicKeymapBufferSize
+		}
+		buffer, err := c.GetDynamicKeymapBuffer(uint16(offset), uint8(chunk))
+		if err != nil {
+			return nil, err
+		}
+		copy(data[offset:offset+chunk], buffer)
+		if progress != nil {
+			progress(offset+chunk, size)
+		}
+	}
+	return data, nil
+}
+
+// WriteKeymap writes only the keycodes which differ from the keyboard's
+// current keymap, then reads them back to verify them. The desired keymap must
+// have the keyboard's matrix size, but may cover fewer layers than it has.
+// Progress reports the bytes written.
+func (c *client) WriteKeymap(desired keymap.Keymap, progress Progress) error {
+	if err := desired.Validate(); err != nil {
+		return err
+	}
+	layers, err := c.GetDynamicKeymapLayerCount()
+	if err != nil {
+		return err
+	}
+	if desired.Layers() > int(layers) {
+		return fmt.Errorf("%w: keymap has %d layers, keyboard has %d", keymap.ErrorBadDimensions, desired.Layers(), layers)
+	}
+	rows, cols := desired.Rows(), desired.Cols()
+	size := keymap.Size(desired.Layers(), rows, cols)
+	if size > math.MaxUint16+1 {
+		return fmt.Errorf("%w: %d bytes", ErrorKeymapTooLarge, size)
+	}
+
+	current, err := c.readKeymapBuffer(size, nil)
+	if err != nil {
+		return err
+	}
+	chunks := keymap.Diff(current, desired.Map(c.protocol.keycodes.encode).Bytes(), MaxDynamicKeymapBufferSize)
+
+	total := 0
+	for _, chunk := range chunks {
+		total += len(chunk.Data)
+	}
+	done := 0
+	for _, chunk := range chunks {
+		if err := c.SetDynamicKeymapBuffer(uint16(chunk.Offset), uint8(len(chunk.Data)), chunk.Data); err != nil {
+			return err
+		}
+		done += len(chunk.Data)
+		if progress != nil {
+			progress(done, total)
+		}
+	}
+
+	for _, chunk := range chunks {
+		buffer, err := c.GetDynamicKeymapBuffer(uint16(chunk.Offset), uint8(len(chunk.Data)))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(chunk.Data); i += 2 {
+			if buffer[i] == chunk.Data[i] && buffer[i+1] == chunk.Data[i+1] {
+				continue
+			}
+			index := (chunk.Offset + i) / 2
+			return fmt.Errorf("%w: layer %d row %d col %d: wrote 0x%04x, read 0x%04x", ErrorKeymapVerify,
+				index/(rows*cols), index/cols%rows, index%cols,
+				uint16(keycode.KeycodeFromBytes(chunk.Data[i], chunk.Data[i+1])),
+				uint16(keycode.KeycodeFromBytes(buffer[i], buffer[i+1])))
+		}
+	}
+	return nil
+}
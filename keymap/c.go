@@ -0,0 +1,145 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var ErrorBadLayerName = errors.New("layer name is not a C identifier")
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// COptions configures WriteC
+type COptions struct {
+	// Names for the layer enum, in layer order. Missing names default to _BASE
+	// for layer 0 and _LAYER<n> after it.
+	LayerNames []string
+	// Write short keycode aliases, with _______ for KC_TRNS and XXXXXXX for
+	// KC_NO
+	Short bool
+}
+
+// layerName is the enum name of a layer
+func (o COptions) layerName(layer int) string {
+	switch {
+	case layer < len(o.LayerNames) && o.LayerNames[layer] != "":
+		return o.LayerNames[layer]
+	case layer == 0:
+		return "_BASE"
+	default:
+		return fmt.Sprintf("_LAYER%d", layer)
+	}
+}
+
+// keycodeName is a keycode as written in the keymaps array, in QMK 0.19's
+// vocabulary and with layer arguments named by the layer enum
+func (o COptions) keycodeName(code keycode.Keycode, layers []string) string {
+	if o.Short {
+		switch code {
+		case keycode.KC_TRANSPARENT:
+			return "_______"
+		case keycode.KC_NO:
+			return "XXXXXXX"
+		}
+	}
+	return keycode.FormatKeycode(code, layers, o.Short)
+}
+
+// WriteC writes a QMK 0.19 or later keymap.c with a layer enum and a keymaps
+// array calling the layout's LAYOUT macro. Layer keycodes refer to the enum,
+// as in MO(_LAYER1). A new line of arguments starts wherever the layout
+// moves to another matrix row, and arguments are aligned in columns across all
+// layers. Matrix positions the layout does not use are not written.
+func WriteC(w io.Writer, k Keymap, layout Layout, options COptions) error {
+	if err := layout.Validate(); err != nil {
+		return err
+	}
+	if err := layout.checkMacroOrder(); err != nil {
+		return err
+	}
+	if k.Rows() != layout.Rows || k.Cols() != layout.Cols {
+		return fmt.Errorf("%w: keymap is %dx%d, %s is %dx%d", ErrorBadDimensions, k.Rows(), k.Cols(), layout.Name, layout.Rows, layout.Cols)
+	}
+	macro := layout.Name
+	if macro == "" {
+		macro = "LAYOUT"
+	}
+
+	names := make([]string, k.Layers())
+	seen := map[string]int{}
+	for layer := range names {
+		names[layer] = options.layerName(layer)
+		if !identifier.MatchString(names[layer]) {
+			return fmt.Errorf("%w: %q", ErrorBadLayerName, names[layer])
+		}
+		if first, ok := seen[names[layer]]; ok {
+			return fmt.Errorf("%w: layers %d and %d are both %s", ErrorBadLayerName, first, layer, names[layer])
+		}
+		seen[names[layer]] = layer
+	}
+
+	// Split the LAYOUT arguments into lines, and size each column. The last
+	// argument of a line is not padded, so does not widen its column.
+	var lines [][]Position
+	for i, key := range layout.Keys {
+		if i == 0 || key.Row != layout.Keys[i-1].Row {
+			lines = append(lines, nil)
+		}
+		lines[len(lines)-1] = append(lines[len(lines)-1], key)
+	}
+	var widths []int
+	for layer := range k {
+		for _, line := range lines {
+			for i, key := range line[:len(line)-1] {
+				if i >= len(widths) {
+					widths = append(widths, 0)
+				}
+				if n := len(options.keycodeName(k[layer][key.Row][key.Col], names)); n > widths[i] {
+					widths[i] = n
+				}
+			}
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#include QMK_KEYBOARD_H\n\n")
+	fmt.Fprintf(b, "enum layers {\n")
+	for _, name := range names {
+		fmt.Fprintf(b, "    %s,\n", name)
+	}
+	fmt.Fprintf(b, "};\n\n")
+	fmt.Fprintf(b, "const uint16_t PROGMEM keymaps[][MATRIX_ROWS][MATRIX_COLS] = {\n")
+	for layer := range k {
+		fmt.Fprintf(b, "    [%s] = %s(\n", names[layer], macro)
+		for l, line := range lines {
+			var row strings.Builder
+			for i, key := range line {
+				cell := options.keycodeName(k[layer][key.Row][key.Col], names)
+				if l < len(lines)-1 || i < len(line)-1 {
+					cell += ","
+				}
+				if i < len(line)-1 {
+					// Pad to the column width, plus the comma and a space
+					cell += strings.Repeat(" ", widths[i]+2-len(cell))
+				}
+				row.WriteString(cell)
+			}
+			fmt.Fprintf(b, "        %s\n", row.String())
+		}
+		fmt.Fprintf(b, "    ),\n")
+	}
+	fmt.Fprintf(b, "};\n")
+	return b.Flush()
+}
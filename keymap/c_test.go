@@ -0,0 +1,125 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var testCKeymap = Keymap{
+	{{keycode.KC_ESCAPE, keycode.KC_A, keycode.KC_B}, {keycode.KC_SPACE, keycode.KC_NO, keycode.KC_ENTER}},
+	{{keycode.KC_TRANSPARENT, 0x5101, keycode.KC_NO}, {keycode.KC_TRANSPARENT, keycode.KC_NO, keycode.KC_LEFT_GUI}},
+}
+
+func TestWriteC(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteC(&out, testCKeymap, testLayout, COptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := `#include QMK_KEYBOARD_H
+
+enum layers {
+    _BASE,
+    _LAYER1,
+};
+
+const uint16_t PROGMEM keymaps[][MATRIX_ROWS][MATRIX_COLS] = {
+    [_BASE] = LAYOUT_test(
+        KC_ESCAPE,      KC_A,        KC_B,
+        KC_ENTER,       KC_SPACE
+    ),
+    [_LAYER1] = LAYOUT_test(
+        KC_TRANSPARENT, MO(_LAYER1), KC_NO,
+        KC_LEFT_GUI,    KC_TRANSPARENT
+    ),
+};
+`
+	if out.String() != want {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, out.String())
+	}
+}
+
+func TestWriteCShort(t *testing.T) {
+	var out bytes.Buffer
+	options := COptions{LayerNames: []string{"_QWERTY", "_FN"}, Short: true}
+	if err := WriteC(&out, testCKeymap, testLayout, options); err != nil {
+		t.Fatal(err)
+	}
+	want := `#include QMK_KEYBOARD_H
+
+enum layers {
+    _QWERTY,
+    _FN,
+};
+
+const uint16_t PROGMEM keymaps[][MATRIX_ROWS][MATRIX_COLS] = {
+    [_QWERTY] = LAYOUT_test(
+        KC_ESC,  KC_A,    KC_B,
+        KC_ENT,  KC_SPC
+    ),
+    [_FN] = LAYOUT_test(
+        _______, MO(_FN), XXXXXXX,
+        KC_LGUI, _______
+    ),
+};
+`
+	if out.String() != want {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, out.String())
+	}
+}
+
+func TestWriteCNames(t *testing.T) {
+	k := Keymap{
+		{{keycode.MACRO00, keycode.USER03, keycode.FN_MO13}, {keycode.FN_MO23, keycode.KC_NO, 0x4204}},
+		{{keycode.MACRO15, 0x5410, 0x5901}, {0x5300, keycode.KC_NO, keycode.KC_TRANSPARENT}},
+		{{keycode.KC_NO, keycode.KC_NO, keycode.KC_NO}, {keycode.KC_NO, keycode.KC_NO, keycode.KC_NO}},
+	}
+	var out bytes.Buffer
+	if err := WriteC(&out, k, testLayout, COptions{LayerNames: []string{"", "_NAV"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := `    [_BASE] = LAYOUT_test(
+        QK_MACRO_0,        QK_KB_3, QK_TRI_LAYER_LOWER,
+        LT(_LAYER2, KC_A), QK_TRI_LAYER_UPPER
+    ),
+    [_NAV] = LAYOUT_test(
+        QK_MACRO_15,       OSL(16), LM(_BASE, MOD_LCTL),
+        KC_TRANSPARENT,    TG(_BASE)
+    ),
+`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, out.String())
+	}
+
+	keymap, err := ReadC(&out, testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for layer := range k {
+		k[layer][1][1] = keycode.KC_NO
+	}
+	if !keymap.Equal(k) {
+		t.Errorf("wanted keymap %v after round trip, got %v", k, keymap)
+	}
+}
+
+func TestWriteCErrors(t *testing.T) {
+	var out bytes.Buffer
+	if err := WriteC(&out, New(1, 3, 3), testLayout, COptions{}); !errors.Is(err, ErrorBadDimensions) {
+		t.Errorf("wanted error %v, got %v", ErrorBadDimensions, err)
+	}
+	for _, names := range [][]string{{"1ST"}, {"_A", "_A"}, {"_BASE", "with space"}} {
+		if err := WriteC(&out, testCKeymap, testLayout, COptions{LayerNames: names}); !errors.Is(err, ErrorBadLayerName) {
+			t.Errorf("(%v) wanted error %v, got %v", names, ErrorBadLayerName, err)
+		}
+	}
+}
@@ -0,0 +1,494 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var ErrorBadC = errors.New("unsupported keymap.c syntax")
+
+// CError locates a problem in keymap.c source
+type CError struct {
+	// 1 based line and byte column
+	Line int
+	Col  int
+	Err  error
+}
+
+func (e *CError) Error() string {
+	return fmt.Sprintf("%d:%d: %v", e.Line, e.Col, e.Err)
+}
+
+func (e *CError) Unwrap() error {
+	return e.Err
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenPunct
+	// A #define NAME VALUE line, with the name in text and the value in value
+	tokenDefine
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value string
+	line  int
+	col   int
+}
+
+func (t token) is(punct string) bool {
+	return t.kind == tokenPunct && t.text == punct
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of file"
+	}
+	return strconv.Quote(t.text)
+}
+
+// lexer splits C source into identifiers, numbers and punctuation, skipping
+// comments, strings and preprocessor lines other than simple #defines
+type lexer struct {
+	src  string
+	pos  int
+	line int
+	col  int
+}
+
+func (l *lexer) errorf(line int, col int, format string, args ...interface{}) error {
+	return &CError{Line: line, Col: col, Err: fmt.Errorf("%w: "+format, append([]interface{}{ErrorBadC}, args...)...)}
+}
+
+func (l *lexer) peek(offset int) byte {
+	if l.pos+offset >= len(l.src) {
+		return 0
+	}
+	return l.src[l.pos+offset]
+}
+
+func (l *lexer) advance(n int) {
+	for i := 0; i < n && l.pos < len(l.src); i++ {
+		if l.src[l.pos] == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+		l.pos++
+	}
+}
+
+// skipSpace skips whitespace and comments, reporting whether a newline (or
+// the start of the file) was passed
+func (l *lexer) skipSpace() (bool, error) {
+	newline := l.pos == 0
+	for l.pos < len(l.src) {
+		switch c := l.peek(0); {
+		case c == '\n':
+			newline = true
+			l.advance(1)
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			l.advance(1)
+		case c == '\\' && l.peek(1) == '\n':
+			l.advance(2)
+		case c == '/' && l.peek(1) == '/':
+			for l.pos < len(l.src) && l.peek(0) != '\n' {
+				l.advance(1)
+			}
+		case c == '/' && l.peek(1) == '*':
+			line, col := l.line, l.col
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return false, l.errorf(line, col, "unterminated comment")
+			}
+			l.advance(end + 4)
+		default:
+			return newline, nil
+		}
+	}
+	return newline, nil
+}
+
+// directive reads a preprocessor line, returning the name and value of a
+// #define without arguments
+func (l *lexer) directive() (string, string) {
+	start := l.pos
+	for l.pos < len(l.src) && l.peek(0) != '\n' {
+		if l.peek(0) == '\\' && l.peek(1) == '\n' {
+			l.advance(2)
+			continue
+		}
+		l.advance(1)
+	}
+	text := strings.ReplaceAll(l.src[start:l.pos], "\\\n", " ")
+	if i := strings.Index(text, "//"); i >= 0 {
+		text = text[:i]
+	}
+	fields := strings.Fields(text[1:])
+	if len(fields) < 2 || fields[0] != "define" || strings.Contains(fields[1], "(") {
+		return "", ""
+	}
+	return fields[1], strings.Join(fields[2:], " ")
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func (l *lexer) next() (token, error) {
+	for {
+		newline, err := l.skipSpace()
+		if err != nil {
+			return token{}, err
+		}
+		t := token{line: l.line, col: l.col}
+		if l.pos >= len(l.src) {
+			return t, nil
+		}
+		c := l.peek(0)
+		switch {
+		case c == '#' && newline:
+			name, value := l.directive()
+			if name == "" {
+				continue
+			}
+			t.kind, t.text, t.value = tokenDefine, name, value
+			return t, nil
+		case c == '"' || c == '\'':
+			for l.advance(1); l.pos < len(l.src) && l.peek(0) != c; l.advance(1) {
+				if l.peek(0) == '\\' {
+					l.advance(1)
+				}
+				if l.peek(0) == '\n' {
+					return t, l.errorf(t.line, t.col, "unterminated literal")
+				}
+			}
+			if l.pos >= len(l.src) {
+				return t, l.errorf(t.line, t.col, "unterminated literal")
+			}
+			l.advance(1)
+			continue
+		case isIdentStart(c) || (c >= '0' && c <= '9'):
+			start := l.pos
+			for l.pos < len(l.src) && isIdent(l.peek(0)) {
+				l.advance(1)
+			}
+			t.kind, t.text = tokenIdent, l.src[start:l.pos]
+			if !isIdentStart(c) {
+				t.kind = tokenNumber
+			}
+			return t, nil
+		default:
+			t.kind, t.text = tokenPunct, string(c)
+			l.advance(1)
+			return t, nil
+		}
+	}
+}
+
+// cParser reads the layer names and keymaps array of a keymap.c
+type cParser struct {
+	lexer  *lexer
+	tokens []token
+	pos    int
+	layout Layout
+	// Layer names from enums and #defines
+	layers map[string]uint8
+	keymap Keymap
+	// Layers already parsed
+	defined map[int]bool
+}
+
+func (p *cParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *cParser) take() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *cParser) errorf(t token, format string, args ...interface{}) error {
+	return p.lexer.errorf(t.line, t.col, format, args...)
+}
+
+func (p *cParser) expect(punct string) (token, error) {
+	t := p.take()
+	if !t.is(punct) {
+		return t, p.errorf(t, "expected %q, got %s", punct, t)
+	}
+	return t, nil
+}
+
+// number parses an integer literal, or a layer name
+func (p *cParser) number(text string) (int, bool) {
+	if text != "" && text[0] >= '0' && text[0] <= '9' {
+		n, err := strconv.ParseInt(strings.TrimRight(text, "uUlL"), 0, 32)
+		return int(n), err == nil
+	}
+	if n, ok := p.layers[text]; ok {
+		return int(n), true
+	}
+	return 0, false
+}
+
+// collectLayers records #define NAME <int> and enum members with known
+// values as layer names. Enum members after one with an unknown value, such
+// as SAFE_RANGE, are left out.
+func (p *cParser) collectLayers() {
+	for i := 0; i < len(p.tokens); i++ {
+		t := p.tokens[i]
+		if t.kind == tokenDefine {
+			if n, ok := p.number(t.value); ok && n >= 0 && n <= 0xFF {
+				p.layers[t.text] = uint8(n)
+			}
+			continue
+		}
+		if t.kind != tokenIdent || t.text != "enum" {
+			continue
+		}
+		// enum [name] {
+		j := i + 1
+		if j < len(p.tokens) && p.tokens[j].kind == tokenIdent {
+			j++
+		}
+		if j >= len(p.tokens) || !p.tokens[j].is("{") {
+			continue
+		}
+		value, known := 0, true
+		for j++; j < len(p.tokens) && !p.tokens[j].is("}") && p.tokens[j].kind != tokenEOF; {
+			name := p.tokens[j]
+			j++
+			if j < len(p.tokens) && p.tokens[j].is("=") {
+				j++
+				var expression []string
+				for ; j < len(p.tokens) && !p.tokens[j].is(",") && !p.tokens[j].is("}") && p.tokens[j].kind != tokenEOF; j++ {
+					expression = append(expression, p.tokens[j].text)
+				}
+				value, known = p.number(strings.Join(expression, ""))
+			}
+			if known && name.kind == tokenIdent && value >= 0 && value <= 0xFF {
+				p.layers[name.text] = uint8(value)
+			}
+			value++
+			if j < len(p.tokens) && p.tokens[j].is(",") {
+				j++
+			}
+		}
+		i = j
+	}
+}
+
+// findKeymaps moves to the { opening the keymaps array initializer
+func (p *cParser) findKeymaps() error {
+	for ; p.peek().kind != tokenEOF; p.pos++ {
+		if t := p.peek(); t.kind != tokenIdent || t.text != "keymaps" {
+			continue
+		}
+		// Skip the array dimensions to the initializer
+		for p.take(); !p.peek().is("=") && !p.peek().is(";"); p.take() {
+			if p.peek().kind == tokenEOF {
+				return p.errorf(p.peek(), "expected keymaps initializer")
+			}
+		}
+		if p.take().is(";") {
+			continue
+		}
+		_, err := p.expect("{")
+		return err
+	}
+	return p.errorf(p.peek(), "no keymaps array")
+}
+
+// argument collects the tokens of a LAYOUT argument up to a top level , or )
+func (p *cParser) argument() (string, token, error) {
+	var (
+		text  strings.Builder
+		depth int
+		start = p.peek()
+	)
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokenEOF:
+			return "", t, p.errorf(t, "unterminated LAYOUT arguments")
+		case depth == 0 && (t.is(",") || t.is(")")):
+			if text.Len() == 0 {
+				return "", t, p.errorf(t, "empty LAYOUT argument")
+			}
+			return text.String(), start, nil
+		case t.is("("):
+			depth++
+		case t.is(")"):
+			depth--
+		}
+		if t.is(",") {
+			text.WriteString(", ")
+		} else {
+			text.WriteString(t.text)
+		}
+		p.take()
+	}
+}
+
+// layer parses a [designator] = LAYOUT(...) entry, returning the next
+// layer's index
+func (p *cParser) layer(index int) (int, error) {
+	if p.peek().is("[") {
+		p.take()
+		t := p.take()
+		n, ok := p.number(t.text)
+		if (t.kind != tokenIdent && t.kind != tokenNumber) || !ok {
+			return 0, p.errorf(t, "unknown layer %s", t)
+		}
+		if n < 0 || n > 0xFF {
+			return 0, p.errorf(t, "layer %d out of range", n)
+		}
+		index = n
+		if _, err := p.expect("]"); err != nil {
+			return 0, err
+		}
+		if _, err := p.expect("="); err != nil {
+			return 0, err
+		}
+	}
+
+	macro := p.take()
+	if macro.kind != tokenIdent || !strings.HasPrefix(macro.text, "LAYOUT") {
+		return 0, p.errorf(macro, "expected a LAYOUT macro, got %s", macro)
+	}
+	if macro.text != "LAYOUT" && p.layout.Name != "" && macro.text != p.layout.Name {
+		return 0, p.errorf(macro, "%s does not match layout %s", macro.text, p.layout.Name)
+	}
+	if _, err := p.expect("("); err != nil {
+		return 0, err
+	}
+	if p.defined[index] {
+		return 0, p.errorf(macro, "layer %d is defined twice", index)
+	}
+	p.defined[index] = true
+	for index >= len(p.keymap) {
+		p.keymap = append(p.keymap, New(1, p.layout.Rows, p.layout.Cols)[0])
+	}
+
+	keys := 0
+	for !p.peek().is(")") {
+		if keys > 0 {
+			if _, err := p.expect(","); err != nil {
+				return 0, err
+			}
+			// A trailing comma before the )
+			if p.peek().is(")") {
+				break
+			}
+		}
+		value, start, err := p.argument()
+		if err != nil {
+			return 0, err
+		}
+		if keys >= len(p.layout.Keys) {
+			return 0, p.errorf(start, "%s has %d keys, got more", macro.text, len(p.layout.Keys))
+		}
+		code, err := keycode.ParseKeycode(value, p.layers)
+		if err != nil {
+			return 0, &CError{Line: start.line, Col: start.col, Err: &KeyError{Layer: index, Index: keys, Value: value, Err: err}}
+		}
+		position := p.layout.Keys[keys]
+		p.keymap[index][position.Row][position.Col] = code
+		keys++
+	}
+	p.take()
+	if keys != len(p.layout.Keys) {
+		return 0, p.errorf(macro, "%s has %d keys, got %d", macro.text, len(p.layout.Keys), keys)
+	}
+	return index + 1, nil
+}
+
+// ReadC parses the keymaps array of a QMK keymap.c, placing each LAYOUT
+// argument at its matrix position in layout. The LAYOUT macro must be the
+// layout's, or plain LAYOUT. Layers may be designated by number or by an enum
+// or #define name, and keycodes are parsed with keycode.ParseKeycode. Layers
+// the array skips are left as KC_NO. Errors are *CError, locating the problem
+// in the source.
+func ReadC(r io.Reader, layout Layout) (Keymap, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	if err := layout.checkMacroOrder(); err != nil {
+		return nil, err
+	}
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &cParser{
+		lexer:   &lexer{src: string(src), line: 1, col: 1},
+		layout:  layout,
+		layers:  map[string]uint8{},
+		defined: map[int]bool{},
+	}
+	for {
+		t, err := p.lexer.next()
+		if err != nil {
+			return nil, err
+		}
+		p.tokens = append(p.tokens, t)
+		if t.kind == tokenEOF {
+			break
+		}
+	}
+	p.collectLayers()
+
+	// Only the layer names need #defines
+	tokens := p.tokens[:0]
+	for _, t := range p.tokens {
+		if t.kind != tokenDefine {
+			tokens = append(tokens, t)
+		}
+	}
+	p.tokens = tokens
+
+	if err := p.findKeymaps(); err != nil {
+		return nil, err
+	}
+	index := 0
+	for !p.peek().is("}") {
+		if index, err = p.layer(index); err != nil {
+			return nil, err
+		}
+		if !p.peek().is("}") {
+			if _, err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(p.keymap) == 0 {
+		return nil, p.errorf(p.peek(), "keymaps array is empty")
+	}
+	return p.keymap, nil
+}
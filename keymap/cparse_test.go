@@ -0,0 +1,126 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+const testC = `// Copyright 2022
+#include QMK_KEYBOARD_H
+#include "keymap_us.h"
+
+#define _FN 2
+
+enum layers {
+    _BASE,
+    _NAV,
+};
+
+enum custom_keycodes {
+    QWERTY = SAFE_RANGE,
+    LOWER,
+};
+
+/* Base layer
+ * ,---------.
+ */
+const uint16_t PROGMEM keymaps[][MATRIX_ROWS][MATRIX_COLS] = {
+    [_BASE] = LAYOUT_test(
+        KC_ESC,  LT(_NAV, KC_A), MT(MOD_LCTL | MOD_LSFT, KC_B),
+        KC_ENT,  KC_SPC
+    ),
+    [_FN] = LAYOUT(
+        _______, LCTL(KC_C), XXXXXXX,
+        MO(_FN), KC_EXLM, // trailing comma
+    ),
+    [_NAV] = LAYOUT_test(KC_TRNS, KC_LEFT, KC_RGHT, TO(0), OSM(MOD_LSFT))
+};
+
+bool process_record_user(uint16_t keycode, keyrecord_t *record) {
+    return true;
+}
+`
+
+func TestReadC(t *testing.T) {
+	keymap, err := ReadC(strings.NewReader(testC), testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Keymap{
+		{{keycode.KC_ESCAPE, 0x4104, 0x6305}, {keycode.KC_SPACE, keycode.KC_NO, keycode.KC_ENTER}},
+		{{keycode.KC_TRANSPARENT, keycode.KC_LEFT, keycode.KC_RIGHT}, {0x5502, keycode.KC_NO, 0x5010}},
+		{{keycode.KC_TRANSPARENT, 0x0106, keycode.KC_NO}, {0x021E, keycode.KC_NO, 0x5102}},
+	}
+	if !keymap.Equal(want) {
+		t.Errorf("wanted keymap %v, got %v", want, keymap)
+	}
+}
+
+func TestReadCRoundTrip(t *testing.T) {
+	for _, short := range []bool{false, true} {
+		var out bytes.Buffer
+		if err := WriteC(&out, testCKeymap, testLayout, COptions{Short: short}); err != nil {
+			t.Fatal(err)
+		}
+		keymap, err := ReadC(&out, testLayout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// WriteC leaves out the unused matrix position
+		want := testCKeymap.Clone()
+		for layer := range want {
+			want[layer][1][1] = keycode.KC_NO
+		}
+		if !keymap.Equal(want) {
+			t.Errorf("(short %v) wanted keymap %v, got %v", short, want, keymap)
+		}
+	}
+}
+
+func TestReadCErrors(t *testing.T) {
+	errorTests := []struct {
+		Source string
+		Line   int
+		Col    int
+		Err    error
+	}{
+		/* 0*/ {"int x;", 1, 7, ErrorBadC},
+		/* 1*/ {"keymaps[] = {\n  [0] = LAYOUT(KC_A, KC_B, KC_C, KC_D, KC_NOPE)\n};", 2, 40, keycode.ErrorUnknownKeycode},
+		/* 2*/ {"keymaps[] = {\n  LAYOUT(KC_A, KC_B, KC_C, KC_D)\n};", 2, 3, ErrorBadC},
+		/* 3*/ {"keymaps[] = {\n  LAYOUT(KC_A, KC_B, KC_C, KC_D, KC_E, KC_F)\n};", 2, 40, ErrorBadC},
+		/* 4*/ {"keymaps[] = {\n  [_NOPE] = LAYOUT()\n};", 2, 4, ErrorBadC},
+		/* 5*/ {"keymaps[] = {\n  LAYOUT_other(KC_A)\n};", 2, 3, ErrorBadC},
+		/* 6*/ {"keymaps[] = {\n  [0] = LAYOUT(KC_A, KC_B, KC_C, KC_D, LT(_NOPE, KC_A))\n};", 2, 40, keycode.ErrorBadArgument},
+		/* 7*/ {"keymaps[] = {\n  [0] = LAYOUT(KC_A, KC_B, KC_C, KC_D, KC_E),\n  [0] = LAYOUT(KC_A, KC_B, KC_C, KC_D, KC_E)\n};", 3, 9, ErrorBadC},
+		/* 8*/ {"keymaps[] = {\n  [0] = LAYOUT(KC_A, KC_B, KC_C, KC_D, KC_E\n", 3, 1, ErrorBadC},
+		/* 9*/ {"/* unterminated", 1, 1, ErrorBadC},
+		/*10*/ {"keymaps[] = {\n  [0] = my_layout[1]\n};", 2, 9, ErrorBadC},
+	}
+	for i, test := range errorTests {
+		_, err := ReadC(strings.NewReader(test.Source), testLayout)
+		var cErr *CError
+		if !errors.As(err, &cErr) {
+			t.Errorf("[%d] wanted a CError, got %v", i, err)
+			continue
+		}
+		if cErr.Line != test.Line || cErr.Col != test.Col || !errors.Is(err, test.Err) {
+			t.Errorf("[%d] wanted %v at %d:%d, got %v", i, test.Err, test.Line, test.Col, err)
+		}
+	}
+
+	_, err := ReadC(strings.NewReader("keymaps[] = {\n  [1] = LAYOUT(KC_A, KC_B, KC_C, KC_D, KC_NOPE)\n};"), testLayout)
+	var keyErr *KeyError
+	if !errors.As(err, &keyErr) || keyErr.Layer != 1 || keyErr.Index != 4 || keyErr.Value != "KC_NOPE" {
+		t.Errorf("wanted KC_NOPE at layer 1 index 4, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var ErrorNoLayout = errors.New("keyboard has no such layout")
+
+// Info is the part of a QMK keyboard's info.json which describes its LAYOUT
+// macros. Unlike a VIA definition, it lists each layout's keys in macro
+// order.
+type Info struct {
+	KeyboardName string `json:"keyboard_name,omitempty"`
+	MatrixSize   *struct {
+		Rows int `json:"rows"`
+		Cols int `json:"cols"`
+	} `json:"matrix_size,omitempty"`
+	MatrixPins *struct {
+		Rows   []string    `json:"rows,omitempty"`
+		Cols   []string    `json:"cols,omitempty"`
+		Direct [][]*string `json:"direct,omitempty"`
+	} `json:"matrix_pins,omitempty"`
+	Layouts map[string]InfoLayout `json:"layouts"`
+	// Other macro names for layouts, such as LAYOUT for LAYOUT_ortho_4x12
+	LayoutAliases map[string]string `json:"layout_aliases,omitempty"`
+}
+
+// InfoLayout is one of an info.json's layouts
+type InfoLayout struct {
+	Layout []InfoKey `json:"layout"`
+}
+
+// InfoKey is a key of an info.json layout, as a LAYOUT macro argument
+type InfoKey struct {
+	Label string `json:"label,omitempty"`
+	// Switch matrix row and column
+	Matrix []int   `json:"matrix"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	W      float64 `json:"w,omitempty"`
+	H      float64 `json:"h,omitempty"`
+}
+
+// ReadInfo decodes a keyboard's info.json
+func ReadInfo(r io.Reader) (*Info, error) {
+	info := &Info{}
+	if err := json.NewDecoder(r).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// LayoutNames lists the layouts, without aliases, in order
+func (i *Info) LayoutNames() []string {
+	names := make([]string, 0, len(i.Layouts))
+	for name := range i.Layouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Layout returns the named layout, or the layout an alias names, with its
+// keys in macro order. The matrix size comes from matrix_size or
+// matrix_pins; info.json files with neither get the smallest matrix holding
+// every key, which may be smaller than the keyboard's.
+func (i *Info) Layout(name string) (Layout, error) {
+	layout, ok := i.Layouts[name]
+	if !ok {
+		if alias, aliased := i.LayoutAliases[name]; aliased {
+			layout, ok = i.Layouts[alias]
+		}
+	}
+	if !ok {
+		return Layout{}, fmt.Errorf("%w: %s", ErrorNoLayout, name)
+	}
+
+	l := Layout{Name: name, Keys: make([]Position, len(layout.Layout))}
+	for n, key := range layout.Layout {
+		if len(key.Matrix) != 2 {
+			return Layout{}, fmt.Errorf("%w: %s key %d has no matrix position", ErrorBadLayout, name, n)
+		}
+		l.Keys[n] = Position{Row: key.Matrix[0], Col: key.Matrix[1]}
+		if key.Matrix[0] >= l.Rows {
+			l.Rows = key.Matrix[0] + 1
+		}
+		if key.Matrix[1] >= l.Cols {
+			l.Cols = key.Matrix[1] + 1
+		}
+	}
+	switch {
+	case i.MatrixSize != nil:
+		l.Rows, l.Cols = i.MatrixSize.Rows, i.MatrixSize.Cols
+	case i.MatrixPins != nil && len(i.MatrixPins.Direct) > 0:
+		l.Rows, l.Cols = len(i.MatrixPins.Direct), len(i.MatrixPins.Direct[0])
+	case i.MatrixPins != nil && len(i.MatrixPins.Rows) > 0:
+		l.Rows, l.Cols = len(i.MatrixPins.Rows), len(i.MatrixPins.Cols)
+	}
+	if err := l.Validate(); err != nil {
+		return Layout{}, err
+	}
+	return l, nil
+}
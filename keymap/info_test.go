@@ -0,0 +1,97 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The testLayout keys, in a 2x3 matrix given by its pins
+const testInfo = `{
+  "keyboard_name": "Test",
+  "matrix_pins": {"rows": ["B0", "B1"], "cols": ["C0", "C1", "C2"]},
+  "layout_aliases": {"LAYOUT": "LAYOUT_test"},
+  "layouts": {
+    "LAYOUT_test": {
+      "layout": [
+        {"label": "Esc", "matrix": [0, 0], "x": 0, "y": 0},
+        {"matrix": [0, 1], "x": 1, "y": 0},
+        {"matrix": [0, 2], "x": 2, "y": 0},
+        {"matrix": [1, 2], "x": 2, "y": 1},
+        {"matrix": [1, 0], "x": 0, "y": 1, "w": 2}
+      ]
+    },
+    "LAYOUT_small": {
+      "layout": [{"matrix": [0, 1], "x": 0, "y": 0}]
+    }
+  }
+}`
+
+func TestInfoLayout(t *testing.T) {
+	info, err := ReadInfo(strings.NewReader(testInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := info.LayoutNames(); !reflect.DeepEqual(names, []string{"LAYOUT_small", "LAYOUT_test"}) {
+		t.Errorf("wanted LAYOUT_small and LAYOUT_test, got %v", names)
+	}
+
+	layout, err := info.Layout("LAYOUT_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(layout, testLayout) {
+		t.Errorf("wanted layout %+v, got %+v", testLayout, layout)
+	}
+	alias, err := info.Layout("LAYOUT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias.Name != "LAYOUT" || !reflect.DeepEqual(alias.Keys, testLayout.Keys) || alias.Order != MacroOrder {
+		t.Errorf("wanted LAYOUT with the LAYOUT_test keys in macro order, got %+v", alias)
+	}
+
+	if _, err := info.Layout("LAYOUT_nope"); !errors.Is(err, ErrorNoLayout) {
+		t.Errorf("wanted error %v, got %v", ErrorNoLayout, err)
+	}
+}
+
+func TestInfoMatrixSize(t *testing.T) {
+	tests := []struct {
+		Matrix string
+		Rows   int
+		Cols   int
+	}{
+		{``, 1, 2},
+		{`"matrix_size": {"rows": 4, "cols": 5},`, 4, 5},
+		{`"matrix_pins": {"direct": [["A0", null, "A2"]]},`, 1, 3},
+	}
+	for i, test := range tests {
+		info, err := ReadInfo(strings.NewReader(`{` + test.Matrix + `"layouts": {"LAYOUT": {"layout": [{"matrix": [0, 1]}]}}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layout, err := info.Layout("LAYOUT")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if layout.Rows != test.Rows || layout.Cols != test.Cols {
+			t.Errorf("[%d] wanted %dx%d, got %dx%d", i, test.Rows, test.Cols, layout.Rows, layout.Cols)
+		}
+	}
+
+	info, err := ReadInfo(strings.NewReader(`{"layouts": {"LAYOUT": {"layout": [{"x": 0, "y": 0}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := info.Layout("LAYOUT"); !errors.Is(err, ErrorBadLayout) {
+		t.Errorf("wanted error %v, got %v", ErrorBadLayout, err)
+	}
+}
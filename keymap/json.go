@@ -0,0 +1,151 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var ErrorLayoutMismatch = errors.New("layer does not match the layout")
+
+// KeyError locates a keycode which could not be converted
+type KeyError struct {
+	Layer int
+	// Position in the LAYOUT macro
+	Index int
+	// The keycode as written
+	Value string
+	Err   error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("layer %d index %d: %v %q", e.Layer, e.Index, e.Err, e.Value)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// JSON is a QMK keymap.json document
+type JSON struct {
+	Version       int        `json:"version,omitempty"`
+	Keyboard      string     `json:"keyboard"`
+	Keymap        string     `json:"keymap,omitempty"`
+	Layout        string     `json:"layout"`
+	Layers        [][]string `json:"layers"`
+	Author        string     `json:"author,omitempty"`
+	Notes         string     `json:"notes,omitempty"`
+	Documentation string     `json:"documentation,omitempty"`
+}
+
+// ReadJSON decodes a keymap.json document
+func ReadJSON(r io.Reader) (*JSON, error) {
+	doc := &JSON{}
+	if err := json.NewDecoder(r).Decode(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Write encodes the document as indented JSON
+func (j *JSON) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(j)
+}
+
+// ToKeymap places each layer's keycodes at their matrix positions. Matrix
+// positions the layout does not use are left as KC_NO. Keycodes may be
+// functional forms such as MO(1) or LT(1,KC_SPC), and may be wrapped in
+// ANY(), as QMK Configurator writes keycodes it has no button for. The
+// layout must be in macro order, as from Info.Layout.
+func (j *JSON) ToKeymap(layout Layout) (Keymap, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	if err := layout.checkMacroOrder(); err != nil {
+		return nil, err
+	}
+	keymap := New(len(j.Layers), layout.Rows, layout.Cols)
+	for layer, keys := range j.Layers {
+		if len(keys) != len(layout.Keys) {
+			return nil, fmt.Errorf("%w: layer %d has %d keys, %s has %d", ErrorLayoutMismatch, layer, len(keys), layout.Name, len(layout.Keys))
+		}
+		for i, value := range keys {
+			code, err := keycode.KeycodeFromString(unwrapAny(value))
+			if err != nil {
+				return nil, &KeyError{Layer: layer, Index: i, Value: value, Err: err}
+			}
+			position := layout.Keys[i]
+			keymap[layer][position.Row][position.Col] = code
+		}
+	}
+	return keymap, nil
+}
+
+// unwrapAny strips QMK Configurator's ANY() wrapper
+func unwrapAny(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "ANY(") && strings.HasSuffix(value, ")") {
+		return value[len("ANY(") : len(value)-1]
+	}
+	return value
+}
+
+// ToKeymapWithInfo is ToKeymap with the document's layout, by name, from a
+// keyboard's info.json
+func (j *JSON) ToKeymapWithInfo(info *Info) (Keymap, error) {
+	layout, err := info.Layout(j.Layout)
+	if err != nil {
+		return nil, err
+	}
+	return j.ToKeymap(layout)
+}
+
+// FromKeymap builds a keymap.json document from the layout's keys in each
+// layer, with QMK 0.19 keycode names as FormatKeycode writes them. Keycodes
+// without a name are written as hex literals.
+func FromKeymap(k Keymap, layout Layout, keyboard string) (*JSON, error) {
+	if err := layout.Validate(); err != nil {
+		return nil, err
+	}
+	if err := layout.checkMacroOrder(); err != nil {
+		return nil, err
+	}
+	if k.Rows() != layout.Rows || k.Cols() != layout.Cols {
+		return nil, fmt.Errorf("%w: keymap is %dx%d, %s is %dx%d", ErrorBadDimensions, k.Rows(), k.Cols(), layout.Name, layout.Rows, layout.Cols)
+	}
+	doc := &JSON{
+		Version:  1,
+		Keyboard: keyboard,
+		Layout:   layout.Name,
+		Layers:   make([][]string, k.Layers()),
+	}
+	for layer := range k {
+		doc.Layers[layer] = make([]string, len(layout.Keys))
+		for i, position := range layout.Keys {
+			doc.Layers[layer][i] = keycode.FormatKeycode(k[layer][position.Row][position.Col], nil, false)
+		}
+	}
+	return doc, nil
+}
+
+// FromKeymapWithInfo is FromKeymap with the named layout from a keyboard's
+// info.json
+func FromKeymapWithInfo(k Keymap, info *Info, layout string, keyboard string) (*JSON, error) {
+	l, err := info.Layout(layout)
+	if err != nil {
+		return nil, err
+	}
+	return FromKeymap(k, l, keyboard)
+}
@@ -0,0 +1,237 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+// A 2x3 matrix with a 5 key layout, leaving 1,1 unused
+var testLayout = Layout{
+	Name: "LAYOUT_test",
+	Rows: 2,
+	Cols: 3,
+	Keys: []Position{{0, 0}, {0, 1}, {0, 2}, {1, 2}, {1, 0}},
+}
+
+const testJSON = `{
+  "version": 1,
+  "keyboard": "test/rev1",
+  "keymap": "default",
+  "layout": "LAYOUT_test",
+  "layers": [
+    ["KC_ESC", "KC_A", "KC_B", "KC_ENT", "KC_SPC"],
+    ["KC_TRNS", "MO(1)", "KC_NO", "MACRO00", "KC_TRNS"]
+  ]
+}`
+
+func TestReadJSON(t *testing.T) {
+	doc, err := ReadJSON(strings.NewReader(testJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Keyboard != "test/rev1" || doc.Layout != "LAYOUT_test" || len(doc.Layers) != 2 {
+		t.Fatalf("wanted test/rev1 LAYOUT_test with 2 layers, got %+v", doc)
+	}
+
+	keymap, err := doc.ToKeymap(testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Keymap{
+		{{keycode.KC_ESCAPE, keycode.KC_A, keycode.KC_B}, {keycode.KC_SPACE, keycode.KC_NO, keycode.KC_ENTER}},
+		{{keycode.KC_TRANSPARENT, 0x5101, keycode.KC_NO}, {keycode.KC_TRANSPARENT, keycode.KC_NO, keycode.MACRO00}},
+	}
+	if !keymap.Equal(want) {
+		t.Errorf("wanted keymap %v, got %v", want, keymap)
+	}
+}
+
+// A 3x3 macropad keymap as exported by QMK Configurator, which writes
+// functional keycodes without spaces and wraps others in ANY()
+const configuratorJSON = `{
+  "version": 1,
+  "notes": "",
+  "documentation": "\"This file is a QMK Configurator export.\"\n",
+  "keyboard": "test/macropad",
+  "keymap": "test_macropad_layout_mine",
+  "layout": "LAYOUT_ortho_3x3",
+  "layers": [
+    [
+      "KC_7", "KC_8", "KC_9",
+      "LCTL_T(KC_ESC)", "LT(1,KC_SPC)", "OSM(MOD_LSFT)",
+      "MO(1)", "TG(2)", "ANY(C(KC_Z))"
+    ],
+    [
+      "KC_TRNS", "LSFT(KC_TAB)", "KC_EXLM",
+      "MT(MOD_LCTL|MOD_LALT,KC_DEL)", "KC_TRNS", "TT(2)",
+      "KC_TRNS", "TO(0)", "LM(2,MOD_LGUI)"
+    ],
+    [
+      "KC_NO", "DF(0)", "OSL(1)",
+      "LCS(KC_T)", "TD(3)", "KC_NO",
+      "KC_TRNS", "KC_TRNS", "ANY(0x7E00)"
+    ]
+  ],
+  "author": ""
+}`
+
+func TestConfiguratorJSON(t *testing.T) {
+	doc, err := ReadJSON(strings.NewReader(configuratorJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := Layout{Name: "LAYOUT_ortho_3x3", Rows: 3, Cols: 3}
+	for row := 0; row < 3; row++ {
+		for col := 0; col < 3; col++ {
+			layout.Keys = append(layout.Keys, Position{row, col})
+		}
+	}
+	keymap, err := doc.ToKeymap(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Keymap{
+		{
+			{keycode.KC_7, keycode.KC_8, keycode.KC_9},
+			{0x6129, 0x412C, 0x5502},
+			{0x5101, 0x5302, 0x011D},
+		},
+		{
+			{keycode.KC_TRANSPARENT, 0x022B, 0x021E},
+			{0x654C, keycode.KC_TRANSPARENT, 0x5802},
+			{keycode.KC_TRANSPARENT, 0x5010, 0x5928},
+		},
+		{
+			{keycode.KC_NO, 0x5200, 0x5401},
+			{0x0317, 0x5703, keycode.KC_NO},
+			{keycode.KC_TRANSPARENT, keycode.KC_TRANSPARENT, 0x7E00},
+		},
+	}
+	for layer := range want {
+		for row := range want[layer] {
+			for col, code := range want[layer][row] {
+				if keymap[layer][row][col] != code {
+					t.Errorf("[%d %d %d] wanted %v, got %v", layer, row, col, code, keymap[layer][row][col])
+				}
+			}
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	doc := &JSON{Layout: "LAYOUT_test", Layers: [][]string{
+		{"KC_ESC", "KC_A", "KC_B", "KC_ENT", "KC_SPC"},
+		{"KC_TRNS", "KC_A", "KC_NOPE", "KC_B", "KC_C"},
+	}}
+	_, err := doc.ToKeymap(testLayout)
+	var keyError *KeyError
+	if !errors.As(err, &keyError) || !errors.Is(err, keycode.ErrorUnknownKeycode) {
+		t.Fatalf("wanted unknown keycode error, got %v", err)
+	}
+	if keyError.Layer != 1 || keyError.Index != 2 || keyError.Value != "KC_NOPE" {
+		t.Errorf("wanted error at layer 1 index 2 for KC_NOPE, got %v", keyError)
+	}
+
+	doc.Layers[1] = doc.Layers[1][:4]
+	if _, err := doc.ToKeymap(testLayout); !errors.Is(err, ErrorLayoutMismatch) {
+		t.Errorf("wanted error %v, got %v", ErrorLayoutMismatch, err)
+	}
+
+	bad := testLayout
+	bad.Keys = append([]Position{{2, 0}}, bad.Keys...)
+	if _, err := doc.ToKeymap(bad); !errors.Is(err, ErrorBadLayout) {
+		t.Errorf("wanted error %v, got %v", ErrorBadLayout, err)
+	}
+}
+
+func TestFromKeymap(t *testing.T) {
+	doc, err := ReadJSON(strings.NewReader(testJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keymap, err := doc.ToKeymap(testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keymap[1][1][1] = keycode.KC_A // not in the layout, so not written
+
+	exported, err := FromKeymap(keymap, testLayout, "test/rev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"KC_ESCAPE", "KC_A", "KC_B", "KC_ENTER", "KC_SPACE"},
+		{"KC_TRANSPARENT", "MO(1)", "KC_NO", "QK_MACRO_0", "KC_TRANSPARENT"},
+	}
+	for layer := range want {
+		if strings.Join(exported.Layers[layer], ",") != strings.Join(want[layer], ",") {
+			t.Errorf("wanted layer %d %v, got %v", layer, want[layer], exported.Layers[layer])
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := exported.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	reread, err := ReadJSON(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := reread.ToKeymap(testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keymap[1][1][1] = keycode.KC_NO
+	if !roundTrip.Equal(keymap) {
+		t.Errorf("wanted keymap %v after round trip, got %v", keymap, roundTrip)
+	}
+
+	if _, err := FromKeymap(New(1, 3, 3), testLayout, "test/rev1"); !errors.Is(err, ErrorBadDimensions) {
+		t.Errorf("wanted error %v, got %v", ErrorBadDimensions, err)
+	}
+}
+
+func TestJSONWithInfo(t *testing.T) {
+	info, err := ReadInfo(strings.NewReader(testInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ReadJSON(strings.NewReader(strings.Replace(testJSON, `"LAYOUT_test"`, `"LAYOUT"`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keymap, err := doc.ToKeymapWithInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := doc.ToKeymap(testLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keymap.Equal(want) {
+		t.Errorf("wanted keymap %v, got %v", want, keymap)
+	}
+
+	exported, err := FromKeymapWithInfo(keymap, info, "LAYOUT", "test/rev1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.Layout != "LAYOUT" || strings.Join(exported.Layers[0], ",") != "KC_ESCAPE,KC_A,KC_B,KC_ENTER,KC_SPACE" {
+		t.Errorf("wanted LAYOUT with the first layer in macro order, got %s %v", exported.Layout, exported.Layers[0])
+	}
+
+	doc.Layout = "LAYOUT_nope"
+	if _, err := doc.ToKeymapWithInfo(info); !errors.Is(err, ErrorNoLayout) {
+		t.Errorf("wanted error %v, got %v", ErrorNoLayout, err)
+	}
+}
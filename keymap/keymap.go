@@ -0,0 +1,191 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var (
+	ErrorBadDimensions = errors.New("keymap dimensions do not match")
+	ErrorBadDataSize   = errors.New("keymap data size does not match its dimensions")
+)
+
+// Keymap holds keycodes by layer, row and column
+type Keymap [][][]keycode.Keycode
+
+// New creates a keymap of KC_NO
+func New(layers int, rows int, cols int) Keymap {
+	keymap := make(Keymap, layers)
+	for layer := range keymap {
+		keymap[layer] = make([][]keycode.Keycode, rows)
+		for row := range keymap[layer] {
+			keymap[layer][row] = make([]keycode.Keycode, cols)
+		}
+	}
+	return keymap
+}
+
+func (k Keymap) Layers() int {
+	return len(k)
+}
+
+func (k Keymap) Rows() int {
+	if len(k) == 0 {
+		return 0
+	}
+	return len(k[0])
+}
+
+func (k Keymap) Cols() int {
+	if len(k) == 0 || len(k[0]) == 0 {
+		return 0
+	}
+	return len(k[0][0])
+}
+
+// Validate checks that every layer and row has the same size
+func (k Keymap) Validate() error {
+	rows, cols := k.Rows(), k.Cols()
+	for layer := range k {
+		if len(k[layer]) != rows {
+			return fmt.Errorf("%w: layer %d has %d rows, wanted %d", ErrorBadDimensions, layer, len(k[layer]), rows)
+		}
+		for row := range k[layer] {
+			if len(k[layer][row]) != cols {
+				return fmt.Errorf("%w: layer %d row %d has %d columns, wanted %d", ErrorBadDimensions, layer, row, len(k[layer][row]), cols)
+			}
+		}
+	}
+	return nil
+}
+
+// Offset is the position of a keycode in the dynamic keymap EEPROM
+func Offset(rows int, cols int, layer int, row int, col int) int {
+	return ((layer*rows+row)*cols + col) * 2
+}
+
+// Size is the number of bytes a keymap takes in the dynamic keymap EEPROM
+func Size(layers int, rows int, cols int) int {
+	return layers * rows * cols * 2
+}
+
+// FromBytes decodes a dynamic keymap EEPROM image of big-endian keycodes
+func FromBytes(data []byte, layers int, rows int, cols int) (Keymap, error) {
+	if len(data) != Size(layers, rows, cols) {
+		return nil, fmt.Errorf("%w: %d bytes for %dx%dx%d", ErrorBadDataSize, len(data), layers, rows, cols)
+	}
+	keymap := New(layers, rows, cols)
+	for layer := range keymap {
+		for row := range keymap[layer] {
+			for col := range keymap[layer][row] {
+				offset := Offset(rows, cols, layer, row, col)
+				keymap[layer][row][col] = keycode.KeycodeFromBytes(data[offset], data[offset+1])
+			}
+		}
+	}
+	return keymap, nil
+}
+
+// Bytes encodes the keymap as a dynamic keymap EEPROM image
+func (k Keymap) Bytes() []byte {
+	rows, cols := k.Rows(), k.Cols()
+	data := make([]byte, Size(k.Layers(), rows, cols))
+	for layer := range k {
+		for row := range k[layer] {
+			for col, code := range k[layer][row] {
+				copy(data[Offset(rows, cols, layer, row, col):], code.ToBytes())
+			}
+		}
+	}
+	return data
+}
+
+// Clone returns a deep copy of the keymap
+func (k Keymap) Clone() Keymap {
+	clone := New(k.Layers(), k.Rows(), k.Cols())
+	for layer := range k {
+		for row := range k[layer] {
+			copy(clone[layer][row], k[layer][row])
+		}
+	}
+	return clone
+}
+
+// Map returns a copy of the keymap with f applied to every keycode
+func (k Keymap) Map(f func(keycode.Keycode) keycode.Keycode) Keymap {
+	mapped := k.Clone()
+	for layer := range mapped {
+		for row := range mapped[layer] {
+			for col := range mapped[layer][row] {
+				mapped[layer][row][col] = f(mapped[layer][row][col])
+			}
+		}
+	}
+	return mapped
+}
+
+// Equal reports whether two keymaps have the same dimensions and keycodes
+func (k Keymap) Equal(other Keymap) bool {
+	if len(k) != len(other) {
+		return false
+	}
+	for layer := range k {
+		if len(k[layer]) != len(other[layer]) {
+			return false
+		}
+		for row := range k[layer] {
+			if len(k[layer][row]) != len(other[layer][row]) {
+				return false
+			}
+			for col := range k[layer][row] {
+				if k[layer][row][col] != other[layer][row][col] {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Chunk is a run of bytes to write at an offset in the dynamic keymap EEPROM
+type Chunk struct {
+	Offset int
+	Data   []byte
+}
+
+// Diff finds the keycodes which differ between two EEPROM images of the same
+// size, coalescing them into chunks of at most size bytes. Unchanged keycodes
+// between changes are carried in a chunk where that saves starting another.
+func Diff(current []byte, desired []byte, size int) []Chunk {
+	size -= size % 2
+	chunks := []Chunk{}
+	start, end := -1, -1
+	flush := func() {
+		if start >= 0 {
+			chunks = append(chunks, Chunk{start, append([]byte{}, desired[start:end]...)})
+		}
+		start, end = -1, -1
+	}
+	for offset := 0; offset+1 < len(desired) && offset+1 < len(current); offset += 2 {
+		if current[offset] == desired[offset] && current[offset+1] == desired[offset+1] {
+			continue
+		}
+		if start >= 0 && offset+2-start > size {
+			flush()
+		}
+		if start < 0 {
+			start = offset
+		}
+		end = offset + 2
+	}
+	flush()
+	return chunks
+}
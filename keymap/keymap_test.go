@@ -0,0 +1,121 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+func TestFromBytes(t *testing.T) {
+	data := []byte{
+		0x00, 0x04, 0x00, 0x05, 0x00, 0x06, // layer 0 row 0
+		0x00, 0x07, 0x00, 0x08, 0x00, 0x09, // layer 0 row 1
+		0x51, 0x01, 0x00, 0x00, 0x41, 0x2C, // layer 1 row 0
+		0x00, 0x01, 0x00, 0x00, 0x00, 0x00, // layer 1 row 1
+	}
+	keymap, err := FromBytes(data, 2, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Layer, Row, Col int
+		Keycode         keycode.Keycode
+	}{
+		{0, 0, 0, keycode.KC_A},
+		{0, 1, 2, keycode.KC_F},
+		{1, 0, 0, 0x5101},
+		{1, 0, 2, 0x412C},
+		{1, 1, 0, keycode.KC_TRNS},
+	}
+	for i, test := range tests {
+		if code := keymap[test.Layer][test.Row][test.Col]; code != test.Keycode {
+			t.Errorf("[%d] wanted keycode 0x%04x, got 0x%04x", i, uint16(test.Keycode), uint16(code))
+		}
+	}
+	if encoded := keymap.Bytes(); !bytes.Equal(encoded, data) {
+		t.Errorf("wanted bytes %v, got %v", data, encoded)
+	}
+
+	if _, err := FromBytes(data[:5], 2, 2, 3); !errors.Is(err, ErrorBadDataSize) {
+		t.Errorf("wanted error %v, got %v", ErrorBadDataSize, err)
+	}
+}
+
+func TestOffset(t *testing.T) {
+	if offset := Offset(4, 12, 2, 3, 5); offset != ((2*4+3)*12+5)*2 {
+		t.Errorf("wanted offset %d, got %d", ((2*4+3)*12+5)*2, offset)
+	}
+	if size := Size(4, 4, 12); size != 384 {
+		t.Errorf("wanted size %d, got %d", 384, size)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	keymap := New(2, 2, 3)
+	if err := keymap.Validate(); err != nil {
+		t.Error(err)
+	}
+	keymap[1][1] = keymap[1][1][:2]
+	if err := keymap.Validate(); !errors.Is(err, ErrorBadDimensions) {
+		t.Errorf("wanted error %v, got %v", ErrorBadDimensions, err)
+	}
+}
+
+func TestCloneEqual(t *testing.T) {
+	keymap := New(2, 2, 3)
+	keymap[0][1][2] = keycode.KC_A
+	clone := keymap.Clone()
+	if !clone.Equal(keymap) {
+		t.Error("wanted clone equal to keymap")
+	}
+	clone[0][1][2] = keycode.KC_B
+	if clone.Equal(keymap) || keymap[0][1][2] != keycode.KC_A {
+		t.Error("wanted clone independent of keymap")
+	}
+	if New(2, 2, 3).Equal(New(2, 3, 2)) {
+		t.Error("wanted keymaps of different dimensions unequal")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	current := make([]byte, 80)
+	desired := append([]byte{}, current...)
+	desired[1] = 0x04               // keycode 0
+	desired[7] = 0x05               // keycode 3, carried with keycode 0
+	desired[40], desired[41] = 1, 1 // keycode 20, too far to carry
+	desired[79] = 0x06              // keycode 39
+
+	chunks := Diff(current, desired, 28)
+	want := []Chunk{
+		{0, desired[0:8]},
+		{40, desired[40:42]},
+		{78, desired[78:80]},
+	}
+	if len(chunks) != len(want) {
+		t.Fatalf("wanted %d chunks, got %d: %v", len(want), len(chunks), chunks)
+	}
+	for i := range want {
+		if chunks[i].Offset != want[i].Offset || !bytes.Equal(chunks[i].Data, want[i].Data) {
+			t.Errorf("[%d] wanted chunk %v, got %v", i, want[i], chunks[i])
+		}
+	}
+
+	if chunks := Diff(current, current, 28); len(chunks) != 0 {
+		t.Errorf("wanted no chunks for identical images, got %v", chunks)
+	}
+
+	// A long run of changes is split at the chunk size
+	changed := bytes.Repeat([]byte{0xFF}, 80)
+	chunks = Diff(current, changed, 28)
+	if len(chunks) != 3 || len(chunks[0].Data) != 28 || len(chunks[2].Data) != 24 {
+		t.Errorf("wanted chunks of 28, 28 and 24 bytes, got %v", chunks)
+	}
+}
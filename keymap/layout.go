@@ -0,0 +1,72 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package keymap
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrorBadLayout   = errors.New("layout does not fit the matrix")
+	ErrorLayoutOrder = errors.New("layout keys are not in LAYOUT macro order")
+)
+
+// Position is a switch matrix row and column
+type Position struct {
+	Row int
+	Col int
+}
+
+// KeyOrder is the order of a layout's keys
+type KeyOrder int
+
+const (
+	// The arguments of a QMK LAYOUT macro
+	MacroOrder KeyOrder = iota
+	// A VIA keyboard definition's KLE order, which QMK keymaps do not use
+	KLEOrder
+)
+
+// Layout maps the arguments of a LAYOUT macro, in order, to switch matrix
+// positions. Keyboard definitions supply these.
+type Layout struct {
+	// Macro name, such as LAYOUT_ortho_4x12
+	Name string
+	// Switch matrix size
+	Rows int
+	Cols int
+	// Matrix position of each LAYOUT argument
+	Keys []Position
+	// MacroOrder unless the keys come from somewhere other than a LAYOUT
+	// macro. Only MacroOrder layouts read and write keymap.c and keymap.json.
+	Order KeyOrder
+}
+
+// Validate checks that every key is inside the matrix, and that no matrix
+// position is used twice
+func (l Layout) Validate() error {
+	seen := map[Position]int{}
+	for i, key := range l.Keys {
+		if key.Row < 0 || key.Row >= l.Rows || key.Col < 0 || key.Col >= l.Cols {
+			return fmt.Errorf("%w: key %d at %d,%d is outside the %dx%d matrix", ErrorBadLayout, i, key.Row, key.Col, l.Rows, l.Cols)
+		}
+		if first, ok := seen[key]; ok {
+			return fmt.Errorf("%w: keys %d and %d are both at %d,%d", ErrorBadLayout, first, i, key.Row, key.Col)
+		}
+		seen[key] = i
+	}
+	return nil
+}
+
+// checkMacroOrder checks that the keys are a LAYOUT macro's arguments
+func (l Layout) checkMacroOrder() error {
+	if l.Order == KLEOrder {
+		return fmt.Errorf("%w: keys are in KLE order", ErrorLayoutOrder)
+	}
+	return nil
+}
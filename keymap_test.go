@@ -0,0 +1,251 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/keymap"
+	"github.com/ianmclinden/qmk-go/qmktest"
+)
+
+// testKeymap fills a keymap with distinct keycodes
+func testKeymap(layers int, rows int, cols int) []keycode.Keycode {
+	codes := make([]keycode.Keycode, layers*rows*cols)
+	for i := range codes {
+		codes[i] = keycode.Keycode(0x0100 + i)
+	}
+	return codes
+}
+
+func TestReadKeymap(t *testing.T) {
+	config := qmktest.DefaultConfig
+	// 3 layers of 5x7 is 210 bytes, which does not divide into chunks evenly
+	config.Layers, config.Rows, config.Cols = 3, 5, 7
+	config.Keymap = testKeymap(3, 5, 7)
+	client, _ := newTestClient(t, config)
+
+	var calls, done, total int
+	keymap, err := client.ReadKeymap(5, 7, func(d int, t int) {
+		calls++
+		done, total = d, t
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keymap.Layers() != 3 || keymap.Rows() != 5 || keymap.Cols() != 7 {
+		t.Fatalf("wanted 3x5x7 keymap, got %dx%dx%d", keymap.Layers(), keymap.Rows(), keymap.Cols())
+	}
+	for i, want := range config.Keymap {
+		layer, row, col := i/35, i/7%5, i%7
+		if code := keymap[layer][row][col]; code != want {
+			t.Errorf("wanted keycode 0x%04x at %d,%d,%d, got 0x%04x", uint16(want), layer, row, col, uint16(code))
+		}
+	}
+	if calls != 8 || done != 210 || total != 210 {
+		t.Errorf("wanted 8 progress calls ending at 210/210, got %d ending at %d/%d", calls, done, total)
+	}
+}
+
+func TestReadKeymapV12(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = qmk.ViaProtocolVersion12
+	config.Layers, config.Rows, config.Cols = 1, 1, 2
+	config.Keymap = []keycode.Keycode{0x5221, 0x7700} // MO(1), MACRO00 on the wire
+	client, _ := newTestClient(t, config)
+
+	keymap, err := client.ReadKeymap(1, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keymap[0][0][0] != 0x5101 || keymap[0][0][1] != keycode.MACRO00 {
+		t.Errorf("wanted keycodes 0x5101, 0x%04x, got 0x%04x, 0x%04x", uint16(keycode.MACRO00), uint16(keymap[0][0][0]), uint16(keymap[0][0][1]))
+	}
+}
+
+// corruptingTransport flips a keycode bit in every buffer write
+type corruptingTransport struct {
+	*qmktest.Emulator
+}
+
+func (t corruptingTransport) Write(b []byte) (int, error) {
+	if b[0] == qmk.DynamicKeymapSetBufferId {
+		b = append([]byte{}, b...)
+		b[5] ^= 0x01
+	}
+	return t.Emulator.Write(b)
+}
+
+func countCommands(commands []byte, command byte) int {
+	count := 0
+	for _, c := range commands {
+		if c == command {
+			count++
+		}
+	}
+	return count
+}
+
+func TestWriteKeymap(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.Keymap = testKeymap(4, 4, 12)
+	client, emulator := newTestClient(t, config)
+
+	current, err := client.ReadKeymap(4, 12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	desired[0][0][0] = keycode.KC_A
+	desired[0][0][3] = keycode.KC_B
+	desired[2][3][11] = keycode.KC_C
+	desired[3] = desired[3][:0] // fewer rows on a layer fails validation
+
+	if err := client.WriteKeymap(desired, nil); !errors.Is(err, keymap.ErrorBadDimensions) {
+		t.Errorf("wanted error %v, got %v", keymap.ErrorBadDimensions, err)
+	}
+	desired = desired[:3]
+
+	before := len(emulator.Commands())
+	var done, total int
+	if err := client.WriteKeymap(desired, func(d int, t int) { done, total = d, t }); err != nil {
+		t.Fatal(err)
+	}
+	commands := emulator.Commands()[before:]
+	if writes := countCommands(commands, qmk.DynamicKeymapSetBufferId); writes != 2 {
+		t.Errorf("wanted %d buffer writes, got %d", 2, writes)
+	}
+	if done != 10 || total != 10 {
+		t.Errorf("wanted progress 10/10, got %d/%d", done, total)
+	}
+	for _, key := range []struct {
+		Layer, Row, Col uint8
+		Keycode         keycode.Keycode
+	}{
+		{0, 0, 0, keycode.KC_A},
+		{0, 0, 1, current[0][0][1]},
+		{0, 0, 3, keycode.KC_B},
+		{2, 3, 11, keycode.KC_C},
+		{3, 0, 0, current[3][0][0]},
+	} {
+		if code := emulator.Keycode(key.Layer, key.Row, key.Col); code != key.Keycode {
+			t.Errorf("wanted keycode 0x%04x at %d,%d,%d, got 0x%04x", uint16(key.Keycode), key.Layer, key.Row, key.Col, uint16(code))
+		}
+	}
+
+	// Nothing left to write
+	before = len(emulator.Commands())
+	if err := client.WriteKeymap(desired, nil); err != nil {
+		t.Fatal(err)
+	}
+	if writes := countCommands(emulator.Commands()[before:], qmk.DynamicKeymapSetBufferId); writes != 0 {
+		t.Errorf("wanted no buffer writes, got %d", writes)
+	}
+
+	tooMany := keymap.New(5, 4, 12)
+	if err := client.WriteKeymap(tooMany, nil); !errors.Is(err, keymap.ErrorBadDimensions) {
+		t.Errorf("wanted error %v, got %v", keymap.ErrorBadDimensions, err)
+	}
+}
+
+func TestWriteKeymapV12(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = qmk.ViaProtocolVersion12
+	client, emulator := newTestClient(t, config)
+
+	desired := keymap.New(1, 4, 12)
+	desired[0][1][2] = 0x5101 // MO(1)
+	if err := client.WriteKeymap(desired, nil); err != nil {
+		t.Fatal(err)
+	}
+	if code := emulator.Keycode(0, 1, 2); code != 0x5221 {
+		t.Errorf("wanted v12 keycode 0x%04x, got 0x%04x", 0x5221, uint16(code))
+	}
+}
+
+func TestKeymapRoundTripV12(t *testing.T) {
+	config := qmktest.DefaultConfig
+	config.ProtocolVersion = qmk.ViaProtocolVersion12
+	config.Layers, config.Rows, config.Cols = 1, 1, 4
+	// QK_USER_0 has no legacy keycode, and QK_BOOT and RGB_TOG read back as
+	// their legacy RESET and RGB_TOG
+	config.Keymap = []keycode.Keycode{0x7C00, 0x7820, 0x7E40, 0x5221}
+	source, _ := newTestClient(t, config)
+
+	saved, err := source.ReadKeymap(1, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Keymap = nil
+	destination, emulator := newTestClient(t, config)
+	if err := destination.WriteKeymap(saved, nil); err != nil {
+		t.Fatal(err)
+	}
+	for col, want := range []keycode.Keycode{0x7C00, 0x7820, 0x7E40, 0x5221} {
+		if code := emulator.Keycode(0, 0, uint8(col)); code != want {
+			t.Errorf("[%d] wanted v12 keycode 0x%04x, got 0x%04x", col, uint16(want), uint16(code))
+		}
+	}
+}
+
+func TestKeymapAcrossVersions(t *testing.T) {
+	// LM(1, MOD_LSFT), SH_T(KC_A), SH_TG, RESET and RGB_TOG move in v12
+	legacy := []keycode.Keycode{0x5912, 0x5B04, 0x5BF0, 0x5C00, 0x5CC2}
+	v12 := []keycode.Keycode{0x5022, 0x5604, 0x56F0, 0x7C00, 0x7820}
+	tests := []struct {
+		From   uint16
+		To     uint16
+		Keymap []keycode.Keycode
+		Want   []keycode.Keycode
+	}{
+		{qmk.ViaProtocolVersion9, qmk.ViaProtocolVersion12, legacy, v12},
+		{qmk.ViaProtocolVersion12, qmk.ViaProtocolVersion11, v12, legacy},
+	}
+	for i, test := range tests {
+		config := qmktest.DefaultConfig
+		config.ProtocolVersion = test.From
+		config.Layers, config.Rows, config.Cols = 1, 1, uint8(len(test.Keymap))
+		config.Keymap = test.Keymap
+		source, _ := newTestClient(t, config)
+		saved, err := source.ReadKeymap(1, config.Cols, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config.ProtocolVersion, config.Keymap = test.To, nil
+		destination, emulator := newTestClient(t, config)
+		if err := destination.WriteKeymap(saved, nil); err != nil {
+			t.Fatal(err)
+		}
+		for col, want := range test.Want {
+			if code := emulator.Keycode(0, 0, uint8(col)); code != want {
+				t.Errorf("[%d] wanted keycode 0x%04x at %d, got 0x%04x", i, uint16(want), col, uint16(code))
+			}
+		}
+	}
+}
+
+func TestWriteKeymapVerify(t *testing.T) {
+	emulator := qmktest.NewEmulator(qmktest.DefaultConfig)
+	client, err := qmk.NewClientWithTransport(corruptingTransport{emulator})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := keymap.New(1, 4, 12)
+	desired[0][2][5] = keycode.KC_A
+	err = client.WriteKeymap(desired, nil)
+	if !errors.Is(err, qmk.ErrorKeymapVerify) {
+		t.Fatalf("wanted error %v, got %v", qmk.ErrorKeymapVerify, err)
+	}
+	if !strings.Contains(err.Error(), "layer 0 row 2 col 5") {
+		t.Errorf("wanted error naming the key, got %v", err)
+	}
+}
@@ -0,0 +1,276 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+// Package kle reads keyboard-layout-editor.com raw data, as embedded in VIA
+// keyboard definitions, into key geometry.
+package kle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go/keymap"
+)
+
+var ErrorBadKLE = errors.New("invalid KLE data")
+
+// Legend indices VIA reads, in KLE's raw (unaligned) legend order
+const (
+	// "row,col" switch matrix position
+	MatrixLegend = 0
+	// "group,choice" layout option
+	OptionLegend = 3
+)
+
+// Option places a key in one choice of a layout option
+type Option struct {
+	Group  int
+	Choice int
+}
+
+// Key is one key, in key units (1u is a standard key's width). X and Y are
+// the top left corner before rotation.
+type Key struct {
+	X float64
+	Y float64
+	W float64
+	H float64
+	// Second rectangle of stepped and ISO enter keys, relative to X and Y
+	X2 float64
+	Y2 float64
+	W2 float64
+	H2 float64
+	// Rotation in degrees clockwise about RX, RY
+	R  float64
+	RX float64
+	RY float64
+
+	// Legends, as written
+	Labels []string
+	// Decals are drawn but are not keys
+	Decal bool
+	Ghost bool
+
+	// Switch matrix position, nil for keys without one
+	Matrix *keymap.Position
+	// Layout option, nil for keys in every layout
+	Option *Option
+}
+
+// Point is a position in key units
+type Point struct {
+	X float64
+	Y float64
+}
+
+// Corners returns the key's corners clockwise from the top left, rotated
+func (k Key) Corners() [4]Point {
+	corners := [4]Point{
+		{k.X, k.Y},
+		{k.X + k.W, k.Y},
+		{k.X + k.W, k.Y + k.H},
+		{k.X, k.Y + k.H},
+	}
+	if k.R == 0 {
+		return corners
+	}
+	sin, cos := math.Sincos(k.R * math.Pi / 180)
+	for i, p := range corners {
+		x, y := p.X-k.RX, p.Y-k.RY
+		corners[i] = Point{k.RX + x*cos - y*sin, k.RY + x*sin + y*cos}
+	}
+	return corners
+}
+
+// Center returns the middle of the key, rotated
+func (k Key) Center() Point {
+	corners := k.Corners()
+	return Point{(corners[0].X + corners[2].X) / 2, (corners[0].Y + corners[2].Y) / 2}
+}
+
+// Layout is a parsed KLE layout
+type Layout struct {
+	// Keyboard metadata, if the data starts with it
+	Meta json.RawMessage
+	Keys []Key
+}
+
+// Bounds returns the smallest rectangle holding every key, rotations
+// included
+func (l *Layout) Bounds() (Point, Point) {
+	if len(l.Keys) == 0 {
+		return Point{}, Point{}
+	}
+	min := Point{math.Inf(1), math.Inf(1)}
+	max := Point{math.Inf(-1), math.Inf(-1)}
+	for _, key := range l.Keys {
+		for _, p := range key.Corners() {
+			min.X, min.Y = math.Min(min.X, p.X), math.Min(min.Y, p.Y)
+			max.X, max.Y = math.Max(max.X, p.X), math.Max(max.Y, p.Y)
+		}
+	}
+	return min, max
+}
+
+// properties change the keys after them in a row
+type properties struct {
+	X  *float64 `json:"x"`
+	Y  *float64 `json:"y"`
+	W  *float64 `json:"w"`
+	H  *float64 `json:"h"`
+	X2 *float64 `json:"x2"`
+	Y2 *float64 `json:"y2"`
+	W2 *float64 `json:"w2"`
+	H2 *float64 `json:"h2"`
+	R  *float64 `json:"r"`
+	RX *float64 `json:"rx"`
+	RY *float64 `json:"ry"`
+	D  bool     `json:"d"`
+	G  *bool    `json:"g"`
+}
+
+// Parse reads KLE raw data: an array of rows, each an array of legends and
+// the property objects which change the keys after them. VIA's matrix
+// position and layout option legends are read into each key.
+func Parse(data []byte) (*Layout, error) {
+	var rows []json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorBadKLE, err)
+	}
+
+	layout := &Layout{}
+	current := Key{W: 1, H: 1}
+	// Where rows start, moved by rotation origins
+	cluster := Point{}
+	ghost := false
+	for r, raw := range rows {
+		var items []json.RawMessage
+		if err := json.Unmarshal(raw, &items); err != nil {
+			if r == 0 && len(raw) > 0 && raw[0] == '{' {
+				layout.Meta = raw
+				continue
+			}
+			return nil, fmt.Errorf("%w: row %d is not an array", ErrorBadKLE, r)
+		}
+
+		for i, item := range items {
+			var legend string
+			if err := json.Unmarshal(item, &legend); err == nil {
+				layout.Keys = append(layout.Keys, newKey(current, legend, ghost))
+
+				current.X += current.W
+				current.W, current.H = 1, 1
+				current.X2, current.Y2, current.W2, current.H2 = 0, 0, 0, 0
+				current.Decal = false
+				continue
+			}
+
+			var p properties
+			if err := json.Unmarshal(item, &p); err != nil {
+				return nil, fmt.Errorf("%w: row %d item %d is neither a legend nor properties", ErrorBadKLE, r, i)
+			}
+			if (p.R != nil || p.RX != nil || p.RY != nil) && i != 0 {
+				return nil, fmt.Errorf("%w: row %d item %d: rotation can only change at the start of a row", ErrorBadKLE, r, i)
+			}
+			if p.R != nil {
+				current.R = *p.R
+			}
+			if p.RX != nil {
+				current.RX, cluster.X = *p.RX, *p.RX
+				current.X, current.Y = cluster.X, cluster.Y
+			}
+			if p.RY != nil {
+				current.RY, cluster.Y = *p.RY, *p.RY
+				current.X, current.Y = cluster.X, cluster.Y
+			}
+			if p.X != nil {
+				current.X += *p.X
+			}
+			if p.Y != nil {
+				current.Y += *p.Y
+			}
+			if p.W != nil {
+				current.W, current.W2 = *p.W, *p.W
+			}
+			if p.H != nil {
+				current.H, current.H2 = *p.H, *p.H
+			}
+			if p.X2 != nil {
+				current.X2 = *p.X2
+			}
+			if p.Y2 != nil {
+				current.Y2 = *p.Y2
+			}
+			if p.W2 != nil {
+				current.W2 = *p.W2
+			}
+			if p.H2 != nil {
+				current.H2 = *p.H2
+			}
+			current.Decal = p.D
+			if p.G != nil {
+				ghost = *p.G
+			}
+		}
+
+		current.Y++
+		current.X = current.RX
+	}
+	return layout, nil
+}
+
+// newKey copies the current key state, reading VIA's legends. Legends which
+// are not number pairs, as in layouts not made for VIA, are left as labels.
+func newKey(current Key, legend string, ghost bool) Key {
+	key := current
+	key.Labels = strings.Split(legend, "\n")
+	key.Ghost = ghost
+	// Second rectangles default to the first
+	if key.W2 == 0 {
+		key.W2 = key.W
+	}
+	if key.H2 == 0 {
+		key.H2 = key.H
+	}
+	if key.Decal {
+		return key
+	}
+	if row, col, ok := pair(key.label(MatrixLegend)); ok {
+		key.Matrix = &keymap.Position{Row: row, Col: col}
+	}
+	if group, choice, ok := pair(key.label(OptionLegend)); ok {
+		key.Option = &Option{Group: group, Choice: choice}
+	}
+	return key
+}
+
+func (k Key) label(index int) string {
+	if index >= len(k.Labels) {
+		return ""
+	}
+	return strings.TrimSpace(k.Labels[index])
+}
+
+// pair parses "a,b" into two non-negative integers
+func pair(value string) (int, int, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	a, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || a < 0 {
+		return 0, 0, false
+	}
+	b, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || b < 0 {
+		return 0, 0, false
+	}
+	return a, b, true
+}
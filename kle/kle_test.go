@@ -0,0 +1,114 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package kle
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go/keymap"
+)
+
+const testKLE = `[
+  {"name": "test"},
+  ["0,0", {"w": 1.5}, "0,1", "0,2\n\n\n0,0", {"x": -1, "d": true}, "decal", "0,3\n\n\n0,1"],
+  [{"y": 0.5, "w": 1.25, "h": 2, "w2": 1.5, "h2": 1, "x2": -0.25}, "1,0"],
+  [{"r": 90, "rx": 5, "ry": 1}, "2,0", "2,1"],
+  [{"x": 1}, "3,0"]
+]`
+
+func TestParse(t *testing.T) {
+	layout, err := Parse([]byte(testKLE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(layout.Meta) != `{"name": "test"}` {
+		t.Errorf("wanted meta, got %s", layout.Meta)
+	}
+
+	pos := func(row int, col int) *keymap.Position { return &keymap.Position{Row: row, Col: col} }
+	want := []struct {
+		Key    Key
+		Matrix *keymap.Position
+		Option *Option
+	}{
+		/* 0*/ {Key{X: 0, Y: 0, W: 1, H: 1, W2: 1, H2: 1}, pos(0, 0), nil},
+		/* 1*/ {Key{X: 1, Y: 0, W: 1.5, H: 1, W2: 1.5, H2: 1}, pos(0, 1), nil},
+		/* 2*/ {Key{X: 2.5, Y: 0, W: 1, H: 1, W2: 1, H2: 1}, pos(0, 2), &Option{0, 0}},
+		/* 3*/ {Key{X: 2.5, Y: 0, W: 1, H: 1, W2: 1, H2: 1, Decal: true}, nil, nil},
+		/* 4*/ {Key{X: 3.5, Y: 0, W: 1, H: 1, W2: 1, H2: 1}, pos(0, 3), &Option{0, 1}},
+		/* 5*/ {Key{X: 0, Y: 1.5, W: 1.25, H: 2, X2: -0.25, W2: 1.5, H2: 1}, pos(1, 0), nil},
+		/* 6*/ {Key{X: 5, Y: 1, W: 1, H: 1, W2: 1, H2: 1, R: 90, RX: 5, RY: 1}, pos(2, 0), nil},
+		/* 7*/ {Key{X: 6, Y: 1, W: 1, H: 1, W2: 1, H2: 1, R: 90, RX: 5, RY: 1}, pos(2, 1), nil},
+		/* 8*/ {Key{X: 6, Y: 2, W: 1, H: 1, W2: 1, H2: 1, R: 90, RX: 5, RY: 1}, pos(3, 0), nil},
+	}
+	if len(layout.Keys) != len(want) {
+		t.Fatalf("wanted %d keys, got %d", len(want), len(layout.Keys))
+	}
+	for i, w := range want {
+		key := layout.Keys[i]
+		if key.X != w.Key.X || key.Y != w.Key.Y || key.W != w.Key.W || key.H != w.Key.H ||
+			key.X2 != w.Key.X2 || key.Y2 != w.Key.Y2 || key.W2 != w.Key.W2 || key.H2 != w.Key.H2 ||
+			key.R != w.Key.R || key.RX != w.Key.RX || key.RY != w.Key.RY || key.Decal != w.Key.Decal {
+			t.Errorf("[%d] wanted key %+v, got %+v", i, w.Key, key)
+		}
+		if (key.Matrix == nil) != (w.Matrix == nil) || (key.Matrix != nil && *key.Matrix != *w.Matrix) {
+			t.Errorf("[%d] wanted matrix %v, got %v", i, w.Matrix, key.Matrix)
+		}
+		if (key.Option == nil) != (w.Option == nil) || (key.Option != nil && *key.Option != *w.Option) {
+			t.Errorf("[%d] wanted option %v, got %v", i, w.Option, key.Option)
+		}
+	}
+}
+
+func near(a Point, b Point) bool {
+	return math.Abs(a.X-b.X) < 1e-9 && math.Abs(a.Y-b.Y) < 1e-9
+}
+
+func TestCorners(t *testing.T) {
+	key := Key{X: 6, Y: 1, W: 2, H: 1, R: 90, RX: 5, RY: 1}
+	want := [4]Point{{5, 2}, {5, 4}, {4, 4}, {4, 2}}
+	for i, p := range key.Corners() {
+		if !near(p, want[i]) {
+			t.Errorf("[%d] wanted corner %v, got %v", i, want[i], p)
+		}
+	}
+	if c := key.Center(); !near(c, Point{4.5, 3}) {
+		t.Errorf("wanted center {4.5 3}, got %v", c)
+	}
+
+	layout := &Layout{Keys: []Key{{X: 0, Y: 0, W: 1.5, H: 1}, key}}
+	min, max := layout.Bounds()
+	if !near(min, Point{0, 0}) || !near(max, Point{5, 4}) {
+		t.Errorf("wanted bounds {0 0} to {5 4}, got %v to %v", min, max)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	errorTests := []string{
+		`{}`,
+		`[["0,0"], "row"]`,
+		`[["0,0", 3]]`,
+		`[["0,0", {"r": 15}, "0,1"]]`,
+		`[[{"w": "wide"}, "0,0"]]`,
+	}
+	for i, test := range errorTests {
+		if _, err := Parse([]byte(test)); !errors.Is(err, ErrorBadKLE) {
+			t.Errorf("[%d] wanted error %v, got %v", i, ErrorBadKLE, err)
+		}
+	}
+
+	// Legends from layouts not made for VIA are kept as labels
+	layout, err := Parse([]byte(`[["Esc", "Q\n\n\nq"]]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layout.Keys[0].Matrix != nil || layout.Keys[1].Option != nil || layout.Keys[1].Labels[3] != "q" {
+		t.Errorf("wanted plain labels, got %+v", layout.Keys)
+	}
+}
@@ -0,0 +1,167 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var ErrorBadMacro = errors.New("invalid macro")
+
+// Dynamic macro action codes, as in QMK's send_string
+const (
+	// Introduces an action from protocol v11 (SS_QMK_PREFIX)
+	macroPrefix = 0x01
+
+	macroTap      = 0x01
+	macroDown     = 0x02
+	macroUp       = 0x03
+	macroDelay    = 0x04
+	macroDelayEnd = '|'
+)
+
+// macroPrefixed reports whether a protocol version prefixes macro actions,
+// which also brings delays
+func macroPrefixed(protocol uint16) bool {
+	return protocol >= ViaProtocolVersion11
+}
+
+// EncodeMacro converts VIA macro text into dynamic macro bytes for a VIA
+// protocol version. Text is typed as is, except for actions in braces:
+// {KC_A} taps a key, {KC_LCTL,KC_C} presses keys in order and releases them in
+// reverse, {+KC_A} and {-KC_A} press and release a key, and {100} waits 100ms.
+func EncodeMacro(text string, protocol uint16) ([]byte, error) {
+	var (
+		macro    = []byte{}
+		prefixed = macroPrefixed(protocol)
+	)
+	action := func(code byte, key byte) {
+		if prefixed {
+			macro = append(macro, macroPrefix)
+		}
+		macro = append(macro, code, key)
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] != '{' {
+			if text[i] <= macroDelay {
+				return nil, fmt.Errorf("%w: control character 0x%02x at %d", ErrorBadMacro, text[i], i)
+			}
+			macro = append(macro, text[i])
+			continue
+		}
+
+		end := strings.IndexByte(text[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unclosed { at %d", ErrorBadMacro, i)
+		}
+		expression := text[i+1 : i+end]
+
+		if delay, err := strconv.ParseUint(expression, 10, 32); err == nil {
+			if !prefixed {
+				return nil, fmt.Errorf("%w: delays need VIA protocol v11, at %d", ErrorBadMacro, i)
+			}
+			macro = append(macro, macroPrefix, macroDelay)
+			macro = append(macro, strconv.FormatUint(delay, 10)...)
+			macro = append(macro, macroDelayEnd)
+			i += end
+			continue
+		}
+
+		names := strings.Split(expression, ",")
+		keys := make([]byte, len(names))
+		for j, name := range names {
+			name = strings.TrimSpace(name)
+			if len(names) == 1 && (strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-")) {
+				name = name[1:]
+			}
+			code, err := keycode.KeycodeFromString(name)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v %q at %d", ErrorBadMacro, err, name, i)
+			}
+			if code > 0xFF {
+				return nil, fmt.Errorf("%w: %s is not a basic keycode, at %d", ErrorBadMacro, code, i)
+			}
+			keys[j] = byte(code)
+		}
+
+		switch {
+		case strings.HasPrefix(expression, "+"):
+			action(macroDown, keys[0])
+		case strings.HasPrefix(expression, "-"):
+			action(macroUp, keys[0])
+		case len(keys) == 1:
+			action(macroTap, keys[0])
+		default:
+			for _, key := range keys {
+				action(macroDown, key)
+			}
+			for j := len(keys) - 1; j >= 0; j-- {
+				action(macroUp, keys[j])
+			}
+		}
+		i += end
+	}
+	return macro, nil
+}
+
+// DecodeMacro converts dynamic macro bytes for a VIA protocol version into
+// VIA macro text (see EncodeMacro)
+func DecodeMacro(macro []byte, protocol uint16) (string, error) {
+	var (
+		text     strings.Builder
+		prefixed = macroPrefixed(protocol)
+	)
+	for i := 0; i < len(macro); i++ {
+		code := macro[i]
+		if code > macroDelay || (prefixed && code != macroPrefix) {
+			text.WriteByte(code)
+			continue
+		}
+		if prefixed {
+			i++
+			if i >= len(macro) {
+				return "", fmt.Errorf("%w: truncated action at %d", ErrorBadMacro, i-1)
+			}
+			code = macro[i]
+		}
+
+		if code == macroDelay && prefixed {
+			end := strings.IndexByte(string(macro[i+1:]), macroDelayEnd)
+			if end < 0 {
+				return "", fmt.Errorf("%w: unterminated delay at %d", ErrorBadMacro, i)
+			}
+			delay := string(macro[i+1 : i+1+end])
+			if _, err := strconv.ParseUint(delay, 10, 32); err != nil {
+				return "", fmt.Errorf("%w: bad delay %q at %d", ErrorBadMacro, delay, i)
+			}
+			text.WriteString("{" + delay + "}")
+			i += end + 1
+			continue
+		}
+		if code < macroTap || code > macroUp || i+1 >= len(macro) {
+			return "", fmt.Errorf("%w: bad action 0x%02x at %d", ErrorBadMacro, code, i)
+		}
+
+		i++
+		key := keycode.Keycode(macro[i])
+		switch code {
+		case macroTap:
+			text.WriteString("{" + key.String() + "}")
+		case macroDown:
+			text.WriteString("{+" + key.String() + "}")
+		case macroUp:
+			text.WriteString("{-" + key.String() + "}")
+		}
+	}
+	return text.String(), nil
+}
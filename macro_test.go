@@ -0,0 +1,99 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go"
+)
+
+var macroTests = []struct {
+	Protocol uint16
+	Text     string
+	Macro    []byte
+	Decoded  string
+}{
+	/* 0*/ {qmk.ViaProtocolVersion9, "hi", []byte("hi"), "hi"},
+	/* 1*/ {qmk.ViaProtocolVersion9, "{KC_ENT}", []byte{1, 0x28}, "{KC_ENTER}"},
+	/* 2*/ {qmk.ViaProtocolVersion9, "{KC_LCTL,KC_C}", []byte{2, 0xE0, 2, 0x06, 3, 0x06, 3, 0xE0}, "{+KC_LEFT_CTRL}{+KC_C}{-KC_C}{-KC_LEFT_CTRL}"},
+	/* 3*/ {qmk.ViaProtocolVersion11, "a{KC_B}", []byte{'a', 1, 1, 0x05}, "a{KC_B}"},
+	/* 4*/ {qmk.ViaProtocolVersion11, "{+KC_LSFT}x{-KC_LSFT}", []byte{1, 2, 0xE1, 'x', 1, 3, 0xE1}, "{+KC_LEFT_SHIFT}x{-KC_LEFT_SHIFT}"},
+	/* 5*/ {qmk.ViaProtocolVersion12, "{KC_A}{250}{KC_B}", []byte{1, 1, 0x04, 1, 4, '2', '5', '0', '|', 1, 1, 0x05}, "{KC_A}{250}{KC_B}"},
+	/* 6*/ {qmk.ViaProtocolVersion11, "", []byte{}, ""},
+}
+
+func TestEncodeMacro(t *testing.T) {
+	for i, test := range macroTests {
+		macro, err := qmk.EncodeMacro(test.Text, test.Protocol)
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		if !bytes.Equal(macro, test.Macro) {
+			t.Errorf("[%d] wanted macro %v, got %v", i, test.Macro, macro)
+		}
+	}
+}
+
+func TestDecodeMacro(t *testing.T) {
+	for i, test := range macroTests {
+		text, err := qmk.DecodeMacro(test.Macro, test.Protocol)
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		if text != test.Decoded {
+			t.Errorf("[%d] wanted text %q, got %q", i, test.Decoded, text)
+		}
+		// Decoded text encodes back to the same bytes
+		macro, err := qmk.EncodeMacro(text, test.Protocol)
+		if err != nil {
+			t.Errorf("[%d] %v", i, err)
+			continue
+		}
+		if !bytes.Equal(macro, test.Macro) {
+			t.Errorf("[%d] wanted macro %v after round trip, got %v", i, test.Macro, macro)
+		}
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	encodeTests := []struct {
+		Protocol uint16
+		Text     string
+	}{
+		{qmk.ViaProtocolVersion11, "{KC_A"},
+		{qmk.ViaProtocolVersion11, "{KC_NOPE}"},
+		{qmk.ViaProtocolVersion11, "{MACRO00}"},
+		{qmk.ViaProtocolVersion11, "\x01"},
+		{qmk.ViaProtocolVersion10, "{100}"},
+	}
+	for i, test := range encodeTests {
+		if _, err := qmk.EncodeMacro(test.Text, test.Protocol); !errors.Is(err, qmk.ErrorBadMacro) {
+			t.Errorf("[%d] wanted error %v, got %v", i, qmk.ErrorBadMacro, err)
+		}
+	}
+
+	decodeTests := []struct {
+		Protocol uint16
+		Macro    []byte
+	}{
+		{qmk.ViaProtocolVersion11, []byte{1}},
+		{qmk.ViaProtocolVersion11, []byte{1, 4, '1', '0'}},
+		{qmk.ViaProtocolVersion11, []byte{1, 9, 4}},
+		{qmk.ViaProtocolVersion9, []byte{4, 4}},
+		{qmk.ViaProtocolVersion9, []byte{1}},
+	}
+	for i, test := range decodeTests {
+		if _, err := qmk.DecodeMacro(test.Macro, test.Protocol); !errors.Is(err, qmk.ErrorBadMacro) {
+			t.Errorf("[%d] wanted error %v, got %v", i, qmk.ErrorBadMacro, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ClientOption configures a client when it is created
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	macroCache  bool
+	retries     int
+	backoff     Backoff
+	readTimeout time.Duration
+	retryHook   RetryHook
+	reconnect   bool
+	reopen      func() (Transport, error)
+	open        func(Keyboard) (Transport, error)
+}
+
+// reconnectBackoff is the default backoff with WithReconnect, spreading the
+// retries over the seconds a replugged keyboard takes to enumerate
+var reconnectBackoff = ExponentialBackoff{Base: 100 * time.Millisecond, Max: time.Second}
+
+func defaultClientOptions() clientOptions {
+	return clientOptions{
+		macroCache: true,
+		retries:    20,
+	}
+}
+
+func newClientOptions(opts []ClientOption) clientOptions {
+	options := defaultClientOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.backoff == nil {
+		options.backoff = ConstantBackoff(0)
+		if options.reconnect {
+			options.backoff = reconnectBackoff
+		}
+	}
+	return options
+}
+
+// WithoutMacroCache reads the macro buffer from the keyboard on every macro
+// access, instead of caching it in the client
+func WithoutMacroCache() ClientOption {
+	return func(o *clientOptions) {
+		o.macroCache = false
+	}
+}
+
+// WithRetries sets the number of attempts made for each command (default 20)
+func WithRetries(attempts int) ClientOption {
+	return func(o *clientOptions) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		o.retries = attempts
+	}
+}
+
+// WithBackoff sets the delay between attempts (default none, or 100ms doubling
+// up to 1s with WithReconnect)
+func WithBackoff(backoff Backoff) ClientOption {
+	return func(o *clientOptions) {
+		if backoff == nil {
+			backoff = ConstantBackoff(0)
+		}
+		o.backoff = backoff
+	}
+}
+
+// WithReadTimeout bounds the wait for each response, after which the command
+// is retried (default unbounded)
+func WithReadTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.readTimeout = timeout
+	}
+}
+
+// WithRetryHook calls hook before each retry of a failed attempt
+func WithRetryHook(hook RetryHook) ClientOption {
+	return func(o *clientOptions) {
+		o.retryHook = hook
+	}
+}
+
+// WithReconnect makes the client resilient to the keyboard being unplugged.
+// After an I/O failure the transport is reopened, the VIA protocol version is
+// re-verified, and the in-flight command is retried. Until a reopen succeeds,
+// each retry tries to reopen again. Keyboards opened over HID are found again
+// by serial (or HID path); clients with other transports also need WithReopen.
+func WithReconnect() ClientOption {
+	return func(o *clientOptions) {
+		o.reconnect = true
+	}
+}
+
+// WithReopen sets how the client opens a replacement transport, for Reopen
+// and WithReconnect
+func WithReopen(reopen func() (Transport, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.reopen = reopen
+	}
+}
+
+// WithOpen sets how a keyboard is opened, in place of its raw HID interface,
+// for keyboards reached through another transport. Unless WithReopen is also
+// given, the client reopens the keyboard the same way.
+func WithOpen(open func(Keyboard) (Transport, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.open = open
+	}
+}
+
+// Retry describes a failed attempt which is about to be retried
+type Retry struct {
+	// VIA command ID and value ID of the request
+	Command    byte
+	SubCommand byte
+	// The attempt which failed, starting from 1
+	Attempt int
+	// Why the attempt failed
+	Err error
+	// How long until the next attempt
+	Delay time.Duration
+}
+
+// RetryHook observes retries, e.g. for logging
+type RetryHook func(Retry)
+
+// Backoff decides how long to wait before the next attempt
+type Backoff interface {
+	// Delay after the given failed attempt, starting from 1
+	Delay(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same duration between every attempt
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) Delay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff doubles the delay after each attempt, up to Max
+type ExponentialBackoff struct {
+	// Delay after the first failed attempt
+	Base time.Duration
+	// Upper bound for the delay (no bound if zero)
+	Max time.Duration
+	// Fraction of the delay (0-1) to randomly subtract, spreading retries
+	Jitter float64
+}
+
+func (b ExponentialBackoff) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := float64(b.Base) * math.Pow(2, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay -= delay * math.Min(b.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(delay)
+}
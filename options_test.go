@@ -0,0 +1,94 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/qmktest"
+)
+
+var backoffTests = []struct {
+	Backoff qmk.Backoff
+	Attempt int
+	Delay   time.Duration
+}{
+	/* 0*/ {qmk.ConstantBackoff(0), 1, 0},
+	/* 1*/ {qmk.ConstantBackoff(time.Second), 5, time.Second},
+	/* 2*/ {qmk.ExponentialBackoff{Base: 10 * time.Millisecond}, 1, 10 * time.Millisecond},
+	/* 3*/ {qmk.ExponentialBackoff{Base: 10 * time.Millisecond}, 3, 40 * time.Millisecond},
+	/* 4*/ {qmk.ExponentialBackoff{Base: 10 * time.Millisecond, Max: 50 * time.Millisecond}, 4, 50 * time.Millisecond},
+	/* 5*/ {qmk.ExponentialBackoff{Base: 10 * time.Millisecond, Max: 50 * time.Millisecond}, 40, 50 * time.Millisecond},
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for i, test := range backoffTests {
+		delay := test.Backoff.Delay(test.Attempt)
+		if test.Delay != delay {
+			t.Errorf("[%d] wanted delay %v, got %v", i, test.Delay, delay)
+		}
+	}
+}
+
+func TestExponentialBackoffJitter(t *testing.T) {
+	backoff := qmk.ExponentialBackoff{Base: 100 * time.Millisecond, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		delay := backoff.Delay(2)
+		if delay < 100*time.Millisecond || delay > 200*time.Millisecond {
+			t.Fatalf("wanted delay within [100ms, 200ms], got %v", delay)
+		}
+	}
+}
+
+func TestRetryHook(t *testing.T) {
+	retries := []qmk.Retry{}
+	emulator := qmktest.NewEmulator(qmktest.DefaultConfig)
+	client, err := qmk.NewClientWithTransport(emulator,
+		qmk.WithRetries(3),
+		qmk.WithBackoff(qmk.ConstantBackoff(time.Millisecond)),
+		qmk.WithRetryHook(func(r qmk.Retry) { retries = append(retries, r) }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulator.Close()
+
+	err = client.SaveLighting()
+	var protocolError *qmk.ProtocolError
+	if !errors.As(err, &protocolError) || protocolError.Attempts != 3 {
+		t.Fatalf("wanted failure after 3 attempts, got %v", err)
+	}
+	if len(retries) != 2 {
+		t.Fatalf("wanted %d retries, got %d", 2, len(retries))
+	}
+	for i, retry := range retries {
+		if retry.Attempt != i+1 || retry.Command != qmk.LightingSaveId || retry.Delay != time.Millisecond {
+			t.Errorf("[%d] unexpected retry %+v", i, retry)
+		}
+		if !errors.Is(retry.Err, qmktest.ErrorClosed) {
+			t.Errorf("[%d] wanted retry error %v, got %v", i, qmktest.ErrorClosed, retry.Err)
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	transport := &stallingTransport{qmktest.NewEmulator(qmktest.DefaultConfig), make(chan struct{})}
+	close(transport.stalled)
+	client, err := qmk.NewClientWithTransport(transport, qmk.WithRetries(2), qmk.WithReadTimeout(5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport.stalled = make(chan struct{})
+
+	_, err = client.GetUptime()
+	if !errors.Is(err, qmk.ErrorReadWrite) || !errors.Is(err, qmk.ErrorReadTimeout) {
+		t.Errorf("wanted error %v caused by %v, got %v", qmk.ErrorReadWrite, qmk.ErrorReadTimeout, err)
+	}
+}
@@ -0,0 +1,281 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"sync"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+// protocol describes the commands and keycode encoding of a VIA protocol
+// version, selected after the protocol version handshake
+type protocol struct {
+	version uint16
+	// Command IDs the firmware understands
+	commands map[byte]bool
+	// id_get/set_keyboard_value IDs the firmware understands
+	keyboardValues map[byte]bool
+	// Keycode numbering on the wire
+	keycodes keycodeEncoding
+	// Lighting is reached through id_custom_* channels (v12)
+	customValues bool
+}
+
+func (p *protocol) supports(command byte) bool {
+	return p.commands[command]
+}
+
+func (p *protocol) supportsKeyboardValue(id byte) bool {
+	return p.keyboardValues[id]
+}
+
+var commandsV9 = map[byte]bool{
+	GetProtocolVersionId:              true,
+	GetKeyboardValueId:                true,
+	SetKeyboardValueId:                true,
+	DynamicKeymapGetKeycodeId:         true,
+	DynamicKeymapSetKeycodeId:         true,
+	DynamicKeymapResetId:              true,
+	LightingSetValueId:                true,
+	LightingGetValueId:                true,
+	LightingSaveId:                    true,
+	EepromResetId:                     true,
+	BootloaderJumpId:                  true,
+	DynamicKeymapMacroGetCountId:      true,
+	DynamicKeymapMacroGetBufferSizeId: true,
+	DynamicKeymapMacroGetBufferId:     true,
+	DynamicKeymapMacroSetBufferId:     true,
+	DynamicKeymapMacroResetId:         true,
+	DynamicKeymapGetLayerCountId:      true,
+	DynamicKeymapGetBufferId:          true,
+	DynamicKeymapSetBufferId:          true,
+}
+
+// v10 added dynamic encoder mapping
+var commandsV10 = withIds(commandsV9, DynamicKeymapGetEncoderId, DynamicKeymapSetEncoderId)
+
+var keyboardValuesV9 = map[byte]bool{
+	UptimeId:            true,
+	LayoutOptionsId:     true,
+	SwitchMatrixStateId: true,
+}
+
+// v11 added the firmware version and device indication
+var keyboardValuesV11 = withIds(keyboardValuesV9, FirmwareVersionId, DeviceIndicationId)
+
+func withIds(base map[byte]bool, ids ...byte) map[byte]bool {
+	set := map[byte]bool{}
+	for id := range base {
+		set[id] = true
+	}
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+var protocols = map[uint16]*protocol{
+	ViaProtocolVersion9:  {ViaProtocolVersion9, commandsV9, keyboardValuesV9, legacyKeycodes{}, false},
+	ViaProtocolVersion10: {ViaProtocolVersion10, commandsV10, keyboardValuesV9, legacyKeycodes{}, false},
+	ViaProtocolVersion11: {ViaProtocolVersion11, commandsV10, keyboardValuesV11, legacyKeycodes{}, false},
+	ViaProtocolVersion12: {ViaProtocolVersion12, commandsV10, keyboardValuesV11, keycodesV12{}, true},
+}
+
+// keycodesFor returns the keycode numbering of a protocol version
+func keycodesFor(version uint16) keycodeEncoding {
+	if version >= ViaProtocolVersion12 {
+		return keycodesV12{}
+	}
+	return legacyKeycodes{}
+}
+
+// keycodeEncoding translates between the keycode package numbering and the
+// numbering used by a firmware on the wire
+type keycodeEncoding interface {
+	encode(keycode.Keycode) keycode.Keycode
+	decode(keycode.Keycode) keycode.Keycode
+}
+
+// legacyKeycodes is the pre QMK 0.19 numbering used by the keycode package
+type legacyKeycodes struct{}
+
+func (legacyKeycodes) encode(k keycode.Keycode) keycode.Keycode { return k }
+func (legacyKeycodes) decode(k keycode.Keycode) keycode.Keycode { return k }
+
+// keycodesV12 is the QMK 0.19 renumbering, used from protocol v12. Basic,
+// modified and layer-tap keycodes are unchanged; the rest move. Keycodes
+// without a counterpart in the other numbering, such as QK_USER_0 or the MIDI
+// keycodes, take the places the moved keycodes leave, so that every keycode
+// survives a read and write unchanged.
+type keycodesV12 struct{}
+
+// keycodeRange maps a run of keycodes between legacy and v12 numbering
+type keycodeRange struct {
+	legacy keycode.Keycode
+	v12    keycode.Keycode
+	size   keycode.Keycode
+}
+
+var v12Ranges = []keycodeRange{
+	{0x5010, 0x5200, 0x0010}, // TO(layer)
+	{0x5100, 0x5220, 0x0020}, // MO(layer)
+	{0x5200, 0x5240, 0x0020}, // DF(layer)
+	{0x5300, 0x5260, 0x0020}, // TG(layer)
+	{0x5400, 0x5280, 0x0020}, // OSL(layer)
+	{0x5500, 0x52A0, 0x0020}, // OSM(mod)
+	{0x5800, 0x52C0, 0x0020}, // TT(layer)
+	{0x5B00, 0x5600, 0x0100}, // SH_T(kc) and SH_TG to SH_OS
+	{0x6000, 0x2000, 0x2000}, // MT(mod, kc)
+	{keycode.FN_MO13, 0x7C77, 2},
+	{keycode.MACRO00, 0x7700, 16},
+	{keycode.USER00, 0x7E00, 16},
+}
+
+// v12Quantum maps the legacy quantum keycodes from 0x5C00, which v12 splits
+// into the magic, audio, backlight, RGB and QK_BOOT blocks in a new order
+var v12Quantum = map[keycode.Keycode]keycode.Keycode{
+	0x5C00: 0x7C00, // RESET, QK_BOOT
+	0x5C01: 0x7C02, // DEBUG, QK_DEBUG_TOGGLE
+	// Magic
+	0x5C02: 0x7000, // MAGIC_SWAP_CONTROL_CAPSLOCK
+	0x5C03: 0x7004, // MAGIC_CAPSLOCK_TO_CONTROL
+	0x5C04: 0x7005, // MAGIC_SWAP_LALT_LGUI
+	0x5C05: 0x7007, // MAGIC_SWAP_RALT_RGUI
+	0x5C06: 0x700A, // MAGIC_NO_GUI
+	0x5C07: 0x700C, // MAGIC_SWAP_GRAVE_ESC
+	0x5C08: 0x700E, // MAGIC_SWAP_BACKSLASH_BACKSPACE
+	0x5C09: 0x7011, // MAGIC_HOST_NKRO
+	0x5C0A: 0x7014, // MAGIC_SWAP_ALT_GUI
+	0x5C0B: 0x7001, // MAGIC_UNSWAP_CONTROL_CAPSLOCK
+	0x5C0C: 0x7003, // MAGIC_UNCAPSLOCK_TO_CONTROL
+	0x5C0D: 0x7006, // MAGIC_UNSWAP_LALT_LGUI
+	0x5C0E: 0x7008, // MAGIC_UNSWAP_RALT_RGUI
+	0x5C0F: 0x7009, // MAGIC_UNNO_GUI
+	0x5C10: 0x700D, // MAGIC_UNSWAP_GRAVE_ESC
+	0x5C11: 0x700F, // MAGIC_UNSWAP_BACKSLASH_BACKSPACE
+	0x5C12: 0x7012, // MAGIC_UNHOST_NKRO
+	0x5C13: 0x7015, // MAGIC_UNSWAP_ALT_GUI
+	0x5C14: 0x7013, // MAGIC_TOGGLE_NKRO
+	0x5C15: 0x7016, // MAGIC_TOGGLE_ALT_GUI
+	0x5C16: 0x7C16, // GRAVE_ESC
+	// Auto shift
+	0x5C17: 0x7C11, // KC_ASUP
+	0x5C18: 0x7C10, // KC_ASDN
+	0x5C19: 0x7C12, // KC_ASRP
+	0x5C1A: 0x7C15, // KC_ASTG
+	0x5C1B: 0x7C13, // KC_ASON
+	0x5C1C: 0x7C14, // KC_ASOFF
+	// Audio, clicky and music
+	0x5C1D: 0x7480, // AU_ON
+	0x5C1E: 0x7481, // AU_OFF
+	0x5C1F: 0x7482, // AU_TOG
+	0x5C20: 0x748A, // CLICKY_TOGGLE
+	0x5C21: 0x748B, // CLICKY_ENABLE
+	0x5C22: 0x748C, // CLICKY_DISABLE
+	0x5C23: 0x748D, // CLICKY_UP
+	0x5C24: 0x748E, // CLICKY_DOWN
+	0x5C25: 0x748F, // CLICKY_RESET
+	0x5C26: 0x7490, // MU_ON
+	0x5C27: 0x7491, // MU_OFF
+	0x5C28: 0x7492, // MU_TOG
+	0x5C29: 0x7493, // MU_MOD
+	0x5C2A: 0x7494, // MUV_IN
+	0x5C2B: 0x7495, // MUV_DE
+	// Backlight
+	0x5CBB: 0x7800, // BL_ON
+	0x5CBC: 0x7801, // BL_OFF
+	0x5CBD: 0x7803, // BL_DEC
+	0x5CBE: 0x7804, // BL_INC
+	0x5CBF: 0x7802, // BL_TOGG
+	0x5CC0: 0x7805, // BL_STEP
+	0x5CC1: 0x7806, // BL_BRTG
+	// RGB lighting
+	0x5CC2: 0x7820, // RGB_TOG
+	0x5CC3: 0x7821, // RGB_MOD
+	0x5CC4: 0x7822, // RGB_RMOD
+	0x5CC5: 0x7823, // RGB_HUI
+	0x5CC6: 0x7824, // RGB_HUD
+	0x5CC7: 0x7825, // RGB_SAI
+	0x5CC8: 0x7826, // RGB_SAD
+	0x5CC9: 0x7827, // RGB_VAI
+	0x5CCA: 0x7828, // RGB_VAD
+	0x5CCB: 0x7829, // RGB_SPI
+	0x5CCC: 0x782A, // RGB_SPD
+	0x5CCD: 0x782B, // RGB_M_P
+	0x5CCE: 0x782C, // RGB_M_B
+	0x5CCF: 0x782D, // RGB_M_R
+	0x5CD0: 0x782E, // RGB_M_SW
+	0x5CD1: 0x782F, // RGB_M_SN
+	0x5CD2: 0x7830, // RGB_M_K
+	0x5CD3: 0x7831, // RGB_M_X
+	0x5CD4: 0x7832, // RGB_M_G
+	0x5CD5: 0x7833, // RGB_M_T
+	// Space cadet
+	0x5CD7: 0x7C1A, // KC_LSPO
+	0x5CD8: 0x7C1B, // KC_RSPC
+	0x5CD9: 0x7C1E, // KC_SFTENT
+	0x5CF3: 0x7C18, // KC_LCPO
+	0x5CF4: 0x7C19, // KC_RCPC
+	0x5CF5: 0x7C1C, // KC_LAPO
+	0x5CF6: 0x7C1D, // KC_RAPC
+}
+
+// v12Tables holds keycodesV12 as lookup tables, built on first use
+var v12Tables struct {
+	once   sync.Once
+	encode [0x10000]keycode.Keycode
+	decode [0x10000]keycode.Keycode
+}
+
+func buildV12Tables() {
+	var mapped, used [0x10000]bool
+	set := func(legacy keycode.Keycode, v12 keycode.Keycode) {
+		v12Tables.encode[legacy], v12Tables.decode[v12] = v12, legacy
+		mapped[legacy], used[v12] = true, true
+	}
+	// LM(layer, mod) packs a 4 bit mod after the layer, v12 a 5 bit mod
+	for k := keycode.Keycode(0x5900); k < 0x5A00; k++ {
+		set(k, 0x5000|(k&0xF0)<<1|k&0x0F)
+	}
+	for _, r := range v12Ranges {
+		for i := keycode.Keycode(0); i < r.size; i++ {
+			set(r.legacy+i, r.v12+i)
+		}
+	}
+	for legacy, v12 := range v12Quantum {
+		set(legacy, v12)
+	}
+
+	// Legacy keycodes displaced by a moved keycode take, in order, the v12
+	// keycodes left free by one
+	var displaced, free []keycode.Keycode
+	for i := 0; i < 0x10000; i++ {
+		k := keycode.Keycode(i)
+		switch {
+		case !mapped[k] && !used[k]:
+			v12Tables.encode[k], v12Tables.decode[k] = k, k
+		case !mapped[k]:
+			displaced = append(displaced, k)
+		case !used[k]:
+			free = append(free, k)
+		}
+	}
+	for i, k := range displaced {
+		v12Tables.encode[k], v12Tables.decode[free[i]] = free[i], k
+	}
+}
+
+func (keycodesV12) encode(k keycode.Keycode) keycode.Keycode {
+	v12Tables.once.Do(buildV12Tables)
+	return v12Tables.encode[k]
+}
+
+func (keycodesV12) decode(k keycode.Keycode) keycode.Keycode {
+	v12Tables.once.Do(buildV12Tables)
+	return v12Tables.decode[k]
+}
@@ -0,0 +1,96 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"testing"
+
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var keycodesV12Tests = []struct {
+	Legacy keycode.Keycode
+	V12    keycode.Keycode
+}{
+	/* 0*/ {keycode.KC_A, keycode.KC_A},
+	/* 1*/ {0x0204, 0x0204}, // LSFT(KC_A)
+	/* 2*/ {0x412C, 0x412C}, // LT(1, KC_SPC)
+	/* 3*/ {0x5012, 0x5202}, // TO(2)
+	/* 4*/ {0x5101, 0x5221}, // MO(1)
+	/* 5*/ {0x5203, 0x5243}, // DF(3)
+	/* 6*/ {0x5304, 0x5264}, // TG(4)
+	/* 7*/ {0x5405, 0x5285}, // OSL(5)
+	/* 8*/ {0x5502, 0x52A2}, // OSM(MOD_LSFT)
+	/* 9*/ {0x5806, 0x52C6}, // TT(6)
+	/*10*/ {0x5921, 0x5041}, // LM(2, MOD_LCTL)
+	/*11*/ {0x6129, 0x2129}, // MT(MOD_LCTL, KC_ESC)
+	/*12*/ {keycode.FN_MO13, 0x7C77},
+	/*13*/ {keycode.FN_MO23, 0x7C78},
+	/*14*/ {keycode.MACRO00, 0x7700},
+	/*15*/ {keycode.MACRO15, 0x770F},
+	/*16*/ {keycode.USER00, 0x7E00},
+	/*17*/ {keycode.USER15, 0x7E0F},
+	/*18*/ {0x5B04, 0x5604}, // SH_T(KC_A)
+	/*19*/ {0x5BF0, 0x56F0}, // SH_TG
+	/*20*/ {0x5BF6, 0x56F6}, // SH_OS
+	/*21*/ {0x5C00, 0x7C00}, // RESET, QK_BOOT
+	/*22*/ {0x5C14, 0x7013}, // MAGIC_TOGGLE_NKRO
+	/*23*/ {0x5C1F, 0x7482}, // AU_TOG
+	/*24*/ {0x5CBF, 0x7802}, // BL_TOGG
+	/*25*/ {0x5CC2, 0x7820}, // RGB_TOG
+	/*26*/ {0x5CD7, 0x7C1A}, // KC_LSPO
+}
+
+func TestKeycodesV12(t *testing.T) {
+	codec := keycodesV12{}
+	for i, test := range keycodesV12Tests {
+		if encoded := codec.encode(test.Legacy); encoded != test.V12 {
+			t.Errorf("[%d] wanted v12 keycode 0x%04x, got 0x%04x", i, uint16(test.V12), uint16(encoded))
+		}
+		if decoded := codec.decode(test.V12); decoded != test.Legacy {
+			t.Errorf("[%d] wanted legacy keycode 0x%04x, got 0x%04x", i, uint16(test.Legacy), uint16(decoded))
+		}
+	}
+}
+
+func TestKeycodesV12RoundTrip(t *testing.T) {
+	codec := keycodesV12{}
+	for i := 0; i < 0x10000; i++ {
+		k := keycode.Keycode(i)
+		if got := codec.encode(codec.decode(k)); got != k {
+			t.Errorf("v12 keycode 0x%04x came back as 0x%04x", i, uint16(got))
+		}
+		if got := codec.decode(codec.encode(k)); got != k {
+			t.Errorf("legacy keycode 0x%04x came back as 0x%04x", i, uint16(got))
+		}
+	}
+}
+
+func TestProtocolTable(t *testing.T) {
+	for version := uint16(MinViaProtocolVersion); version <= MaxViaProtocolVersion; version++ {
+		p, ok := protocols[version]
+		if !ok {
+			t.Errorf("no protocol for version 0x%04x", version)
+			continue
+		}
+		if p.version != version {
+			t.Errorf("wanted protocol version 0x%04x, got 0x%04x", version, p.version)
+		}
+		if !p.supports(GetProtocolVersionId) {
+			t.Errorf("protocol 0x%04x does not support the version handshake", version)
+		}
+	}
+	if protocols[ViaProtocolVersion9].supports(DynamicKeymapGetEncoderId) {
+		t.Error("protocol v9 should not support encoders")
+	}
+	if protocols[ViaProtocolVersion10].supportsKeyboardValue(FirmwareVersionId) {
+		t.Error("protocol v10 should not support the firmware version")
+	}
+	if !protocols[ViaProtocolVersion12].supportsKeyboardValue(DeviceIndicationId) {
+		t.Error("protocol v12 should support device indication")
+	}
+}
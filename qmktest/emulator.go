@@ -0,0 +1,623 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+// Package qmktest provides an in-process VIA keyboard for testing qmk clients
+// without hardware attached.
+package qmktest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/keycode"
+)
+
+var (
+	ErrorClosed    = errors.New("emulator is closed")
+	ErrorNoData    = errors.New("no response pending")
+	ErrorUnplugged = errors.New("emulator is unplugged")
+)
+
+// Config describes the emulated keyboard
+type Config struct {
+	// Device information reported through the transport
+	Keyboard qmk.Keyboard
+	// VIA protocol version (defaults to qmk.ViaProtocolVersion)
+	ProtocolVersion uint16
+	// Reported through id_firmware_version (v11)
+	FirmwareVersion uint32
+
+	// Dynamic keymap dimensions
+	Layers uint8
+	Rows   uint8
+	Cols   uint8
+	// Default keymap in layer, row, column order (zero filled if short)
+	Keymap []keycode.Keycode
+	// Rotary encoders in the dynamic encoder map (v10)
+	Encoders uint8
+
+	// Dynamic macro count and EEPROM buffer size
+	MacroCount      uint8
+	MacroBufferSize uint16
+
+	// Lighting subsystems which answer id_lighting_get/set_value, or their
+	// id_custom_* channels from protocol v12. As in QMK before v12, with
+	// either one every id_lighting_get/set_value is answered, values of the
+	// other echoed unchanged.
+	Backlight bool
+	Rgblight  bool
+	// Audio, RGB matrix and LED matrix channels (v12)
+	Audio     bool
+	RgbMatrix bool
+	LedMatrix bool
+	// Keyboard-specific custom channel values by value ID (v12)
+	CustomValues map[uint8][]byte
+	// Whether id_bootloader_jump is honoured, unplugging the emulator once
+	// its reply has been read
+	BootloaderJump bool
+}
+
+// DefaultConfig is a small keyboard with every feature enabled
+var DefaultConfig = Config{
+	Layers:          4,
+	Rows:            4,
+	Cols:            12,
+	Encoders:        2,
+	MacroCount:      16,
+	MacroBufferSize: 512,
+	Backlight:       true,
+	Rgblight:        true,
+	BootloaderJump:  true,
+}
+
+// Emulator is an in-memory VIA keyboard which implements qmk.Transport
+type Emulator struct {
+	mu sync.Mutex
+
+	config     Config
+	started    time.Time
+	closed     bool
+	unplugged  bool
+	bootloader bool
+
+	keymap        []byte
+	encoders      []byte
+	macros        []byte
+	lighting      map[byte][]byte
+	custom        map[[2]byte][]byte
+	layoutOptions uint32
+	switchMatrix  []byte
+
+	lightingSaves int
+	indications   int
+	commands      []byte
+	pending       [][]byte
+}
+
+// NewEmulator creates an emulated keyboard with a freshly reset EEPROM
+func NewEmulator(config Config) *Emulator {
+	if config.ProtocolVersion == 0 {
+		config.ProtocolVersion = qmk.ViaProtocolVersion
+	}
+	if config.Keyboard.Path == "" {
+		config.Keyboard.Path = "qmktest"
+	}
+	if config.Keyboard.Product == "" {
+		config.Keyboard.Product = "qmktest emulator"
+	}
+	config.Keyboard.UsagePage = qmk.HidUsagePage
+	config.Keyboard.Usage = qmk.HidUsage
+
+	e := &Emulator{
+		config:       config,
+		started:      time.Now(),
+		switchMatrix: make([]byte, int(config.Rows)*matrixRowSize(config.Cols)),
+	}
+	e.resetKeymap()
+	e.resetMacros()
+	e.resetLighting()
+	return e
+}
+
+func matrixRowSize(cols uint8) int {
+	return (int(cols) + 7) / 8
+}
+
+func (e *Emulator) resetKeymap() {
+	size := int(e.config.Layers) * int(e.config.Rows) * int(e.config.Cols)
+	e.keymap = make([]byte, size*2)
+	for i := 0; i < size && i < len(e.config.Keymap); i++ {
+		copy(e.keymap[i*2:], e.config.Keymap[i].ToBytes())
+	}
+	e.encoders = make([]byte, int(e.config.Layers)*int(e.config.Encoders)*2*2)
+}
+
+func (e *Emulator) resetMacros() {
+	e.macros = make([]byte, e.config.MacroBufferSize)
+}
+
+func (e *Emulator) resetLighting() {
+	e.lighting = map[byte][]byte{}
+	if e.config.Backlight {
+		e.lighting[qmk.BacklightBrightnessId] = []byte{0}
+		e.lighting[qmk.BacklightEffectId] = []byte{0}
+	}
+	if e.config.Rgblight {
+		e.lighting[qmk.RgblightBrightnessId] = []byte{0}
+		e.lighting[qmk.RgblightEffectId] = []byte{0}
+		e.lighting[qmk.RgblightEffectSpeedId] = []byte{0}
+		e.lighting[qmk.RgblightColorId] = []byte{0, 0}
+	}
+
+	e.custom = map[[2]byte][]byte{}
+	if e.config.Audio {
+		e.custom[[2]byte{qmk.AudioChannelId, qmk.QmkAudioEnableId}] = []byte{0}
+		e.custom[[2]byte{qmk.AudioChannelId, qmk.QmkAudioClickyEnableId}] = []byte{0}
+	}
+	if e.config.RgbMatrix {
+		e.custom[[2]byte{qmk.RgbMatrixChannelId, qmk.QmkRgbMatrixBrightnessId}] = []byte{0}
+		e.custom[[2]byte{qmk.RgbMatrixChannelId, qmk.QmkRgbMatrixEffectId}] = []byte{0}
+		e.custom[[2]byte{qmk.RgbMatrixChannelId, qmk.QmkRgbMatrixEffectSpeedId}] = []byte{0}
+		e.custom[[2]byte{qmk.RgbMatrixChannelId, qmk.QmkRgbMatrixColorId}] = []byte{0, 0}
+	}
+	if e.config.LedMatrix {
+		e.custom[[2]byte{qmk.LedMatrixChannelId, qmk.QmkLedMatrixBrightnessId}] = []byte{0}
+		e.custom[[2]byte{qmk.LedMatrixChannelId, qmk.QmkLedMatrixEffectId}] = []byte{0}
+		e.custom[[2]byte{qmk.LedMatrixChannelId, qmk.QmkLedMatrixEffectSpeedId}] = []byte{0}
+	}
+	for id, value := range e.config.CustomValues {
+		e.custom[[2]byte{qmk.CustomChannelId, id}] = append([]byte{}, value...)
+	}
+	// v12 channels share storage with the legacy lighting values
+	for legacy, channel := range lightingChannels {
+		if value, ok := e.lighting[legacy]; ok {
+			e.custom[channel] = value
+		}
+	}
+}
+
+var lightingChannels = map[byte][2]byte{
+	qmk.BacklightBrightnessId: {qmk.BacklightChannelId, qmk.QmkBacklightBrightnessId},
+	qmk.BacklightEffectId:     {qmk.BacklightChannelId, qmk.QmkBacklightEffectId},
+	qmk.RgblightBrightnessId:  {qmk.RgblightChannelId, qmk.QmkRgblightBrightnessId},
+	qmk.RgblightEffectId:      {qmk.RgblightChannelId, qmk.QmkRgblightEffectId},
+	qmk.RgblightEffectSpeedId: {qmk.RgblightChannelId, qmk.QmkRgblightEffectSpeedId},
+	qmk.RgblightColorId:       {qmk.RgblightChannelId, qmk.QmkRgblightColorId},
+}
+
+// Write handles a single VIA command and queues the response for Read
+func (e *Emulator) Write(b []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.ioError(); err != nil {
+		return 0, err
+	}
+	if e.bootloader {
+		return 0, ErrorUnplugged
+	}
+	message := make([]byte, qmk.HidMessageSize)
+	copy(message, b)
+	e.commands = append(e.commands, message[0])
+	// Like QMK, the keyboard echoes id_bootloader_jump and resets into its
+	// bootloader once the reply has gone out
+	if message[0] == qmk.BootloaderJumpId && e.config.BootloaderJump {
+		e.bootloader = true
+		e.pending = append(e.pending, message)
+		return len(b), nil
+	}
+	e.handle(message)
+	e.pending = append(e.pending, message)
+	return len(b), nil
+}
+
+// Read returns the oldest queued response
+func (e *Emulator) Read(b []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.ioError(); err != nil {
+		return 0, err
+	}
+	if len(e.pending) == 0 {
+		return 0, ErrorNoData
+	}
+	message := e.pending[0]
+	e.pending = e.pending[1:]
+	if e.bootloader && len(e.pending) == 0 {
+		e.unplugged = true
+	}
+	return copy(b, message), nil
+}
+
+func (e *Emulator) ioError() error {
+	if e.unplugged {
+		return ErrorUnplugged
+	}
+	if e.closed {
+		return ErrorClosed
+	}
+	return nil
+}
+
+// Unplug detaches the keyboard, failing all I/O until Plug is called
+func (e *Emulator) Unplug() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.unplugged = true
+	e.pending = nil
+}
+
+// Plug reattaches the keyboard. Like a freshly enumerated device, it is open
+// again, and EEPROM contents are kept.
+func (e *Emulator) Plug() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.unplugged = false
+	e.bootloader = false
+	e.closed = false
+	e.started = time.Now()
+}
+
+// InBootloader reports whether the emulator has jumped to its bootloader and
+// not since been plugged back in
+func (e *Emulator) InBootloader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.bootloader
+}
+
+// Close marks the emulator as closed, failing all further I/O
+func (e *Emulator) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.closed = true
+	e.pending = nil
+	return nil
+}
+
+// DeviceInfo returns the configured keyboard information
+func (e *Emulator) DeviceInfo() qmk.Keyboard {
+	return e.config.Keyboard
+}
+
+// Keycode returns the raw keycode stored in the emulated EEPROM, in the
+// numbering of the emulated protocol version
+func (e *Emulator) Keycode(layer uint8, row uint8, col uint8) keycode.Keycode {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	offset, ok := e.keycodeOffset(layer, row, col)
+	if !ok {
+		return keycode.KC_NO
+	}
+	return keycode.KeycodeFromBytes(e.keymap[offset], e.keymap[offset+1])
+}
+
+// Encoder returns the raw keycode an encoder sends when turned, in the
+// numbering of the emulated protocol version
+func (e *Emulator) Encoder(layer uint8, encoder uint8, clockwise bool) keycode.Keycode {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var direction uint8
+	if clockwise {
+		direction = 1
+	}
+	offset, ok := e.encoderOffset(layer, encoder, direction)
+	if !ok {
+		return keycode.KC_NO
+	}
+	return keycode.KeycodeFromBytes(e.encoders[offset], e.encoders[offset+1])
+}
+
+// MacroBuffer returns a copy of the emulated macro EEPROM
+func (e *Emulator) MacroBuffer() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]byte{}, e.macros...)
+}
+
+// Lighting returns the raw value stored for a lighting value ID
+func (e *Emulator) Lighting(id byte) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]byte{}, e.lighting[id]...)
+}
+
+// CustomValue returns the raw value stored for a v12 channel and value ID
+func (e *Emulator) CustomValue(channel byte, id byte) []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]byte{}, e.custom[[2]byte{channel, id}]...)
+}
+
+// LightingSaves returns the number of id_lighting_save (or v12 id_custom_save)
+// commands received
+func (e *Emulator) LightingSaves() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.lightingSaves
+}
+
+// Indications returns the number of id_device_indication commands received
+func (e *Emulator) Indications() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.indications
+}
+
+// SetSwitchMatrixState sets the pressed state of a switch
+func (e *Emulator) SetSwitchMatrixState(row uint8, col uint8, pressed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if row >= e.config.Rows || col >= e.config.Cols {
+		return
+	}
+	size := matrixRowSize(e.config.Cols)
+	index := int(row)*size + size - 1 - int(col)/8
+	mask := byte(1 << (col % 8))
+	if pressed {
+		e.switchMatrix[index] |= mask
+	} else {
+		e.switchMatrix[index] &^= mask
+	}
+}
+
+// Commands returns the command IDs received, in order
+func (e *Emulator) Commands() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]byte{}, e.commands...)
+}
+
+func (e *Emulator) keycodeOffset(layer uint8, row uint8, col uint8) (int, bool) {
+	if layer >= e.config.Layers || row >= e.config.Rows || col >= e.config.Cols {
+		return 0, false
+	}
+	index := (int(layer)*int(e.config.Rows)+int(row))*int(e.config.Cols) + int(col)
+	return index * 2, true
+}
+
+// encoderOffset locates an encoder direction in the encoder map, clockwise
+// first as in QMK
+func (e *Emulator) encoderOffset(layer uint8, encoder uint8, clockwise uint8) (int, bool) {
+	if layer >= e.config.Layers || encoder >= e.config.Encoders {
+		return 0, false
+	}
+	index := (int(layer)*int(e.config.Encoders) + int(encoder)) * 2
+	if clockwise == 0 {
+		index++
+	}
+	return index * 2, true
+}
+
+// switchMatrixLimit is the largest switch matrix QMK reports over VIA
+const switchMatrixLimit = 28
+
+func (e *Emulator) handle(message []byte) {
+	if e.config.ProtocolVersion >= qmk.ViaProtocolVersion12 {
+		switch message[0] {
+		case qmk.CustomGetValueId, qmk.CustomSetValueId, qmk.CustomSaveId:
+			e.handleCustom(message)
+			return
+		}
+	}
+
+	switch message[0] {
+	case qmk.GetProtocolVersionId:
+		message[1] = byte(e.config.ProtocolVersion >> 8)
+		message[2] = byte(e.config.ProtocolVersion)
+
+	case qmk.GetKeyboardValueId:
+		switch message[1] {
+		case qmk.UptimeId:
+			putUint32(message[2:], uint32(time.Since(e.started)/time.Millisecond))
+		case qmk.LayoutOptionsId:
+			putUint32(message[2:], e.layoutOptions)
+		case qmk.SwitchMatrixStateId:
+			if len(e.switchMatrix) > switchMatrixLimit {
+				message[0] = qmk.UnhandledId
+				break
+			}
+			copy(message[2:], e.switchMatrix)
+		case qmk.FirmwareVersionId:
+			if e.config.ProtocolVersion < qmk.ViaProtocolVersion11 {
+				message[0] = qmk.UnhandledId
+				break
+			}
+			putUint32(message[2:], e.config.FirmwareVersion)
+		default:
+			message[0] = qmk.UnhandledId
+		}
+
+	case qmk.SetKeyboardValueId:
+		switch message[1] {
+		case qmk.LayoutOptionsId:
+			e.layoutOptions = getUint32(message[2:])
+		case qmk.DeviceIndicationId:
+			if e.config.ProtocolVersion < qmk.ViaProtocolVersion11 {
+				message[0] = qmk.UnhandledId
+				break
+			}
+			e.indications++
+		default:
+			message[0] = qmk.UnhandledId
+		}
+
+	case qmk.DynamicKeymapGetKeycodeId:
+		message[4], message[5] = 0, 0
+		if offset, ok := e.keycodeOffset(message[1], message[2], message[3]); ok {
+			copy(message[4:6], e.keymap[offset:])
+		}
+
+	case qmk.DynamicKeymapSetKeycodeId:
+		if offset, ok := e.keycodeOffset(message[1], message[2], message[3]); ok {
+			copy(e.keymap[offset:offset+2], message[4:6])
+		}
+
+	case qmk.DynamicKeymapResetId:
+		e.resetKeymap()
+
+	case qmk.LightingGetValueId:
+		if len(e.lighting) == 0 {
+			message[0] = qmk.UnhandledId
+			break
+		}
+		if value, ok := e.lighting[message[1]]; ok {
+			copy(message[2:], value)
+		}
+
+	case qmk.LightingSetValueId:
+		if len(e.lighting) == 0 {
+			message[0] = qmk.UnhandledId
+			break
+		}
+		if value, ok := e.lighting[message[1]]; ok {
+			copy(value, message[2:])
+		}
+
+	case qmk.LightingSaveId:
+		if len(e.lighting) == 0 {
+			message[0] = qmk.UnhandledId
+			break
+		}
+		e.lightingSaves++
+
+	case qmk.EepromResetId:
+		e.resetKeymap()
+		e.resetMacros()
+		e.resetLighting()
+		e.layoutOptions = 0
+
+	case qmk.DynamicKeymapMacroGetCountId:
+		message[1] = e.config.MacroCount
+
+	case qmk.DynamicKeymapMacroGetBufferSizeId:
+		message[1] = byte(e.config.MacroBufferSize >> 8)
+		message[2] = byte(e.config.MacroBufferSize)
+
+	case qmk.DynamicKeymapMacroGetBufferId:
+		getBuffer(message, e.macros)
+
+	case qmk.DynamicKeymapMacroSetBufferId:
+		setBuffer(message, e.macros)
+
+	case qmk.DynamicKeymapMacroResetId:
+		e.resetMacros()
+
+	case qmk.DynamicKeymapGetLayerCountId:
+		message[1] = e.config.Layers
+
+	case qmk.DynamicKeymapGetBufferId:
+		getBuffer(message, e.keymap)
+
+	case qmk.DynamicKeymapSetBufferId:
+		setBuffer(message, e.keymap)
+
+	case qmk.DynamicKeymapGetEncoderId, qmk.DynamicKeymapSetEncoderId:
+		if e.config.ProtocolVersion < qmk.ViaProtocolVersion10 || e.config.Encoders == 0 {
+			message[0] = qmk.UnhandledId
+			break
+		}
+		offset, ok := e.encoderOffset(message[1], message[2], message[3])
+		if message[0] == qmk.DynamicKeymapGetEncoderId {
+			message[4], message[5] = 0, 0
+			if ok {
+				copy(message[4:6], e.encoders[offset:])
+			}
+		} else if ok {
+			copy(e.encoders[offset:offset+2], message[4:6])
+		}
+
+	default:
+		message[0] = qmk.UnhandledId
+	}
+}
+
+func (e *Emulator) handleCustom(message []byte) {
+	channel := message[1]
+	if !e.hasChannel(channel) {
+		message[0] = qmk.UnhandledId
+		return
+	}
+	if message[0] == qmk.CustomSaveId {
+		e.lightingSaves++
+		return
+	}
+
+	value, ok := e.custom[[2]byte{channel, message[2]}]
+	if !ok {
+		message[0] = qmk.UnhandledId
+		return
+	}
+	if message[0] == qmk.CustomGetValueId {
+		copy(message[3:], value)
+	} else {
+		copy(value, message[3:])
+	}
+}
+
+func (e *Emulator) hasChannel(channel byte) bool {
+	for key := range e.custom {
+		if key[0] == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// getBuffer copies EEPROM into a buffer response (overrun reads return 0x00)
+func getBuffer(message []byte, eeprom []byte) {
+	offset, size := bufferRange(message)
+	for i := 0; i < size; i++ {
+		message[4+i] = 0
+		if offset+i < len(eeprom) {
+			message[4+i] = eeprom[offset+i]
+		}
+	}
+}
+
+// setBuffer copies a buffer request into EEPROM (overrun writes are noop)
+func setBuffer(message []byte, eeprom []byte) {
+	offset, size := bufferRange(message)
+	for i := 0; i < size && offset+i < len(eeprom); i++ {
+		eeprom[offset+i] = message[4+i]
+	}
+}
+
+func bufferRange(message []byte) (int, int) {
+	offset := int(message[1])<<8 | int(message[2])
+	size := int(message[3])
+	if size > qmk.MaxDynamicKeymapBufferSize {
+		size = qmk.MaxDynamicKeymapBufferSize
+	}
+	return offset, size
+}
+
+func putUint32(b []byte, value uint32) {
+	b[0] = byte(value >> 24)
+	b[1] = byte(value >> 16)
+	b[2] = byte(value >> 8)
+	b[3] = byte(value)
+}
+
+func getUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
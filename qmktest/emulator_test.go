@@ -0,0 +1,91 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmktest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go"
+)
+
+func roundTrip(t *testing.T, e *Emulator, request ...byte) []byte {
+	t.Helper()
+	message := make([]byte, qmk.HidMessageSize)
+	copy(message, request)
+	if _, err := e.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Read(message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestUnknownCommand(t *testing.T) {
+	e := NewEmulator(DefaultConfig)
+	if response := roundTrip(t, e, 0x7E); response[0] != qmk.UnhandledId {
+		t.Errorf("wanted command 0x%02x, got 0x%02x", qmk.UnhandledId, response[0])
+	}
+}
+
+func TestBufferOverrun(t *testing.T) {
+	config := DefaultConfig
+	config.MacroBufferSize = 4
+	e := NewEmulator(config)
+
+	roundTrip(t, e, qmk.DynamicKeymapMacroSetBufferId, 0, 2, 4, 'a', 'b', 'c', 'd')
+	response := roundTrip(t, e, qmk.DynamicKeymapMacroGetBufferId, 0, 0, 6)
+	if want := []byte{0, 0, 'a', 'b', 0, 0}; !bytes.Equal(response[4:10], want) {
+		t.Errorf("wanted macro buffer %v, got %v", want, response[4:10])
+	}
+}
+
+func TestClose(t *testing.T) {
+	e := NewEmulator(DefaultConfig)
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Write(make([]byte, qmk.HidMessageSize)); !errors.Is(err, ErrorClosed) {
+		t.Errorf("wanted error %v, got %v", ErrorClosed, err)
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	config := DefaultConfig
+	config.ProtocolVersion = qmk.ViaProtocolVersion10
+	e := NewEmulator(config)
+
+	roundTrip(t, e, qmk.DynamicKeymapSetEncoderId, 1, 1, 0, 0x00, 0x81)
+	response := roundTrip(t, e, qmk.DynamicKeymapGetEncoderId, 1, 1, 0)
+	if want := []byte{0x00, 0x81}; !bytes.Equal(response[4:6], want) {
+		t.Errorf("wanted encoder keycode %v, got %v", want, response[4:6])
+	}
+	response = roundTrip(t, e, qmk.DynamicKeymapGetEncoderId, 1, 1, 1)
+	if want := []byte{0x00, 0x00}; !bytes.Equal(response[4:6], want) {
+		t.Errorf("wanted clockwise keycode %v, got %v", want, response[4:6])
+	}
+
+	e = NewEmulator(DefaultConfig)
+	if response := roundTrip(t, e, qmk.DynamicKeymapGetEncoderId, 0, 0, 1); response[0] != qmk.UnhandledId {
+		t.Errorf("wanted command 0x%02x before v10, got 0x%02x", qmk.UnhandledId, response[0])
+	}
+}
+
+func TestBootloaderJump(t *testing.T) {
+	e := NewEmulator(DefaultConfig)
+	if response := roundTrip(t, e, qmk.BootloaderJumpId); response[0] != qmk.BootloaderJumpId {
+		t.Errorf("wanted command 0x%02x, got 0x%02x", qmk.BootloaderJumpId, response[0])
+	}
+	if !e.InBootloader() {
+		t.Error("wanted emulator in bootloader")
+	}
+	if _, err := e.Read(make([]byte, qmk.HidMessageSize)); !errors.Is(err, ErrorUnplugged) {
+		t.Errorf("wanted error %v, got %v", ErrorUnplugged, err)
+	}
+}
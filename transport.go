@@ -0,0 +1,156 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"context"
+	"time"
+
+	"github.com/karalabe/hid"
+)
+
+// How long Close waits for an abandoned read to finish
+const hidCloseTimeout = time.Second
+
+// Transport carries raw VIA reports between a Client and a keyboard
+type Transport interface {
+	// Write a single HidMessageSize report to the device
+	Write([]byte) (int, error)
+	// Read a single HidMessageSize report from the device
+	Read([]byte) (int, error)
+	// Release the underlying device. Unless the transport is a
+	// ContextReader, Close may be called while an abandoned Read is still
+	// blocked, and should make that Read return.
+	Close() error
+	// Describe the underlying device
+	DeviceInfo() Keyboard
+}
+
+// ContextReader is implemented by transports which can abandon a blocked
+// read when a context is done. Transports without it are read in a goroutine,
+// one read at a time.
+type ContextReader interface {
+	ReadContext(context.Context, []byte) (int, error)
+}
+
+// hidTransport is the default Transport, backed by karalabe/hid. Like every
+// transport it is only used by one transaction at a time.
+type hidTransport struct {
+	device *hid.Device
+	// An abandoned read, which is collected before starting another, or
+	// before closing
+	inflight chan pendingRead
+}
+
+// pendingRead is the result of a background read
+type pendingRead struct {
+	report []byte
+	n      int
+	err    error
+}
+
+func openHidTransport(keyboard Keyboard) (Transport, error) {
+	device, err := keyboard.hidInfo().Open()
+	if err != nil {
+		return nil, err
+	}
+	return &hidTransport{device: device}, nil
+}
+
+func (t *hidTransport) Write(b []byte) (int, error) {
+	return t.device.Write(b)
+}
+
+func (t *hidTransport) Read(b []byte) (int, error) {
+	return t.ReadContext(context.Background(), b)
+}
+
+// ReadContext reads in the background so that hid.Device.Read, which blocks
+// without a timeout, can be abandoned. At most one read is ever outstanding.
+func (t *hidTransport) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if t.inflight == nil {
+		reads := make(chan pendingRead, 1)
+		t.inflight = reads
+		go func(size int) {
+			report := make([]byte, size)
+			n, err := t.device.Read(report)
+			reads <- pendingRead{report, n, err}
+		}(len(b))
+	}
+	select {
+	case read := <-t.inflight:
+		t.inflight = nil
+		return copy(b, read.report[:read.n]), read.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Close releases the device once an abandoned read has finished, as
+// hid.Device would free the device under a read still blocked in hidapi. The
+// keyboard answers every report, so a protocol version request is sent to
+// finish the read. If it still does not finish the device is left open.
+func (t *hidTransport) Close() error {
+	if t.inflight != nil {
+		probe := make([]byte, HidMessageSize)
+		probe[0] = GetProtocolVersionId
+		t.device.Write(probe)
+
+		timer := time.NewTimer(hidCloseTimeout)
+		defer timer.Stop()
+		select {
+		case <-t.inflight:
+			t.inflight = nil
+		case <-timer.C:
+			return ErrorReadInFlight
+		}
+	}
+	return t.device.Close()
+}
+
+func (t *hidTransport) DeviceInfo() Keyboard {
+	return keyboardFromHid(t.device.DeviceInfo)
+}
+
+// backgroundTransport makes a ContextReader of a Transport without one. As
+// with hidTransport, an abandoned Read is collected by the next read rather
+// than another Read started beside it.
+type backgroundTransport struct {
+	Transport
+	inflight chan pendingRead
+}
+
+// withContextReader wraps transports which are not ContextReaders
+func withContextReader(transport Transport) Transport {
+	if _, ok := transport.(ContextReader); ok {
+		return transport
+	}
+	return &backgroundTransport{Transport: transport}
+}
+
+func (t *backgroundTransport) Read(b []byte) (int, error) {
+	return t.ReadContext(context.Background(), b)
+}
+
+func (t *backgroundTransport) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if t.inflight == nil {
+		reads := make(chan pendingRead, 1)
+		t.inflight = reads
+		go func(size int) {
+			report := make([]byte, size)
+			n, err := t.Transport.Read(report)
+			reads <- pendingRead{report, n, err}
+		}(len(b))
+	}
+	select {
+	case read := <-t.inflight:
+		t.inflight = nil
+		return copy(b, read.report[:read.n]), read.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
@@ -0,0 +1,81 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+//go:build linux
+// +build linux
+
+package qmk
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysfsUSBDevices is where Linux lists attached USB devices and interfaces
+const sysfsUSBDevices = "/sys/bus/usb/devices"
+
+// enumerateUSB lists attached USB devices of every class, so bootloaders
+// which are not HID devices can be spotted
+func enumerateUSB() []Keyboard {
+	return enumerateSysfs(sysfsUSBDevices)
+}
+
+// enumerateSysfs lists the USB devices under a sysfs devices directory. Paths
+// are sysfs device directories.
+func enumerateSysfs(root string) []Keyboard {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil
+	}
+	var devices []Keyboard
+	for _, entry := range entries {
+		// Interfaces are listed as <device>:<config>.<interface>
+		if strings.Contains(entry.Name(), ":") {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		vendor, err := sysfsHex(dir, "idVendor")
+		if err != nil {
+			continue
+		}
+		product, err := sysfsHex(dir, "idProduct")
+		if err != nil {
+			continue
+		}
+		release, _ := sysfsHex(dir, "bcdDevice")
+		devices = append(devices, Keyboard{
+			VendorID:     vendor,
+			ProductID:    product,
+			Serial:       sysfsString(dir, "serial"),
+			Path:         dir,
+			Manufacturer: sysfsString(dir, "manufacturer"),
+			Product:      sysfsString(dir, "product"),
+			Release:      release,
+		})
+	}
+	return devices
+}
+
+// sysfsString reads a sysfs attribute, empty if the device has none
+func sysfsString(dir string, name string) string {
+	value, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
+
+// sysfsHex reads a sysfs attribute written as four hex digits
+func sysfsHex(dir string, name string) (uint16, error) {
+	value, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(value)), 16, 16)
+	return uint16(id), err
+}
@@ -0,0 +1,61 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+//go:build linux
+// +build linux
+
+package qmk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnumerateSysfs(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		// An STM32 in its DFU bootloader, which is not a HID device
+		"1-2/idVendor":     "0483\n",
+		"1-2/idProduct":    "df11\n",
+		"1-2/bcdDevice":    "2200\n",
+		"1-2/manufacturer": "STMicroelectronics\n",
+		"1-2/product":      "STM32  BOOTLOADER\n",
+		"1-2/serial":       "FFFFFFFEFFFF\n",
+		// Interfaces and hubs without IDs are skipped
+		"1-2:1.0/bInterfaceClass": "fe\n",
+		"usb1/bDeviceClass":       "09\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	devices := enumerateSysfs(root)
+	if len(devices) != 1 {
+		t.Fatalf("wanted 1 device, got %v", devices)
+	}
+	want := Keyboard{
+		VendorID:     0x0483,
+		ProductID:    0xDF11,
+		Serial:       "FFFFFFFEFFFF",
+		Path:         filepath.Join(root, "1-2"),
+		Manufacturer: "STMicroelectronics",
+		Product:      "STM32  BOOTLOADER",
+		Release:      0x2200,
+	}
+	if devices[0] != want {
+		t.Errorf("wanted %+v, got %+v", want, devices[0])
+	}
+	if bootloader, ok := findBootloader(devices[0]); !ok || bootloader.Name != "stm32-dfu" {
+		t.Errorf("wanted stm32-dfu, got %v", bootloader)
+	}
+}
@@ -0,0 +1,16 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+//go:build !linux
+// +build !linux
+
+package qmk
+
+// enumerateUSB lists no devices, as only Linux has a USB enumerator. Only HID
+// bootloaders are seen, through enumerateDevices.
+func enumerateUSB() []Keyboard {
+	return nil
+}
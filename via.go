@@ -6,11 +6,22 @@
 
 package qmk
 
+import "fmt"
+
 // VIA Protocol
 // This is changed only when the command IDs change,
 // so VIA Configurator can detect compatible firmware.
 const (
-	ViaProtocolVersion = 0x0009
+	ViaProtocolVersion = ViaProtocolVersion9
+
+	ViaProtocolVersion9  = 0x0009
+	ViaProtocolVersion10 = 0x000A
+	ViaProtocolVersion11 = 0x000B
+	ViaProtocolVersion12 = 0x000C
+
+	// Range of versions a Client can negotiate
+	MinViaProtocolVersion = ViaProtocolVersion9
+	MaxViaProtocolVersion = ViaProtocolVersion12
 )
 
 // HID Usage Page
@@ -41,14 +52,50 @@ const (
 	DynamicKeymapGetLayerCountId      = 0x11
 	DynamicKeymapGetBufferId          = 0x12
 	DynamicKeymapSetBufferId          = 0x13
+	DynamicKeymapGetEncoderId         = 0x14
+	DynamicKeymapSetEncoderId         = 0x15
 	UnhandledId                       = 0xFF
 )
 
+var commandNames = map[byte]string{
+	GetProtocolVersionId:              "id_get_protocol_version",
+	GetKeyboardValueId:                "id_get_keyboard_value",
+	SetKeyboardValueId:                "id_set_keyboard_value",
+	DynamicKeymapGetKeycodeId:         "id_dynamic_keymap_get_keycode",
+	DynamicKeymapSetKeycodeId:         "id_dynamic_keymap_set_keycode",
+	DynamicKeymapResetId:              "id_dynamic_keymap_reset",
+	LightingSetValueId:                "id_lighting_set_value",
+	LightingGetValueId:                "id_lighting_get_value",
+	LightingSaveId:                    "id_lighting_save",
+	EepromResetId:                     "id_eeprom_reset",
+	BootloaderJumpId:                  "id_bootloader_jump",
+	DynamicKeymapMacroGetCountId:      "id_dynamic_keymap_macro_get_count",
+	DynamicKeymapMacroGetBufferSizeId: "id_dynamic_keymap_macro_get_buffer_size",
+	DynamicKeymapMacroGetBufferId:     "id_dynamic_keymap_macro_get_buffer",
+	DynamicKeymapMacroSetBufferId:     "id_dynamic_keymap_macro_set_buffer",
+	DynamicKeymapMacroResetId:         "id_dynamic_keymap_macro_reset",
+	DynamicKeymapGetLayerCountId:      "id_dynamic_keymap_get_layer_count",
+	DynamicKeymapGetBufferId:          "id_dynamic_keymap_get_buffer",
+	DynamicKeymapSetBufferId:          "id_dynamic_keymap_set_buffer",
+	DynamicKeymapGetEncoderId:         "id_dynamic_keymap_get_encoder",
+	DynamicKeymapSetEncoderId:         "id_dynamic_keymap_set_encoder",
+	UnhandledId:                       "id_unhandled",
+}
+
+func commandName(id byte) string {
+	if name, ok := commandNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("command 0x%02x", id)
+}
+
 // VIA Keyboard Value IDs
 const (
 	UptimeId            = 0x01
 	LayoutOptionsId     = 0x02
 	SwitchMatrixStateId = 0x03
+	FirmwareVersionId   = 0x04
+	DeviceIndicationId  = 0x05
 )
 
 // VIA Lighting Value IDs
@@ -62,6 +109,58 @@ const (
 	RgblightColorId       = 0x83
 )
 
+// VIA v12 Custom Value Command IDs, which replace the lighting commands
+const (
+	CustomSetValueId = 0x07
+	CustomGetValueId = 0x08
+	CustomSaveId     = 0x09
+)
+
+// VIA v12 Custom Value Channel IDs
+const (
+	CustomChannelId    = 0x00 // Keyboard-specific custom menus
+	BacklightChannelId = 0x01
+	RgblightChannelId  = 0x02
+	RgbMatrixChannelId = 0x03
+	AudioChannelId     = 0x04
+	LedMatrixChannelId = 0x05
+)
+
+// VIA v12 Backlight Channel Value IDs
+const (
+	QmkBacklightBrightnessId = 0x01
+	QmkBacklightEffectId     = 0x02
+)
+
+// VIA v12 Rgblight Channel Value IDs
+const (
+	QmkRgblightBrightnessId  = 0x01
+	QmkRgblightEffectId      = 0x02
+	QmkRgblightEffectSpeedId = 0x03
+	QmkRgblightColorId       = 0x04
+)
+
+// VIA v12 RGB Matrix Channel Value IDs
+const (
+	QmkRgbMatrixBrightnessId  = 0x01
+	QmkRgbMatrixEffectId      = 0x02
+	QmkRgbMatrixEffectSpeedId = 0x03
+	QmkRgbMatrixColorId       = 0x04
+)
+
+// VIA v12 LED Matrix Channel Value IDs
+const (
+	QmkLedMatrixBrightnessId  = 0x01
+	QmkLedMatrixEffectId      = 0x02
+	QmkLedMatrixEffectSpeedId = 0x03
+)
+
+// VIA v12 Audio Channel Value IDs
+const (
+	QmkAudioEnableId       = 0x01
+	QmkAudioClickyEnableId = 0x02
+)
+
 // Dynamic Keymap
 const (
 	MaxDynamicKeymapBufferSize = 28
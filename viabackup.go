@@ -0,0 +1,403 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ianmclinden/qmk-go/backlight"
+	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/keymap"
+	"github.com/ianmclinden/qmk-go/rgblight"
+)
+
+var (
+	ErrorBackupMismatch = errors.New("backup is for a different keyboard")
+	ErrorMacrosTooLarge = errors.New("macros do not fit the keyboard's macro buffer")
+)
+
+// ViaBackup is the layout file written by VIA's "Save + Load". Layers list
+// keycodes in switch matrix order, and macros are VIA macro text. Keycodes
+// without a name are hex literals in the numbering of the keyboard's protocol
+// version, as VIA writes them.
+type ViaBackup struct {
+	Name string `json:"name"`
+	// Vendor ID in the high 16 bits, product ID in the low 16 bits
+	VendorProductID uint32     `json:"vendorProductId"`
+	Macros          []string   `json:"macros"`
+	Layers          [][]string `json:"layers"`
+	// Encoder keycodes by layer and encoder, counter-clockwise then clockwise
+	Encoders [][][2]string `json:"encoders,omitempty"`
+	// Protocol version whose numbering hex literals use. Not written by VIA,
+	// so backups without one are read in the numbering of the keyboard they
+	// are applied to, or in legacy numbering by Keymap.
+	ProtocolVersion uint16 `json:"protocolVersion,omitempty"`
+	// Not written by VIA, which ignores it
+	Lighting *ViaBackupLighting `json:"lighting,omitempty"`
+}
+
+// ViaBackupLighting holds the settings of whichever lighting subsystems the
+// keyboard has
+type ViaBackupLighting struct {
+	Backlight *BacklightSettings `json:"backlight,omitempty"`
+	Rgblight  *RgblightSettings  `json:"rgblight,omitempty"`
+}
+
+type BacklightSettings struct {
+	Brightness backlight.Brightness `json:"brightness"`
+	Effect     backlight.Effect     `json:"effect"`
+}
+
+type RgblightSettings struct {
+	Effect      rgblight.Effect `json:"effect"`
+	EffectSpeed rgblight.Speed  `json:"effectSpeed"`
+	Color       rgblight.Color  `json:"color"`
+}
+
+// ReadViaBackup decodes a VIA layout file
+func ReadViaBackup(r io.Reader) (*ViaBackup, error) {
+	backup := &ViaBackup{}
+	if err := json.NewDecoder(r).Decode(backup); err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// Write encodes the backup as indented JSON
+func (b *ViaBackup) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(b)
+}
+
+func (b *ViaBackup) VendorID() uint16 {
+	return uint16(b.VendorProductID >> 16)
+}
+
+func (b *ViaBackup) ProductID() uint16 {
+	return uint16(b.VendorProductID)
+}
+
+// keycodes is the numbering of the backup's hex literals, that of protocol
+// if the backup does not say
+func (b *ViaBackup) keycodes(protocol uint16) keycodeEncoding {
+	if b.ProtocolVersion != 0 {
+		protocol = b.ProtocolVersion
+	}
+	return keycodesFor(protocol)
+}
+
+// formatBackupKeycode names a keycode, or writes it as a hex literal in the
+// given numbering
+func formatBackupKeycode(code keycode.Keycode, keycodes keycodeEncoding) string {
+	if code.Name() == "UNKNOWN" {
+		return fmt.Sprintf("0x%04X", uint16(keycodes.encode(code)))
+	}
+	return code.String()
+}
+
+// parseBackupKeycode parses a keycode, reading hex literals in the given
+// numbering
+func parseBackupKeycode(value string, keycodes keycodeEncoding) (keycode.Keycode, error) {
+	code, err := keycode.KeycodeFromString(value)
+	if err != nil {
+		return code, err
+	}
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "0x") || strings.HasPrefix(value, "0X") {
+		return keycodes.decode(code), nil
+	}
+	return code, nil
+}
+
+// Keymap decodes the layers for a rows x cols switch matrix
+func (b *ViaBackup) Keymap(rows uint8, cols uint8) (keymap.Keymap, error) {
+	return b.keymap(rows, cols, b.keycodes(0))
+}
+
+func (b *ViaBackup) keymap(rows uint8, cols uint8, keycodes keycodeEncoding) (keymap.Keymap, error) {
+	k := keymap.New(len(b.Layers), int(rows), int(cols))
+	for layer, keys := range b.Layers {
+		if len(keys) != int(rows)*int(cols) {
+			return nil, fmt.Errorf("%w: layer %d has %d keys, wanted %dx%d", keymap.ErrorBadDimensions, layer, len(keys), rows, cols)
+		}
+		for i, value := range keys {
+			code, err := parseBackupKeycode(value, keycodes)
+			if err != nil {
+				return nil, &keymap.KeyError{Layer: layer, Index: i, Value: value, Err: err}
+			}
+			k[layer][i/int(cols)][i%int(cols)] = code
+		}
+	}
+	return k, nil
+}
+
+// EncoderKeycodes decodes the encoders, by layer and encoder, counter-clockwise
+// then clockwise
+func (b *ViaBackup) EncoderKeycodes() ([][][2]keycode.Keycode, error) {
+	return b.encoderKeycodes(b.keycodes(0))
+}
+
+func (b *ViaBackup) encoderKeycodes(keycodes keycodeEncoding) ([][][2]keycode.Keycode, error) {
+	encoders := make([][][2]keycode.Keycode, len(b.Encoders))
+	for layer := range b.Encoders {
+		encoders[layer] = make([][2]keycode.Keycode, len(b.Encoders[layer]))
+		for i, values := range b.Encoders[layer] {
+			for direction, value := range values {
+				code, err := parseBackupKeycode(value, keycodes)
+				if err != nil {
+					return nil, fmt.Errorf("layer %d encoder %d: %w %q", layer, i, err, value)
+				}
+				encoders[layer][i][direction] = code
+			}
+		}
+	}
+	return encoders, nil
+}
+
+// ViaBackupOption configures NewViaBackup
+type ViaBackupOption func(*viaBackupOptions)
+
+type viaBackupOptions struct {
+	encoders uint8
+}
+
+// WithBackupEncoders reads count encoders on every layer into the backup. VIA
+// cannot ask a keyboard how many encoders it has, so by default none are
+// read.
+func WithBackupEncoders(count uint8) ViaBackupOption {
+	return func(o *viaBackupOptions) {
+		o.encoders = count
+	}
+}
+
+// NewViaBackup reads the keymap, encoders, macros and lighting of a keyboard
+// with a rows x cols switch matrix
+func NewViaBackup(client Client, rows uint8, cols uint8, opts ...ViaBackupOption) (*ViaBackup, error) {
+	options := viaBackupOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	keyboard := client.Keyboard()
+	capabilities, err := client.Capabilities()
+	if err != nil {
+		return nil, err
+	}
+	backup := &ViaBackup{
+		Name:            keyboard.Name(),
+		VendorProductID: uint32(keyboard.VendorID)<<16 | uint32(keyboard.ProductID),
+		Macros:          make([]string, capabilities.MacroCount),
+		ProtocolVersion: capabilities.ProtocolVersion,
+	}
+	keycodes := backup.keycodes(0)
+
+	k, err := client.ReadKeymap(rows, cols, nil)
+	if err != nil {
+		return nil, err
+	}
+	backup.Layers = make([][]string, k.Layers())
+	for layer := range k {
+		for row := range k[layer] {
+			for _, code := range k[layer][row] {
+				backup.Layers[layer] = append(backup.Layers[layer], formatBackupKeycode(code, keycodes))
+			}
+		}
+	}
+
+	if options.encoders > 0 {
+		if backup.Encoders, err = readEncoders(client, k.Layers(), options.encoders, keycodes); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range backup.Macros {
+		macro, err := client.GetDynamicKeymapMacro(uint8(i))
+		if err != nil {
+			return nil, err
+		}
+		if backup.Macros[i], err = DecodeMacro(macro, capabilities.ProtocolVersion); err != nil {
+			return nil, fmt.Errorf("macro %d: %w", i, err)
+		}
+	}
+
+	if capabilities.Backlight || capabilities.Rgblight {
+		if backup.Lighting, err = readLighting(client, capabilities); err != nil {
+			return nil, err
+		}
+	}
+	return backup, nil
+}
+
+func readEncoders(client Client, layers int, count uint8, keycodes keycodeEncoding) ([][][2]string, error) {
+	encoders := make([][][2]string, layers)
+	for layer := range encoders {
+		encoders[layer] = make([][2]string, count)
+		for i := range encoders[layer] {
+			for direction, clockwise := range []bool{false, true} {
+				code, err := client.GetDynamicKeymapEncoder(uint8(layer), uint8(i), clockwise)
+				if err != nil {
+					return nil, fmt.Errorf("layer %d encoder %d: %w", layer, i, err)
+				}
+				encoders[layer][i][direction] = formatBackupKeycode(code, keycodes)
+			}
+		}
+	}
+	return encoders, nil
+}
+
+func readLighting(client Client, capabilities Capabilities) (*ViaBackupLighting, error) {
+	var (
+		lighting = &ViaBackupLighting{}
+		err      error
+	)
+	if capabilities.Backlight {
+		settings := &BacklightSettings{}
+		if settings.Brightness, err = client.GetBacklightBrightness(); err != nil {
+			return nil, err
+		}
+		if settings.Effect, err = client.GetBacklightEffect(); err != nil {
+			return nil, err
+		}
+		lighting.Backlight = settings
+	}
+	if capabilities.Rgblight {
+		settings := &RgblightSettings{}
+		if settings.Effect, err = client.GetRgblightEffect(); err != nil {
+			return nil, err
+		}
+		if settings.EffectSpeed, err = client.GetRgblightEffectSpeed(); err != nil {
+			return nil, err
+		}
+		if settings.Color, err = client.GetRgblightColor(); err != nil {
+			return nil, err
+		}
+		lighting.Rgblight = settings
+	}
+	return lighting, nil
+}
+
+// Apply writes the backup to a keyboard with a rows x cols switch matrix. The
+// keymap is written with WriteKeymap, then encoders and the whole macro
+// buffer, and lighting (if any) is saved. Nothing is written if the backup
+// does not convert; it fails with ErrorBackupMismatch if the keyboard has
+// different vendor and product IDs, and with ErrorMacrosTooLarge if the
+// macros overflow its macro buffer.
+func (b *ViaBackup) Apply(client Client, rows uint8, cols uint8) error {
+	keyboard := client.Keyboard()
+	if b.VendorProductID != 0 && (b.VendorID() != keyboard.VendorID || b.ProductID() != keyboard.ProductID) {
+		return fmt.Errorf("%w: backup is for %04x:%04x, keyboard is %04x:%04x", ErrorBackupMismatch,
+			b.VendorID(), b.ProductID(), keyboard.VendorID, keyboard.ProductID)
+	}
+	capabilities, err := client.Capabilities()
+	if err != nil {
+		return err
+	}
+
+	// Check everything converts before writing anything
+	keycodes := b.keycodes(capabilities.ProtocolVersion)
+	k, err := b.keymap(rows, cols, keycodes)
+	if err != nil {
+		return err
+	}
+	encoders, err := b.encoderKeycodes(keycodes)
+	if err != nil {
+		return err
+	}
+	if len(encoders) > 0 && !capabilities.Encoders {
+		return fmt.Errorf("encoders: %w", unsupported(DynamicKeymapSetEncoderId, 0))
+	}
+	// Macros are written as one NUL separated buffer, so they must all fit
+	var macros []byte
+	for i, text := range b.Macros {
+		if i >= int(capabilities.MacroCount) {
+			if text != "" {
+				return fmt.Errorf("macro %d: keyboard has %d macros", i, capabilities.MacroCount)
+			}
+			continue
+		}
+		macro, err := EncodeMacro(text, capabilities.ProtocolVersion)
+		if err != nil {
+			return fmt.Errorf("macro %d: %w", i, err)
+		}
+		macros = append(append(macros, macro...), 0)
+	}
+	if len(macros) > int(capabilities.MacroBufferSize) {
+		return fmt.Errorf("%w: %d bytes, buffer is %d", ErrorMacrosTooLarge, len(macros), capabilities.MacroBufferSize)
+	}
+
+	if err := client.WriteKeymap(k, nil); err != nil {
+		return err
+	}
+	for layer := range encoders {
+		for i, codes := range encoders[layer] {
+			for direction, clockwise := range []bool{false, true} {
+				if err := client.SetDynamicKeymapEncoder(uint8(layer), uint8(i), clockwise, codes[direction]); err != nil {
+					return fmt.Errorf("layer %d encoder %d: %w", layer, i, err)
+				}
+			}
+		}
+	}
+	if len(b.Macros) > 0 {
+		if err := writeMacroBuffer(client, macros, capabilities.MacroBufferSize); err != nil {
+			return fmt.Errorf("macros: %w", err)
+		}
+	}
+	if b.Lighting != nil {
+		return applyLighting(client, capabilities, b.Lighting)
+	}
+	return nil
+}
+
+// writeMacroBuffer writes macros over the whole macro buffer, clearing
+// whatever followed them
+func writeMacroBuffer(client Client, macros []byte, size uint16) error {
+	buffer := make([]byte, size)
+	copy(buffer, macros)
+	for offset := 0; offset < len(buffer); offset += MaxDynamicKeymapBufferSize {
+		end := offset + MaxDynamicKeymapBufferSize
+		if end > len(buffer) {
+			end = len(buffer)
+		}
+		if err := client.SetDynamicKeymapMacroBuffer(uint16(offset), uint8(end-offset), buffer[offset:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyLighting(client Client, capabilities Capabilities, lighting *ViaBackupLighting) error {
+	applied := false
+	if lighting.Backlight != nil && capabilities.Backlight {
+		applied = true
+		if err := client.SetBacklightBrightness(lighting.Backlight.Brightness); err != nil {
+			return err
+		}
+		if err := client.SetBacklightEffect(lighting.Backlight.Effect); err != nil {
+			return err
+		}
+	}
+	if lighting.Rgblight != nil && capabilities.Rgblight {
+		applied = true
+		if err := client.SetRgblightEffect(lighting.Rgblight.Effect); err != nil {
+			return err
+		}
+		if err := client.SetRgblightEffectSpeed(lighting.Rgblight.EffectSpeed); err != nil {
+			return err
+		}
+		if err := client.SetRgblightColor(lighting.Rgblight.Color, true); err != nil {
+			return err
+		}
+	}
+	if !applied {
+		return nil
+	}
+	return client.SaveLighting()
+}
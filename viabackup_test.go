@@ -0,0 +1,299 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ianmclinden/qmk-go"
+	"github.com/ianmclinden/qmk-go/keycode"
+	"github.com/ianmclinden/qmk-go/keymap"
+	"github.com/ianmclinden/qmk-go/qmktest"
+)
+
+const testViaBackup = `{
+  "name": "Test Board",
+  "vendorProductId": 4660,
+  "macros": ["hi{KC_ENT}", "", "{KC_LCTL,KC_C}"],
+  "layers": [
+    ["KC_ESC", "KC_Q", "KC_W", "MO(1)", "KC_LSFT", "0x7E00"],
+    ["KC_TRNS", "KC_1", "KC_2", "KC_TRNS", "KC_NO", "KC_NO"]
+  ]
+}`
+
+func testViaBackupConfig() qmktest.Config {
+	config := qmktest.DefaultConfig
+	config.Keyboard.VendorID, config.Keyboard.ProductID = 0x0000, 0x1234
+	config.Layers, config.Rows, config.Cols = 2, 2, 3
+	return config
+}
+
+func TestViaBackupApply(t *testing.T) {
+	backup, err := qmk.ReadViaBackup(strings.NewReader(testViaBackup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, emulator := newTestClient(t, testViaBackupConfig())
+	if err := backup.Apply(client, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []keycode.Keycode{
+		keycode.KC_ESC, keycode.KC_Q, keycode.KC_W, 0x5101, keycode.KC_LSFT, 0x7E00,
+		keycode.KC_TRNS, keycode.KC_1, keycode.KC_2, keycode.KC_TRNS, keycode.KC_NO, keycode.KC_NO,
+	}
+	for i, code := range want {
+		layer, row, col := uint8(i/6), uint8(i/3%2), uint8(i%3)
+		if got := emulator.Keycode(layer, row, col); got != code {
+			t.Errorf("wanted keycode %s at %d,%d,%d, got %s", code, layer, row, col, got)
+		}
+	}
+
+	for i, text := range backup.Macros {
+		macro, err := client.GetDynamicKeymapMacro(uint8(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := qmk.DecodeMacro(macro, qmk.ViaProtocolVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, _ := qmk.EncodeMacro(text, qmk.ViaProtocolVersion)
+		if !bytes.Equal(macro, encoded) {
+			t.Errorf("[%d] wanted macro %q, got %q", i, text, decoded)
+		}
+	}
+	if saves := emulator.LightingSaves(); saves != 0 {
+		t.Errorf("wanted no lighting saves without lighting, got %d", saves)
+	}
+}
+
+func TestViaBackupRoundTrip(t *testing.T) {
+	config := testViaBackupConfig()
+	config.Keymap = testKeymap(2, 2, 3)
+	source, _ := newTestClient(t, config)
+	if err := source.SetDynamicKeymapMacro(1, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.SetBacklightBrightness(0x40); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := qmk.NewViaBackup(source, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.VendorProductID != 0x1234 || len(backup.Layers) != 2 || len(backup.Macros) != 16 {
+		t.Fatalf("wanted 0x1234 with 2 layers and 16 macros, got 0x%x with %d layers and %d macros",
+			backup.VendorProductID, len(backup.Layers), len(backup.Macros))
+	}
+	if backup.Lighting == nil || backup.Lighting.Backlight == nil || backup.Lighting.Backlight.Brightness != 0x40 {
+		t.Fatalf("wanted backlight brightness 0x40 in backup, got %+v", backup.Lighting)
+	}
+
+	var file bytes.Buffer
+	if err := backup.Write(&file); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := qmk.ReadViaBackup(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, emulator := newTestClient(t, testViaBackupConfig())
+	if err := loaded.Apply(target, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	for i, code := range config.Keymap {
+		layer, row, col := uint8(i/6), uint8(i/3%2), uint8(i%3)
+		if got := emulator.Keycode(layer, row, col); got != code {
+			t.Errorf("wanted keycode 0x%04x at %d,%d,%d, got 0x%04x", uint16(code), layer, row, col, uint16(got))
+		}
+	}
+	if macro, _ := target.GetDynamicKeymapMacro(1); string(macro) != "abc" {
+		t.Errorf("wanted macro 1 %q, got %q", "abc", macro)
+	}
+	if brightness, _ := target.GetBacklightBrightness(); brightness != 0x40 {
+		t.Errorf("wanted backlight brightness 0x40, got 0x%02x", brightness)
+	}
+	if saves := emulator.LightingSaves(); saves != 1 {
+		t.Errorf("wanted 1 lighting save, got %d", saves)
+	}
+}
+
+func TestViaBackupMismatch(t *testing.T) {
+	backup, err := qmk.ReadViaBackup(strings.NewReader(testViaBackup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testViaBackupConfig()
+	config.Keyboard.ProductID = 0x4321
+	client, emulator := newTestClient(t, config)
+	if err := backup.Apply(client, 2, 3); !errors.Is(err, qmk.ErrorBackupMismatch) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorBackupMismatch, err)
+	}
+	if code := emulator.Keycode(0, 0, 0); code != keycode.KC_NO {
+		t.Errorf("wanted keymap untouched, got %s", code)
+	}
+}
+
+func TestViaBackupMacrosTooLarge(t *testing.T) {
+	backup, err := qmk.ReadViaBackup(strings.NewReader(testViaBackup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup.Macros = []string{"0123456789", "0123456789", "0123456789", "0123456789"}
+	config := testViaBackupConfig()
+	config.MacroCount, config.MacroBufferSize = 4, 40
+	client, emulator := newTestClient(t, config)
+	if err := backup.Apply(client, 2, 3); !errors.Is(err, qmk.ErrorMacrosTooLarge) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorMacrosTooLarge, err)
+	}
+	if code := emulator.Keycode(0, 0, 0); code != keycode.KC_NO {
+		t.Errorf("wanted keymap untouched, got %s", code)
+	}
+	if macros := emulator.MacroBuffer(); !bytes.Equal(macros, make([]byte, 40)) {
+		t.Errorf("wanted macros untouched, got %q", macros)
+	}
+
+	// Three fit, and the whole buffer is written once past the last macro
+	backup.Macros = backup.Macros[:3]
+	if err := backup.Apply(client, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte(strings.Repeat("0123456789\x00", 3) + "\x00\x00\x00\x00\x00\x00\x00")
+	if macros := emulator.MacroBuffer(); !bytes.Equal(macros, want) {
+		t.Errorf("wanted macros %q, got %q", want, macros)
+	}
+}
+
+func TestViaBackupBadKeycode(t *testing.T) {
+	backup, err := qmk.ReadViaBackup(strings.NewReader(strings.Replace(testViaBackup, `"KC_2"`, `"KC_NOPE"`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, emulator := newTestClient(t, testViaBackupConfig())
+	err = backup.Apply(client, 2, 3)
+	var keyErr *keymap.KeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("wanted a key error, got %v", err)
+	}
+	if keyErr.Layer != 1 || keyErr.Index != 2 || keyErr.Value != "KC_NOPE" {
+		t.Errorf("wanted KC_NOPE at layer 1 index 2, got %q at layer %d index %d", keyErr.Value, keyErr.Layer, keyErr.Index)
+	}
+	if code := emulator.Keycode(0, 0, 0); code != keycode.KC_NO {
+		t.Errorf("wanted keymap untouched, got %s", code)
+	}
+}
+
+func TestViaBackupHexLiterals(t *testing.T) {
+	// USER00 is 0x5F80 in legacy numbering and 0x7E00 from v12
+	tests := []struct {
+		backup   uint16
+		keyboard uint16
+		literal  string
+		want     keycode.Keycode
+	}{
+		{0, qmk.ViaProtocolVersion9, "0x7E00", 0x7E00},
+		{0, qmk.ViaProtocolVersion12, "0x7E00", 0x7E00},
+		{qmk.ViaProtocolVersion12, qmk.ViaProtocolVersion12, "0x7E00", 0x7E00},
+		{qmk.ViaProtocolVersion12, qmk.ViaProtocolVersion9, "0x7E00", keycode.USER00},
+		{qmk.ViaProtocolVersion9, qmk.ViaProtocolVersion12, "0x5F80", 0x7E00},
+	}
+	for i, test := range tests {
+		backup, err := qmk.ReadViaBackup(strings.NewReader(strings.Replace(testViaBackup, `"0x7E00"`, `"`+test.literal+`"`, 1)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backup.ProtocolVersion = test.backup
+		config := testViaBackupConfig()
+		config.ProtocolVersion = test.keyboard
+		client, emulator := newTestClient(t, config)
+		if err := backup.Apply(client, 2, 3); err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		if got := emulator.Keycode(0, 1, 2); got != test.want {
+			t.Errorf("[%d] wanted raw keycode 0x%04x, got 0x%04x", i, uint16(test.want), uint16(got))
+		}
+	}
+
+	// Hex literals are written in the numbering of the keyboard's version
+	config := testViaBackupConfig()
+	config.ProtocolVersion = qmk.ViaProtocolVersion12
+	config.Keymap = make([]keycode.Keycode, 12)
+	// A v12 keycode with no name
+	config.Keymap[0] = 0x7E40
+	client, _ := newTestClient(t, config)
+	backup, err := qmk.NewViaBackup(client, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backup.ProtocolVersion != qmk.ViaProtocolVersion12 || backup.Layers[0][0] != "0x7E40" {
+		t.Errorf("wanted v12 backup with 0x7E40, got v%d with %s", backup.ProtocolVersion, backup.Layers[0][0])
+	}
+}
+
+func TestViaBackupEncoders(t *testing.T) {
+	config := testViaBackupConfig()
+	config.ProtocolVersion = qmk.ViaProtocolVersion12
+	source, _ := newTestClient(t, config)
+	// Volume keys, and USER01 which moves in v12
+	codes := map[[3]uint8]keycode.Keycode{
+		{1, 0, 0}: keycode.KC_VOLD,
+		{1, 0, 1}: keycode.KC_VOLU,
+		{0, 1, 1}: keycode.USER01,
+	}
+	for at, code := range codes {
+		if err := source.SetDynamicKeymapEncoder(at[0], at[1], at[2] == 1, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backup, err := qmk.NewViaBackup(source, 2, 3, qmk.WithBackupEncoders(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backup.Encoders) != 2 || len(backup.Encoders[1]) != 2 {
+		t.Fatalf("wanted 2 layers of 2 encoders, got %v", backup.Encoders)
+	}
+	if want := [2]string{"KC_AUDIO_VOL_DOWN", "KC_AUDIO_VOL_UP"}; backup.Encoders[1][0] != want {
+		t.Errorf("wanted encoder %v, got %v", want, backup.Encoders[1][0])
+	}
+
+	var file bytes.Buffer
+	if err := backup.Write(&file); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := qmk.ReadViaBackup(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, emulator := newTestClient(t, config)
+	if err := loaded.Apply(target, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	for at, code := range codes {
+		if got, _ := target.GetDynamicKeymapEncoder(at[0], at[1], at[2] == 1); got != code {
+			t.Errorf("wanted encoder keycode %s at %v, got %s", code, at, got)
+		}
+	}
+	if got := emulator.Encoder(0, 1, true); got != 0x7E01 {
+		t.Errorf("wanted raw v12 keycode 0x7e01, got 0x%04x", uint16(got))
+	}
+
+	// Keyboards before v10 cannot take encoders
+	old, emulator := newTestClient(t, testViaBackupConfig())
+	if err := loaded.Apply(old, 2, 3); !errors.Is(err, qmk.ErrorUnsupported) {
+		t.Errorf("wanted error %v, got %v", qmk.ErrorUnsupported, err)
+	}
+	if code := emulator.Keycode(0, 0, 0); code != keycode.KC_NO {
+		t.Errorf("wanted keymap untouched, got %s", code)
+	}
+}
@@ -0,0 +1,153 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// DefaultWatchInterval is how often a Watcher enumerates keyboards by default
+const DefaultWatchInterval = time.Second
+
+type EventType uint8
+
+const (
+	// A keyboard has appeared
+	Attached EventType = iota
+	// A keyboard has disappeared
+	Detached
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Attached:
+		return "Attached"
+	case Detached:
+		return "Detached"
+	default:
+		return "Unknown"
+	}
+}
+
+// Event reports a keyboard appearing or disappearing
+type Event struct {
+	Type     EventType
+	Keyboard Keyboard
+}
+
+// Watcher reports VIA keyboards as they are attached and detached, by
+// periodically enumerating them
+type Watcher struct {
+	// Lists the keyboards currently attached (defaults to ListKeyboards)
+	Enumerate func() ([]Keyboard, error)
+	// Time between enumerations (defaults to DefaultWatchInterval)
+	Interval time.Duration
+}
+
+// Watch reports keyboards matching filter using a default Watcher
+func Watch(ctx context.Context, filter DeviceFilter) <-chan Event {
+	return (&Watcher{}).Watch(ctx, filter)
+}
+
+// Watch reports keyboards matching filter until ctx is done, at which point
+// the channel is closed. Keyboards already attached are reported first.
+// Keyboards are identified by HID path and serial, so one which is replugged
+// at a new path is reported as detached and attached again.
+func (w *Watcher) Watch(ctx context.Context, filter DeviceFilter) <-chan Event {
+	var (
+		enumerate = w.Enumerate
+		interval  = w.Interval
+		events    = make(chan Event)
+	)
+	if enumerate == nil {
+		enumerate = func() ([]Keyboard, error) { return ListKeyboards() }
+	}
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		attached := map[string]Keyboard{}
+		for {
+			keyboards, err := enumerate()
+			if errors.Is(err, ErrorNoKeyboardsFound) {
+				keyboards, err = nil, nil
+			}
+			// Keep the last known state through enumeration failures
+			if err == nil && !w.update(ctx, events, attached, keyboards, filter) {
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// update diffs the attached keyboards against a new enumeration, sending
+// events and returning false if ctx is done first
+func (w *Watcher) update(ctx context.Context, events chan<- Event, attached map[string]Keyboard, keyboards []Keyboard, filter DeviceFilter) bool {
+	send := func(event Event) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	present := map[string]bool{}
+	for _, keyboard := range keyboards {
+		if !filter.Match(keyboard) {
+			continue
+		}
+		key := watchKey(keyboard)
+		if present[key] {
+			continue
+		}
+		present[key] = true
+		if _, ok := attached[key]; ok {
+			continue
+		}
+		attached[key] = keyboard
+		if !send(Event{Attached, keyboard}) {
+			return false
+		}
+	}
+
+	detached := []string{}
+	for key := range attached {
+		if !present[key] {
+			detached = append(detached, key)
+		}
+	}
+	sort.Strings(detached)
+	for _, key := range detached {
+		keyboard := attached[key]
+		delete(attached, key)
+		if !send(Event{Detached, keyboard}) {
+			return false
+		}
+	}
+	return true
+}
+
+func watchKey(k Keyboard) string {
+	return k.Path + "\x00" + k.Serial
+}
@@ -0,0 +1,92 @@
+// qmk-go - go client library for VIA-enabled QMK keyboards
+// Copyright (c) 2022 Ian McLinden. All rights reserved
+//
+// This file is released under GNU LGPL 2.1 on Linux,
+// and under the 3-clause BSD license on all other platforms
+
+package qmk_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ianmclinden/qmk-go"
+)
+
+var (
+	watchA  = qmk.Keyboard{Path: "/dev/hidraw0", Serial: "A", VendorID: 0x4B54, Product: "Alpha"}
+	watchA2 = qmk.Keyboard{Path: "/dev/hidraw5", Serial: "A", VendorID: 0x4B54, Product: "Alpha"}
+	watchB  = qmk.Keyboard{Path: "/dev/hidraw1", Serial: "B", VendorID: 0x4B54, Product: "Beta"}
+	watchC  = qmk.Keyboard{Path: "/dev/hidraw2", Serial: "C", VendorID: 0x1234, Product: "Gamma"}
+)
+
+// snapshots replays a fixed sequence of enumerations, then repeats the last
+type snapshots struct {
+	mu    sync.Mutex
+	lists [][]qmk.Keyboard
+	errs  []error
+}
+
+func (s *snapshots) enumerate() ([]qmk.Keyboard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keyboards, err := s.lists[0], s.errs[0]
+	if len(s.lists) > 1 {
+		s.lists, s.errs = s.lists[1:], s.errs[1:]
+	}
+	return keyboards, err
+}
+
+func TestWatch(t *testing.T) {
+	source := &snapshots{
+		lists: [][]qmk.Keyboard{
+			{watchA, watchC},
+			{watchA, watchB, watchB},
+			nil,
+			{watchB},
+			{watchA2, watchB},
+		},
+		errs: []error{nil, nil, errors.New("enumeration failed"), nil, nil},
+	}
+	watcher := qmk.Watcher{Enumerate: source.enumerate, Interval: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := watcher.Watch(ctx, qmk.DeviceFilter{VendorID: 0x4B54})
+
+	want := []qmk.Event{
+		{Type: qmk.Attached, Keyboard: watchA},
+		{Type: qmk.Attached, Keyboard: watchB},
+		{Type: qmk.Detached, Keyboard: watchA},
+		{Type: qmk.Attached, Keyboard: watchA2},
+	}
+	for i, w := range want {
+		select {
+		case event := <-events:
+			if event.Type != w.Type || event.Keyboard.Path != w.Keyboard.Path {
+				t.Errorf("[%d] wanted %v %s, got %v %s", i, w.Type, w.Keyboard.Path, event.Type, event.Keyboard.Path)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("[%d] timed out waiting for %v %s", i, w.Type, w.Keyboard.Path)
+		}
+	}
+
+	cancel()
+	for event := range events {
+		t.Errorf("wanted no more events, got %v %s", event.Type, event.Keyboard.Path)
+	}
+}
+
+func TestEventTypeString(t *testing.T) {
+	for i, test := range []struct {
+		Type qmk.EventType
+		Name string
+	}{{qmk.Attached, "Attached"}, {qmk.Detached, "Detached"}, {qmk.EventType(9), "Unknown"}} {
+		if name := test.Type.String(); name != test.Name {
+			t.Errorf("[%d] wanted event type %v, got %v", i, test.Name, name)
+		}
+	}
+}